@@ -6,6 +6,7 @@ import (
 	"aws-ssh/lib/ec2connect"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	homedir "github.com/mitchellh/go-homedir"
@@ -17,13 +18,26 @@ var connectCmd = &cobra.Command{
 	Use:   "connect [ssh command (ssh -tt {host})]",
 	Short: "SSH into the EC2 instance using ec2 connect feature",
 	Long: `aws-ssh connects to the EC2 instance using ec2 connect feature. It makes a special API call to upload
-the first public key from your running ssh agent and then runs ssh command.
+the first public key supported by ec2 connect from your running ssh agent (or the one chosen with --key,
+or a new ephemeral key with --ephemeral) and then runs ssh command.
 
 The ssh command accepts the following placeholders:
 1. {host} - will be replaced with the actual host
 2. {user} - will be replaced with the user.
 
-These placeholders are useful when you need to override the ssh command.`,
+These placeholders are useful when you need to override the ssh command.
+
+With --native the built-in ssh client is used instead, so neither ssh nor the generated ssh config is needed.
+It connects through the bastions, allocates a terminal for the interactive shell and, if the arguments are given,
+runs them as the command on the instance. The host keys are checked against ~/.ssh/known_hosts, adding the new hosts.
+
+With --auto-path the ways to reach the instance are probed with short TCP connections: its private address directly
+(e.g. over VPN), then the bastion, then its public address, and the first reachable one is used.
+The results of the private address probes are cached per VPC and its CIDR block for a few minutes.
+It only works in the cache mode.
+
+If the instance has been cached as stopped (run "aws-ssh update --stopped" to cache them), connect offers to start it,
+or starts it right away with --start. Then it waits for the instance to get running and its ssh port to open.`,
 	Aliases: []string{"ssh"},
 	/* There are 2 modes of this command:
 	   1. Run with the specified instanceid and AWS profile
@@ -34,6 +48,9 @@ These placeholders are useful when you need to override the ssh command.`,
 	   switch to the mode 2
 	*/
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+
 		var sshEntries lib.SSHEntries
 		var profile string
 		var instanceID = viper.GetString("instanceid")
@@ -41,8 +58,12 @@ These placeholders are useful when you need to override the ssh command.`,
 
 		profiles := viper.GetStringSlice("profiles")
 		if len(profiles) > 0 && strings.HasPrefix(instanceID, "i-") {
+			if viper.GetBool("auto-path") {
+				log.Fatal("--auto-path needs the cache to know the ways to reach the instance, it can't be used with -p and -i")
+			}
 			profile = profiles[0]
 			ec2connect.ConnectEC2(
+				ctx,
 				lib.SSHEntries{
 					&lib.SSHEntry{
 						ProfileConfig: lib.ProfileConfig{Name: profile},
@@ -53,6 +74,7 @@ These placeholders are useful when you need to override the ssh command.`,
 				},
 				viper.GetString("ssh-config-path"),
 				args,
+				connectOptions(),
 			)
 		} else {
 			// ok, profile is not set, switch to mode 2
@@ -66,30 +88,53 @@ These placeholders are useful when you need to override the ssh command.`,
 			if instanceUser != "" {
 				sshEntry.User = instanceUser
 			}
+			warnIfStale(cache, sshEntry.ProfileConfig.Name)
 
-			sshEntries = append(sshEntries, &sshEntry)
-			// ProxyJump is set, which means we need to lookup the bastion host too
-			if sshEntry.ProxyJump != "" {
-				bastionEntry, err := cache.Lookup(sshEntry.ProxyJump)
-				if err != nil {
-					log.WithError(err).Fatalf("can't lookup bastion %s in cache", sshEntry.ProxyJump)
-				}
+			// ProxyJump is set, which means we need to lookup the bastion hosts too,
+			// following their own ProxyJumps
+			sshEntries, err = withJumpHosts(cache, sshEntry)
+			if err != nil {
+				log.WithError(err).Fatal("can't lookup the bastions in cache")
+			}
+			for _, bastionEntry := range sshEntries[1:] {
 				if instanceUser == "" {
 					bastionEntry.User = instanceUser
 				}
 				log.WithField("instance_id", bastionEntry.InstanceID).Infof("Got bastion %s", bastionEntry.Names[0])
-				sshEntries = append(sshEntries, &bastionEntry)
-			} else {
-				// if ProxyJump is already set we can't just override it,
-				// but if it's empty it means this is the first hop and we can use
-				// the cli-supplied proxyjump flag
-				sshEntry.ProxyJump = viper.GetString("proxyjump")
 			}
-			ec2connect.ConnectEC2(sshEntries, viper.GetString("ssh-config-path"), args)
+			sshEntries = selectPath(ctx, cache, sshEntries, "")
+			// if ProxyJump is already set we can't just override it,
+			// but if it's empty it means this is the first hop and we can use
+			// the cli-supplied proxyjump flag
+			if firstHop := sshEntries[len(sshEntries)-1]; firstHop.ProxyJump == "" {
+				firstHop.ProxyJump = viper.GetString("proxyjump")
+			}
+			ec2connect.ConnectEC2(ctx, sshEntries, viper.GetString("ssh-config-path"), args, connectOptions())
 		}
 	},
 }
 
+// warnIfStale warns if the cached entries of the profile are from the last good update
+func warnIfStale(cache cache.Cache, profile string) {
+	if state, ok := cache.ProfileState(profile); ok && state.Stale {
+		log.WithFields(log.Fields{
+			"profile": profile,
+			"updated": state.Updated.Format(time.RFC3339),
+		}).Warnf("the last cache update of the profile has failed, using stale data")
+	}
+}
+
+// connectOptions returns ec2connect.ConnectOptions from the command line flags
+func connectOptions() ec2connect.ConnectOptions {
+	return ec2connect.ConnectOptions{
+		SecurityGroupID: viper.GetString("security-group-id"),
+		Key:             viper.GetString("key"),
+		Ephemeral:       viper.GetBool("ephemeral"),
+		Native:          viper.GetBool("native"),
+		Start:           viper.GetBool("start"),
+	}
+}
+
 func init() {
 	homeDir, err := homedir.Dir()
 	if err != nil {
@@ -99,12 +144,25 @@ func init() {
 
 	connectCmd.Flags().StringP("instanceid", "i", "", "Instance ID to connect to")
 	connectCmd.Flags().StringP("proxyjump", "j", "", "ProxyJump host to use in the generated ssh config (if there's a bastion proxyjump already this will be added before that)")
-	connectCmd.Flags().StringP("security-group-id", "s", "", "Security group IP to add your IP address to before connecting. If not set, then checks aws-ssh-security-group-id tag on the ec2 instance.")
+	connectCmd.Flags().StringP("security-group-id", "s", "", "Security group ID to add your IP address to before connecting. If not set, then checks aws-ssh-security-group-id tag on the ec2 instance (or the bastion if there is one).")
+	connectCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	connectCmd.Flags().BoolP("ephemeral", "e", false, "Generate a new key for this session instead of using the ssh agent keys. It's added to the agent for a short time if the agent is running, otherwise it's saved to a temporary file")
+	connectCmd.Flags().Bool("native", false, "Use the built-in ssh client instead of running ssh. The arguments are the command to run on the instance then")
+	connectCmd.Flags().Bool("auto-path", false, "Probe the private address, the bastion and the public address of the instance and use the first reachable one")
+	connectCmd.Flags().Duration("probe-timeout", lib.DefaultProbeTimeout, "Timeout of every probe of --auto-path")
+	connectCmd.Flags().Bool("start", false, "Start the instance without asking if it has been cached as stopped (see --stopped of \"update\")")
 	connectCmd.Flags().StringP("ssh-config-path", "c", defaultSSHConfigFile, "Path to the ssh config to generate")
 	connectCmd.Flags().StringP("user", "u", "", "Existing user on the instance")
 
 	viper.BindPFlag("instanceid", connectCmd.Flags().Lookup("instanceid"))
 	viper.BindPFlag("proxyjump", connectCmd.Flags().Lookup("proxyjump"))
+	viper.BindPFlag("security-group-id", connectCmd.Flags().Lookup("security-group-id"))
+	viper.BindPFlag("key", connectCmd.Flags().Lookup("key"))
+	viper.BindPFlag("ephemeral", connectCmd.Flags().Lookup("ephemeral"))
+	viper.BindPFlag("native", connectCmd.Flags().Lookup("native"))
+	viper.BindPFlag("auto-path", connectCmd.Flags().Lookup("auto-path"))
+	viper.BindPFlag("probe-timeout", connectCmd.Flags().Lookup("probe-timeout"))
+	viper.BindPFlag("start", connectCmd.Flags().Lookup("start"))
 	viper.BindPFlag("ssh-config-path", connectCmd.Flags().Lookup("ssh-config-path"))
 	viper.BindPFlag("user", connectCmd.Flags().Lookup("user"))
 
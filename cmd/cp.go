@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"aws-ssh/lib/ec2connect"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp [-r] <source>... <destination>",
+	Short: "Copies files to or from the instances using ec2 connect and scp",
+	Long: `aws-ssh cp copies files and directories (with -r) between this machine and the cached hosts with scp.
+The remote paths are written as host:path, where the host is resolved via the cache by its name or address.
+
+The key is pushed via ec2 connect to the host and its bastion right before running scp, which gets
+the ssh config generated for them, so nothing has to be set up in ~/.ssh/config.
+
+To upload to many hosts at once, use a glob as the destination host. It's matched against the cached names
+like in "aws-ssh list", optionally limited to the profiles given with -p, and up to --parallel hosts
+are copied to at the same time.
+
+  aws-ssh cp ./app.conf prod-web-1:/tmp/
+  aws-ssh cp -r prod-web-1:/var/log/app ./logs
+  aws-ssh cp ./app.conf 'prod-web-*:/tmp/'`,
+	Args: cobra.MinimumNArgs(2),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the flags are shared with other commands
+		viper.BindPFlag("key", cmd.Flags().Lookup("key"))
+		viper.BindPFlag("ephemeral", cmd.Flags().Lookup("ephemeral"))
+		viper.BindPFlag("parallel", cmd.Flags().Lookup("parallel"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+		sources, destination := args[:len(args)-1], args[len(args)-1]
+
+		var hosts []lib.SSHEntries
+		var scpArgs []string
+		if host, path, ok := ec2connect.SplitRemotePath(destination); ok {
+			for _, source := range sources {
+				if _, _, ok := ec2connect.SplitRemotePath(source); ok {
+					log.Fatal("copying between the hosts isn't supported")
+				}
+			}
+			entries, err := ec2connect.FindCopyHosts(cache, host, viper.GetStringSlice("profiles"))
+			if err != nil {
+				log.WithError(err).Fatal("can't find the hosts to copy to")
+			}
+			for _, entry := range entries {
+				sshEntries, err := withJumpHosts(cache, entry)
+				if err != nil {
+					log.WithError(err).Fatalf("can't get the bastion of %s", entry.Names[0])
+				}
+				hosts = append(hosts, sshEntries)
+			}
+			scpArgs = append(append(scpArgs, sources...), "{host}:"+path)
+		} else {
+			// download from a single host
+			var sourceHost string
+			for _, source := range sources {
+				host, path, ok := ec2connect.SplitRemotePath(source)
+				if !ok {
+					log.Fatalf("either the sources or the destination should be remote, %s is local", source)
+				}
+				if sourceHost != "" && host != sourceHost {
+					log.Fatal("the sources should be on the same host")
+				}
+				sourceHost = host
+				scpArgs = append(scpArgs, "{host}:"+path)
+			}
+			entry, err := cache.Get(sourceHost)
+			if err != nil {
+				log.WithError(err).Fatalf("can't find %s in cache", sourceHost)
+			}
+			sshEntries, err := withJumpHosts(cache, entry)
+			if err != nil {
+				log.WithError(err).Fatalf("can't get the bastion of %s", entry.Names[0])
+			}
+			hosts = append(hosts, sshEntries)
+			scpArgs = append(scpArgs, destination)
+		}
+		for _, sshEntries := range hosts {
+			warnIfStale(cache, sshEntries[0].ProfileConfig.Name)
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+		results, err := ec2connect.Copy(ctx, hosts, scpArgs, ec2connect.CopyOptions{
+			ConnectOptions: ec2connect.ConnectOptions{
+				Key:       viper.GetString("key"),
+				Ephemeral: viper.GetBool("ephemeral"),
+			},
+			Recursive:   viper.GetBool("recursive"),
+			Parallelism: viper.GetInt("parallel"),
+		})
+		if err != nil {
+			log.WithError(err).Fatal("can't copy")
+		}
+
+		if len(results) == 1 {
+			if results[0].Err != nil {
+				log.WithError(results[0].Err).Fatal("can't copy")
+			}
+			os.Exit(results[0].ExitCode)
+		}
+		if failed := printExecSummary(results); failed > 0 {
+			log.Errorf("failed on %d of %d hosts", failed, len(results))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	cpCmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+	cpCmd.Flags().IntP("parallel", "P", 10, "Maximum number of hosts to copy to at the same time, 0 means no limit")
+	cpCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	cpCmd.Flags().BoolP("ephemeral", "e", false, "Generate a new key for this session instead of using the ssh agent keys. It's added to the agent for a short time if the agent is running, otherwise it's saved to a temporary file")
+
+	viper.BindPFlag("recursive", cpCmd.Flags().Lookup("recursive"))
+
+	rootCmd.AddCommand(cpCmd)
+}
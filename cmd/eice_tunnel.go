@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/ec2connect"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var eiceTunnelCmd = &cobra.Command{
+	Use:   "eice-tunnel <endpoint-id> <endpoint-dns-name> <host> <port>",
+	Short: "Proxies the connection to the host through EC2 Instance Connect Endpoint, for use as ssh ProxyCommand",
+	Long: `aws-ssh eice-tunnel opens the tunnel to the port of the host through EC2 Instance Connect Endpoint
+of its VPC and connects it to stdin and stdout, like "aws ec2-instance-connect open-tunnel" does.
+
+It doesn't push any keys, it's what the ssh config generated by "aws-ssh reconf" uses
+for the instances in the VPCs with the endpoints. The AWS profile is taken from the -p flag.`,
+	Args: cobra.ExactArgs(4),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// stdout is the ssh connection, so logs go to stderr
+		log.SetHandler(cli.New(os.Stderr))
+		if !viper.GetBool("debug") {
+			log.SetLevel(log.WarnLevel)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var profile lib.ProfileConfig
+		if profiles := viper.GetStringSlice("profiles"); len(profiles) > 0 {
+			profile.Name = profiles[0]
+		}
+		profile.Region, _ = cmd.Flags().GetString("region")
+
+		endpoint := lib.InstanceConnectEndpoint{ID: args[0], DNSName: args[1]}
+		ctx, cancel := signalContext()
+		defer cancel()
+		if err := ec2connect.EICETunnel(ctx, profile, endpoint, args[2], args[3]); err != nil {
+			log.WithError(err).Fatal("can't proxy the connection")
+		}
+	},
+}
+
+func init() {
+	eiceTunnelCmd.Flags().String("region", "", "Region of the endpoint, the one of the profile by default")
+
+	rootCmd.AddCommand(eiceTunnelCmd)
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"aws-ssh/lib/ec2connect"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [name glob...] -- <command>",
+	Short: "Runs the command on many instances in parallel using ec2 connect",
+	Long: `aws-ssh exec runs the command on all cached hosts matching the filters, which are the same as for
+"aws-ssh list": the name globs, -p for profiles and --tag for tags. At least one filter is required,
+so that the command isn't run everywhere by accident.
+
+The key is pushed via ec2 connect to every host and its bastion right before connecting,
+and the command runs on --parallel hosts at the same time. The output lines are prefixed with the host name,
+or with --group the output of every host is printed at once when the command is done there.
+
+In the end there is the summary with the exit codes, and aws-ssh exits with 1 if the command has failed anywhere.
+
+  aws-ssh exec -p prod 'prod-web*' -- uptime
+  aws-ssh exec --tag role=worker --group -- sudo systemctl status worker`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the flags are shared with other commands
+		viper.BindPFlag("key", cmd.Flags().Lookup("key"))
+		viper.BindPFlag("ephemeral", cmd.Flags().Lookup("ephemeral"))
+		viper.BindPFlag("tag", cmd.Flags().Lookup("tag"))
+		viper.BindPFlag("parallel", cmd.Flags().Lookup("parallel"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 || dash == len(args) {
+			log.Fatal("the command should be given after --")
+		}
+		globs, command := args[:dash], strings.Join(args[dash:], " ")
+
+		profiles := viper.GetStringSlice("profiles")
+		tagFilters := viper.GetStringSlice("tag")
+		if len(globs) == 0 && len(profiles) == 0 && len(tagFilters) == 0 {
+			log.Fatal("no hosts selected, use name globs, -p or --tag")
+		}
+
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+		summaries, err := cache.Load()
+		if err != nil {
+			log.WithError(err).Fatal("can't load the cache")
+		}
+		var hosts []lib.SSHEntries
+		for _, summary := range summaries {
+			if len(profiles) > 0 && !contains(profiles, summary.Name) {
+				continue
+			}
+			if summary.Status != lib.ProfileStatusOK {
+				warnIfStale(cache, summary.Name)
+			}
+			for _, entry := range summary.SSHEntries {
+				if !matchNames(entry, globs) || !matchTags(entry, tagFilters) {
+					continue
+				}
+				sshEntries, err := withJumpHosts(cache, entry)
+				if err != nil {
+					log.WithError(err).Fatalf("can't get the bastion of %s", entry.Names[0])
+				}
+				hosts = append(hosts, sshEntries)
+			}
+		}
+		if len(hosts) == 0 {
+			log.Fatal("no hosts match")
+		}
+		log.Infof("running on %d hosts", len(hosts))
+
+		ctx, cancel := signalContext()
+		defer cancel()
+		results, err := ec2connect.Exec(ctx, hosts, command, ec2connect.ExecOptions{
+			ConnectOptions: ec2connect.ConnectOptions{
+				Key:       viper.GetString("key"),
+				Ephemeral: viper.GetBool("ephemeral"),
+			},
+			Parallelism: viper.GetInt("parallel"),
+			Group:       viper.GetBool("group"),
+		}, os.Stdout, os.Stderr)
+		if err != nil {
+			log.WithError(err).Fatal("can't run the command")
+		}
+
+		if failed := printExecSummary(results); failed > 0 {
+			log.Errorf("failed on %d of %d hosts", failed, len(results))
+			os.Exit(1)
+		}
+	},
+}
+
+// printExecSummary prints the exit codes of all hosts and returns the number of hosts where the command failed
+func printExecSummary(results []ec2connect.ExecResult) int {
+	var failed int
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "\nHOST\tEXIT CODE\tERROR")
+	for _, result := range results {
+		var exitCode, errorMessage = fmt.Sprint(result.ExitCode), ""
+		if result.Err != nil {
+			exitCode, errorMessage = "-", result.Err.Error()
+		}
+		if result.Err != nil || result.ExitCode != 0 {
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", result.Name, exitCode, errorMessage)
+	}
+	writer.Flush()
+	return failed
+}
+
+func init() {
+	execCmd.Flags().IntP("parallel", "P", 10, "Maximum number of hosts to run the command on at the same time, 0 means no limit")
+	execCmd.Flags().BoolP("group", "g", false, "Print the output of every host at once instead of prefixing the lines with the host name")
+	execCmd.Flags().StringSliceP("tag", "t", []string{}, "Filter by tag, either \"key\" or \"key=value glob\". Can be specified multiple times")
+	execCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	execCmd.Flags().BoolP("ephemeral", "e", false, "Generate a new key for this session instead of using the ssh agent keys. It's kept in memory only")
+
+	viper.BindPFlag("group", execCmd.Flags().Lookup("group"))
+
+	rootCmd.AddCommand(execCmd)
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <host>",
+	Short: "Explains how the bastion and the address of the host are chosen",
+	Long: `aws-ssh explain re-runs the choice of the way to reach the cached host and prints
+every bastion considered with its score and source (routed with x-aws-ssh-bastion-for, the VPC, the global ones
+or the ones shared by the other profiles),
+the address chosen and why, and the tags which set the user and the port.
+
+The choice is re-run on the cached instances, or on the instances described right now with --live.
+With --live the host profile and its aws-ssh-bastion-profile are read from the config and described,
+so the changes since the cache update are picked up, but the global bastions of the other profiles aren't considered.
+
+The score of a bastion is the length of the longest common subsequence of its name and the host name.
+Note that the scores are sorted in ascending order and the first one is taken, so among several bastions
+the one with the least similar name is chosen.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+		sshEntry, err := cache.Get(args[0])
+		if err != nil {
+			log.WithError(err).Fatalf("can't find %s in cache", args[0])
+		}
+		summaries, err := cache.Load()
+		if err != nil {
+			log.WithError(err).Fatal("can't load the cache")
+		}
+		var names = make(map[string]string) // bastions are referred by instance id
+		for n, profileSummary := range summaries {
+			// the bastions are matched the way the cache has been updated, unless the flags say otherwise
+			summaries[n].ProfileConfig = withBastionFlags(profileSummary.ProfileConfig)
+			for _, entry := range profileSummary.SSHEntries {
+				names[entry.InstanceID] = entry.Names[0]
+			}
+		}
+
+		options := traverseOptions()
+		var explanation lib.Explanation
+		if viper.GetBool("live") {
+			ctx, cancel := signalContext()
+			defer cancel()
+			// the stopped instance should be found too
+			options.Stopped = true
+			// the profiles are taken from the config, as they can have changed since the cache update
+			var liveProfiles []lib.ProfileConfig
+			profiles := configuredProfiles()
+			for _, profile := range profiles {
+				if profile.Name == sshEntry.ProfileConfig.Name {
+					liveProfiles = withBastionProfiles([]lib.ProfileConfig{profile}, profiles)
+				}
+			}
+			if len(liveProfiles) == 0 {
+				log.Fatalf("profile %s of %s isn't in the config", sshEntry.ProfileConfig.Name, args[0])
+			}
+			explanation, err = lib.ExplainLive(ctx, liveProfiles, sshEntry.InstanceID, options)
+		} else {
+			warnIfStale(cache, sshEntry.ProfileConfig.Name)
+			explanation, err = lib.Explain(summaries, sshEntry.InstanceID, options)
+		}
+		if err != nil {
+			log.WithError(err).Fatalf("can't explain %s", args[0])
+		}
+		printExplanation(sshEntry, explanation, names)
+	},
+}
+
+// printExplanation prints the explanation of the entry, resolving the bastion ids to the names
+func printExplanation(sshEntry lib.SSHEntry, explanation lib.Explanation, names map[string]string) {
+	name := func(instanceID string) string {
+		if name, ok := names[instanceID]; ok {
+			return fmt.Sprintf("%s (%s)", name, instanceID)
+		}
+		return instanceID
+	}
+	entry := explanation.Entry
+
+	fmt.Printf("Host: %s\n", name(sshEntry.InstanceID))
+	fmt.Printf("Profile: %s, region %s, VPC %s, subnet %s\n", entry.ProfileConfig.Name, entry.ProfileConfig.Region, entry.Metadata.VpcID, entry.Metadata.SubnetID)
+
+	fmt.Println("\nBastion candidates:")
+	if len(explanation.Candidates) == 0 {
+		fmt.Println("  none")
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "  SOURCE\tNAME\tINSTANCE ID\tSCORE\t")
+		for _, candidate := range explanation.Candidates {
+			var chosen string
+			if candidate.Chosen {
+				chosen = "chosen"
+			}
+			fmt.Fprintf(writer, "  %s\t%s\t%s\t%d\t%s\n", candidate.Source, candidate.Name, candidate.InstanceID, candidate.Score, chosen)
+		}
+		writer.Flush()
+	}
+
+	fmt.Println("\nDecisions:")
+	for n, step := range explanation.Steps {
+		fmt.Printf("  %d. %s\n", n+1, step)
+	}
+
+	fmt.Println("\nResult:")
+	fmt.Printf("  Address: %s\n", entry.Address)
+	if entry.ProxyJump != "" {
+		fmt.Printf("  Bastion: %s\n", name(entry.ProxyJump))
+	}
+	if jumpHosts := sshEntry.JumpHosts(); entry.ProxyJump == sshEntry.ProxyJump && len(jumpHosts) > 1 {
+		var chain []string
+		for _, jumpHost := range jumpHosts {
+			chain = append(chain, name(jumpHost))
+		}
+		fmt.Printf("  Jump hosts: %s, the bastion is reached through its own ProxyJump\n", strings.Join(chain, " -> "))
+	}
+	if entry.Transport != "" {
+		fmt.Printf("  Transport: %s\n", entry.Transport)
+	}
+	if entry.User != "" {
+		fmt.Printf("  User: %s, from x-aws-ssh-user tag\n", entry.User)
+	} else {
+		fmt.Println("  User: no x-aws-ssh-user tag, so ec2-user or the one given with --user")
+	}
+	if entry.Port != "" {
+		fmt.Printf("  Port: %s, from x-aws-ssh-port tag\n", entry.Port)
+	} else {
+		fmt.Println("  Port: no x-aws-ssh-port tag, so 22")
+	}
+	if entry.Address != sshEntry.Address || entry.ProxyJump != sshEntry.ProxyJump || entry.Transport != sshEntry.Transport {
+		fmt.Printf("  The cached entry has address %s, bastion %q and transport %q: the cache is out of date or has been updated with other options\n",
+			sshEntry.Address, sshEntry.ProxyJump, sshEntry.Transport)
+	}
+
+	if len(explanation.Tags) > 0 {
+		fmt.Println("\nTags:")
+		var keys []string
+		for key := range explanation.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("  %s=%s\n", key, explanation.Tags[key])
+		}
+	}
+}
+
+func init() {
+	explainCmd.Flags().Bool("live", false, "Describe the instances of the profile instead of using the cached ones")
+
+	viper.BindPFlag("live", explainCmd.Flags().Lookup("live"))
+
+	rootCmd.AddCommand(explainCmd)
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// hostRow is a cached host as shown by the list command
+type hostRow struct {
+	Name       string            `json:"name"`
+	Profile    string            `json:"profile"`
+	Region     string            `json:"region"`
+	InstanceID string            `json:"instance_id"`
+	Address    string            `json:"address"`
+	User       string            `json:"user"`
+	Bastion    string            `json:"bastion"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list [name glob...]",
+	Short: "Lists the cached hosts",
+	Long: `Lists the hosts from the cache, which is populated by "aws-ssh update".
+
+Hosts can be filtered by name globs (any of the host names should match any of the globs),
+by profile with -p and by tags with --tag. The tag filter is either "key" to check the tag exists
+or "key=value", where the value can be a glob too. If multiple tag filters are specified, all of them should match.
+
+The output format is one of: table, json, csv or names (only canonical names, one per line, useful for piping).`,
+	Aliases: []string{"ls"},
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+		summaries, err := cache.Load()
+		if err != nil {
+			log.WithError(err).Fatal("can't load the cache")
+		}
+
+		// bastions are referred by instance id, so resolve them to names
+		var names = make(map[string]string)
+		for _, summary := range summaries {
+			for _, entry := range summary.SSHEntries {
+				names[entry.InstanceID] = entry.Names[0]
+			}
+		}
+
+		var rows []hostRow
+		profiles := viper.GetStringSlice("profiles")
+		tagFilters := viper.GetStringSlice("tag")
+		for _, summary := range summaries {
+			if len(profiles) > 0 && !contains(profiles, summary.Name) {
+				continue
+			}
+			for _, entry := range summary.SSHEntries {
+				if !matchNames(entry, args) || !matchTags(entry, tagFilters) {
+					continue
+				}
+				var bastion = entry.ProxyJump
+				if name, ok := names[bastion]; ok {
+					bastion = name
+				}
+				rows = append(rows, hostRow{
+					Name:       entry.Names[0],
+					Profile:    entry.ProfileConfig.Name,
+					Region:     entry.ProfileConfig.Region,
+					InstanceID: entry.InstanceID,
+					Address:    entry.Address,
+					User:       entry.User,
+					Bastion:    bastion,
+					Tags:       entry.Tags,
+				})
+			}
+		}
+
+		if err := printHosts(rows, viper.GetString("output")); err != nil {
+			log.WithError(err).Fatal("can't print the hosts")
+		}
+	},
+}
+
+// matchNames checks if any of the entry names matches any of the globs
+func matchNames(entry lib.SSHEntry, globs []string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		for _, name := range entry.Names {
+			if matched, _ := path.Match(glob, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchTags checks if the entry matches all the tag filters
+func matchTags(entry lib.SSHEntry, filters []string) bool {
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "=", 2)
+		value, ok := entry.Tags[parts[0]]
+		if !ok {
+			return false
+		}
+		if len(parts) == 2 {
+			if matched, _ := path.Match(parts[1], value); !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func printHosts(rows []hostRow, output string) error {
+	switch output {
+	case "table":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tPROFILE\tREGION\tINSTANCE ID\tADDRESS\tUSER\tBASTION")
+		for _, row := range rows {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.Name, row.Profile, row.Region, row.InstanceID, row.Address, row.User, row.Bastion)
+		}
+		return writer.Flush()
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if rows == nil {
+			rows = []hostRow{}
+		}
+		return encoder.Encode(rows)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{"name", "profile", "region", "instance_id", "address", "user", "bastion"})
+		for _, row := range rows {
+			writer.Write([]string{row.Name, row.Profile, row.Region, row.InstanceID, row.Address, row.User, row.Bastion})
+		}
+		writer.Flush()
+		return writer.Error()
+	case "names":
+		for _, row := range rows {
+			fmt.Println(row.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", output)
+}
+
+func init() {
+	listCmd.Flags().StringP("output", "o", "table", "Output format: table, json, csv or names")
+	listCmd.Flags().StringSliceP("tag", "t", []string{}, "Filter by tag, either \"key\" or \"key=value glob\". Can be specified multiple times")
+
+	viper.BindPFlag("output", listCmd.Flags().Lookup("output"))
+	viper.BindPFlag("tag", listCmd.Flags().Lookup("tag"))
+
+	listCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "json", "csv", "names"}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"aws-ssh/lib/ec2connect"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var proxyCommandCmd = &cobra.Command{
+	Use:   "proxy-command <host> <port> [user]",
+	Short: "Pushes the key with ec2 connect and proxies ssh connection to the host, for use as ssh ProxyCommand",
+	Long: `aws-ssh proxy-command is meant to be used as ssh ProxyCommand, so that any ssh-based tool
+(scp, rsync, git, VS Code Remote, Ansible, etc.) gets the key pushed via ec2 connect transparently.
+
+The host is resolved via the cache by its name or address, so run "aws-ssh update" first.
+Then the key from the ssh agent is pushed to the instance for the user (if it's not provided,
+the cached one is used) and the connection is proxied to its ssh port directly,
+or through the bastion if there is one. The instances with the ssm transport are reached
+through Session Manager by aws-ssh itself, so the session-manager-plugin isn't needed.
+
+With --auto-path the private address of the instance is probed first, then the bastion and the public address,
+and the first reachable one is used, so the bastion is skipped on VPN. The results of the private address probes
+are cached per VPC and its CIDR block for a few minutes. The port given by ssh is the one probed.
+
+Use "aws-ssh reconf --proxy-command" to generate ssh config with it, or add it manually:
+
+  Host prod-*
+      ProxyCommand aws-ssh proxy-command %n %p %r`,
+	Args: cobra.RangeArgs(2, 3),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// stdout is the ssh connection, so logs go to stderr
+		// and are kept quiet not to get in the way of the tools running ssh
+		log.SetHandler(cli.New(os.Stderr))
+		if !viper.GetBool("debug") {
+			log.SetLevel(log.WarnLevel)
+		}
+		// the flags are shared with connect
+		viper.BindPFlag("key", cmd.Flags().Lookup("key"))
+		viper.BindPFlag("auto-path", cmd.Flags().Lookup("auto-path"))
+		viper.BindPFlag("probe-timeout", cmd.Flags().Lookup("probe-timeout"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+		sshEntry, err := cache.Get(args[0])
+		if err != nil {
+			log.WithError(err).Fatalf("can't find %s in cache", args[0])
+		}
+		warnIfStale(cache, sshEntry.ProfileConfig.Name)
+		if len(args) > 2 && args[2] != "" {
+			sshEntry.User = args[2]
+		}
+		if viper.GetBool("auto-path") {
+			sshEntries, err := withJumpHosts(cache, sshEntry)
+			if err != nil {
+				log.WithError(err).Fatal("can't lookup the bastions in cache")
+			}
+			sshEntry = *selectPath(ctx, cache, sshEntries, args[1])[0]
+		}
+
+		if err := ec2connect.ProxyCommand(ctx, sshEntry, args[1], ec2connect.ConnectOptions{
+			Key: viper.GetString("key"),
+		}); err != nil {
+			log.WithError(err).Fatal("can't proxy the connection")
+		}
+	},
+}
+
+func init() {
+	proxyCommandCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	proxyCommandCmd.Flags().Bool("auto-path", false, "Probe the private address, the bastion and the public address of the instance and use the first reachable one")
+	proxyCommandCmd.Flags().Duration("probe-timeout", lib.DefaultProbeTimeout, "Timeout of every probe of --auto-path")
+
+	rootCmd.AddCommand(proxyCommandCmd)
+}
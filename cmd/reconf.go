@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"aws-ssh/lib"
+	"fmt"
+	"strings"
 
+	"github.com/apex/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -15,12 +18,38 @@ var reconfCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Short: "Creates a new ssh config",
 	Long: `Reconfigures your ssh by creating a new config for it. Only one argument is required,
-which is a filename. In case of any errors, the preexisting file won't be touched.`,
+which is a filename. In case of any errors, the preexisting file won't be touched.
+
+With --proxy-command every host gets "ProxyCommand aws-ssh proxy-command %n %p %r", so that
+plain ssh (and scp, rsync, git, etc.) pushes the key via ec2 connect before connecting.
+It resolves the hosts via the cache, so run "aws-ssh update" as well. With --auto-path too,
+the proxy command probes the ways to reach the host and uses the first reachable one (see "aws-ssh proxy-command --help").`,
 	Run: func(cmd *cobra.Command, args []string) {
-		lib.Reconf(viper.Get("profilesConfig").([]lib.ProfileConfig), args[0], viper.GetBool("no-profile-prefix"))
+		autoPath, _ := cmd.Flags().GetBool("auto-path")
+		if autoPath && !viper.GetBool("proxy-command") {
+			log.Fatal("--auto-path is the option of the proxy command, so it can only be used with --proxy-command")
+		}
+		ctx, cancel := signalContext()
+		defer cancel()
+		var proxyCommand string
+		if viper.GetBool("proxy-command") {
+			proxyCommand = "aws-ssh proxy-command %n %p %r"
+			// the proxy command has to use the same cache
+			if cacheDir := viper.GetString("cache-dir"); cacheDir != cmd.Flags().Lookup("cache-dir").DefValue {
+				proxyCommand = fmt.Sprintf("aws-ssh --cache-dir '%s' proxy-command %%n %%p %%r", cacheDir)
+			}
+			if autoPath {
+				proxyCommand = strings.Replace(proxyCommand, "proxy-command", "proxy-command --auto-path", 1)
+			}
+		}
+		lib.Reconf(ctx, viper.Get("profilesConfig").([]lib.ProfileConfig), args[0], traverseOptions(), proxyCommand)
 	},
 }
 
 func init() {
+	reconfCmd.Flags().BoolP("proxy-command", "", false, "Use \"aws-ssh proxy-command\" as ProxyCommand for all hosts to push keys with ec2 connect")
+	reconfCmd.Flags().Bool("auto-path", false, "Make the proxy command of --proxy-command probe the ways to reach the hosts")
+	viper.BindPFlag("proxy-command", reconfCmd.Flags().Lookup("proxy-command"))
+
 	rootCmd.AddCommand(reconfCmd)
 }
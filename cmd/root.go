@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
@@ -56,11 +57,25 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Show debug output")
 	rootCmd.PersistentFlags().BoolP("no-profile-prefix", "n", false, "Do not prefix host names with profile name")
 	rootCmd.PersistentFlags().StringSliceP("profile", "p", []string{}, "Profiles to query. Can be specified multiple times. If not specified, goes through all profiles in ~/.aws/config and ~/.aws/credentials")
+	rootCmd.PersistentFlags().StringSliceP("regions", "", []string{}, "Regions to query for every profile, \"all\" queries all enabled regions. Overrides aws-ssh-regions in ~/.aws/config")
+	rootCmd.PersistentFlags().IntP("concurrency", "", 10, "Maximum number of profiles to query at the same time, 0 means no limit")
+	rootCmd.PersistentFlags().DurationP("timeout", "", time.Minute, "Time limit to query a single profile, 0 means no limit")
+	rootCmd.PersistentFlags().BoolP("no-endpoints", "", false, "Do not discover RDS, ElastiCache and OpenSearch endpoints")
+	rootCmd.PersistentFlags().BoolP("stopped", "", false, "Also cache the stopped instances, so that \"connect\" can start them")
+	rootCmd.PersistentFlags().StringP("bastion-name", "", "", "Regular expression matching the lowercased Name tag of the bastions, \"bastion\" if neither this nor --bastion-tag is set. Overrides aws-ssh-bastion-name in ~/.aws/config")
+	rootCmd.PersistentFlags().StringP("bastion-tag", "", "", "Tag of the bastions as key[=value], any value matches if it's omitted. Overrides aws-ssh-bastion-tag in ~/.aws/config")
 	rootCmd.PersistentFlags().StringP("cache-dir", "", defaultCacheDir, "Cache dir, which is used by \"update\" and \"connect\" commands")
 
 	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
 	viper.BindPFlag("no-profile-prefix", rootCmd.PersistentFlags().Lookup("no-profile-prefix"))
 	viper.BindPFlag("profiles", rootCmd.PersistentFlags().Lookup("profile"))
+	viper.BindPFlag("regions", rootCmd.PersistentFlags().Lookup("regions"))
+	viper.BindPFlag("concurrency", rootCmd.PersistentFlags().Lookup("concurrency"))
+	viper.BindPFlag("timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	viper.BindPFlag("no-endpoints", rootCmd.PersistentFlags().Lookup("no-endpoints"))
+	viper.BindPFlag("stopped", rootCmd.PersistentFlags().Lookup("stopped"))
+	viper.BindPFlag("bastion-name", rootCmd.PersistentFlags().Lookup("bastion-name"))
+	viper.BindPFlag("bastion-tag", rootCmd.PersistentFlags().Lookup("bastion-tag"))
 	viper.BindPFlag("cache-dir", rootCmd.PersistentFlags().Lookup("cache-dir"))
 
 	viper.SetEnvPrefix("aws_ssh") // will be uppercased
@@ -79,10 +94,7 @@ func initSettings() {
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	profiles, err := getProfiles()
-	if err != nil {
-		log.WithError(err).Fatal("Profiles have not been provided and couldn't retrieve them from the config")
-	}
+	profiles := configuredProfiles()
 	if len(viper.GetStringSlice("profiles")) == 0 {
 		viper.Set("profilesConfig", profiles)
 	} else {
@@ -93,6 +105,24 @@ func initConfig() {
 				filteredProfiles = append(filteredProfiles, profile)
 			}
 		}
-		viper.Set("profilesConfig", filteredProfiles)
+		viper.Set("profilesConfig", withBastionProfiles(filteredProfiles, profiles))
+	}
+}
+
+// configuredProfiles returns all profiles of the config with the command line flags applied
+func configuredProfiles() []lib.ProfileConfig {
+	profiles, err := getProfiles()
+	if err != nil {
+		log.WithError(err).Fatal("Profiles have not been provided and couldn't retrieve them from the config")
+	}
+	// regions from the command line take precedence over the config
+	if regions := viper.GetStringSlice("regions"); len(regions) > 0 {
+		for n := range profiles {
+			profiles[n].Regions = regions
+		}
+	}
+	for n := range profiles {
+		profiles[n] = withBastionFlags(profiles[n])
 	}
+	return profiles
 }
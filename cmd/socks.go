@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"aws-ssh/lib/ec2connect"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var socksCmd = &cobra.Command{
+	Use:   "socks [host]",
+	Short: "Serves SOCKS5 proxy through the bastion, pushing the key with ec2 connect",
+	Long: `aws-ssh socks serves SOCKS5 proxy on the local port, connecting through the bastion of the VPC.
+The key is pushed via ec2 connect and the connection is re-established whenever it breaks, until interrupted.
+
+The VPC is set with --vpc, then the bastion for it is selected the same way as for the instances in the VPC:
+one from the VPC itself if there is any, otherwise a global one. The profile is set with -p then,
+unless all the cached profiles should be looked at. Instead of the VPC, a cached host can be given,
+then its bastion is used, or the host itself if it doesn't have one.
+
+With --pac the proxy auto-config file is written (or printed with "-"), which sends only the connections
+to the CIDRs of the VPC and to the EC2 internal host names through the proxy, so it can be set in the browser.
+
+  aws-ssh socks -p prod --vpc vpc-0123456789 --pac ~/prod.pac
+  aws-ssh socks prod-web-1 --listen localhost:1081`,
+	Args: cobra.MaximumNArgs(1),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the flags are shared with connect and tunnel
+		viper.BindPFlag("vpc", cmd.Flags().Lookup("vpc"))
+		viper.BindPFlag("key", cmd.Flags().Lookup("key"))
+		viper.BindPFlag("ephemeral", cmd.Flags().Lookup("ephemeral"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+
+		var sshEntry lib.SSHEntry
+		var vpcID = viper.GetString("vpc")
+		switch {
+		case vpcID != "" && len(args) > 0:
+			log.Fatal("either the host or --vpc should be set, not both")
+		case vpcID != "":
+			bastion, err := findVPCBastion(cache, vpcID)
+			if err != nil {
+				log.WithError(err).Fatal("can't find the bastion")
+			}
+			sshEntry = *bastion
+		case len(args) > 0:
+			host, err := cache.Lookup(args[0])
+			if err != nil {
+				log.WithError(err).Fatalf("can't lookup %s in cache", args[0])
+			}
+			vpcID = host.Metadata.VpcID
+			sshEntry = host
+			if host.ProxyJump != "" {
+				if sshEntry, err = cache.Lookup(host.ProxyJump); err != nil {
+					log.WithError(err).Fatalf("can't lookup bastion %s in cache", host.ProxyJump)
+				}
+			}
+		default:
+			log.Fatal("either the host or --vpc should be set")
+		}
+		warnIfStale(cache, sshEntry.ProfileConfig.Name)
+		log.WithField("instance_id", sshEntry.InstanceID).Infof("proxying through %s", sshEntry.Names[0])
+
+		sshEntries, err := withJumpHosts(cache, sshEntry)
+		if err != nil {
+			log.WithError(err).Fatal("can't get the bastion")
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+		address := viper.GetString("listen")
+		if pacFile := viper.GetString("pac"); pacFile != "" {
+			if err := writePACFile(ctx, pacFile, address, sshEntry.ProfileConfig, vpcID); err != nil {
+				log.WithError(err).Fatal("can't write the pac file")
+			}
+		}
+
+		if err := ec2connect.SOCKS(ctx, sshEntries, address, ec2connect.ConnectOptions{
+			Key:       viper.GetString("key"),
+			Ephemeral: viper.GetBool("ephemeral"),
+		}); err != nil {
+			log.WithError(err).Fatal("can't serve the proxy")
+		}
+	},
+}
+
+// writePACFile writes the proxy auto-config for the vpc CIDRs to the file, or prints it if the file is "-"
+func writePACFile(ctx context.Context, pacFile, address string, profile lib.ProfileConfig, vpcID string) error {
+	if vpcID == "" {
+		return fmt.Errorf("the vpc isn't known")
+	}
+	cidrs, err := ec2connect.VPCCIDRs(ctx, profile, vpcID)
+	if err != nil {
+		return err
+	}
+	pac, err := lib.PACFile(address, cidrs)
+	if err != nil {
+		return err
+	}
+	if pacFile == "-" {
+		fmt.Print(pac)
+		return nil
+	}
+	if err := ioutil.WriteFile(pacFile, []byte(pac), 0644); err != nil {
+		return err
+	}
+	log.WithField("file", pacFile).Infof("saved the pac file for %s", vpcID)
+	return nil
+}
+
+func init() {
+	socksCmd.Flags().String("vpc", "", "VPC id to select the bastion for instead of the host")
+	socksCmd.Flags().StringP("listen", "l", "localhost:1080", "Local address to serve the proxy on")
+	socksCmd.Flags().String("pac", "", "Write the proxy auto-config file for the VPC CIDRs to this path, or print it with \"-\"")
+	socksCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	socksCmd.Flags().BoolP("ephemeral", "e", false, "Generate a new key for this session instead of using the ssh agent keys. It's kept in memory only")
+
+	viper.BindPFlag("listen", socksCmd.Flags().Lookup("listen"))
+	viper.BindPFlag("pac", socksCmd.Flags().Lookup("pac"))
+
+	rootCmd.AddCommand(socksCmd)
+}
@@ -20,15 +20,17 @@ var testCmd = &cobra.Command{
 Allows to identify permission issues early.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signalContext()
+		defer cancel()
 		profiles := viper.Get("profilesConfig").([]lib.ProfileConfig)
-		summaries, err := lib.TraverseProfiles(profiles, viper.GetBool("no-profile-prefix"))
+		summaries, err := lib.TraverseProfiles(ctx, profiles, traverseOptions())
+		for _, summary := range summaries {
+			logSummary(summary)
+		}
 		if err != nil {
 			log.WithError(err).Fatal("Can't traverse through all profiles")
 		} else {
 			log.Info("All profiles have been traversted through without errors")
-			for _, summary := range summaries {
-				log.WithFields(log.Fields{"profile": summary.Name}).Infof("found %d instances", len(summary.SSHEntries))
-			}
 		}
 	},
 }
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"aws-ssh/lib/ec2connect"
+	"aws-ssh/lib/sshclient"
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel [host|endpoint] [[bind-address:]port:remote-host:remote-port...]",
+	Short: "Forwards local ports through the instance, pushing the key with ec2 connect",
+	Long: `aws-ssh tunnel forwards local ports to the remote addresses through the cached host, like ssh -L,
+but without the ssh config. The key is pushed via ec2 connect to the host and its bastion,
+and the connection is re-established (pushing the key again) whenever it breaks, until interrupted.
+
+The host can also be a service endpoint discovered by "aws-ssh update", like prod-db-main for the RDS instance "main".
+Then it goes through the bastion of the endpoint and, if no ports are given, forwards the endpoint port as it is.
+
+Instead of the host, the VPC can be set with --vpc, then the bastion for it is selected the same way
+as for the instances in the VPC: one from the VPC itself if there is any, otherwise a global one.
+The profile is set with -p then, unless all the cached profiles should be looked at.
+
+  aws-ssh tunnel prod-bastion 5432:db.internal:5432 6379:redis.internal:6379
+  aws-ssh tunnel prod-db-main
+  aws-ssh tunnel -p prod --vpc vpc-0123456789 5432:db.internal:5432`,
+	Args: cobra.MinimumNArgs(1),
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the flags are shared with connect and socks
+		viper.BindPFlag("vpc", cmd.Flags().Lookup("vpc"))
+		viper.BindPFlag("key", cmd.Flags().Lookup("key"))
+		viper.BindPFlag("ephemeral", cmd.Flags().Lookup("ephemeral"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
+
+		var sshEntry lib.SSHEntry
+		if vpcID := viper.GetString("vpc"); vpcID != "" {
+			bastion, err := findVPCBastion(cache, vpcID)
+			if err != nil {
+				log.WithError(err).Fatal("can't find the bastion")
+			}
+			sshEntry = *bastion
+		} else if endpoint := findEndpoint(cache, args[0]); endpoint != nil {
+			if endpoint.ProxyJump == "" {
+				log.Fatalf("there is no bastion to reach %s through", endpoint.Name)
+			}
+			bastion, err := cache.Get(endpoint.ProxyJump)
+			if err != nil {
+				log.WithError(err).Fatalf("can't find bastion %s in cache", endpoint.ProxyJump)
+			}
+			sshEntry = bastion
+			args = args[1:]
+			// forward the endpoint port as it is, unless the forwards are given
+			if len(args) == 0 {
+				args = []string{fmt.Sprintf("%s:%s:%s", endpoint.Port, endpoint.Address, endpoint.Port)}
+			}
+		} else {
+			var err error
+			if sshEntry, err = cache.Lookup(args[0]); err != nil {
+				log.WithError(err).Fatalf("can't lookup %s in cache", args[0])
+			}
+			args = args[1:]
+		}
+		warnIfStale(cache, sshEntry.ProfileConfig.Name)
+		log.WithField("instance_id", sshEntry.InstanceID).Infof("tunneling through %s", sshEntry.Names[0])
+
+		if len(args) == 0 {
+			log.Fatal("no ports to forward")
+		}
+		var forwards []sshclient.Forward
+		for _, arg := range args {
+			forward, err := sshclient.ParseForward(arg)
+			if err != nil {
+				log.WithError(err).Fatal("can't parse the forward")
+			}
+			forwards = append(forwards, forward)
+		}
+
+		sshEntries, err := withJumpHosts(cache, sshEntry)
+		if err != nil {
+			log.WithError(err).Fatal("can't get the bastion")
+		}
+
+		ctx, cancel := signalContext()
+		defer cancel()
+		if err := ec2connect.Tunnel(ctx, sshEntries, forwards, ec2connect.ConnectOptions{
+			Key:       viper.GetString("key"),
+			Ephemeral: viper.GetBool("ephemeral"),
+		}); err != nil {
+			log.WithError(err).Fatal("can't forward the ports")
+		}
+	},
+}
+
+// findEndpoint finds the service endpoint in the cache by its name
+func findEndpoint(cache cache.Cache, name string) *lib.ServiceEndpoint {
+	summaries, err := cache.Load()
+	if err != nil {
+		return nil
+	}
+	for _, summary := range summaries {
+		for _, endpoint := range summary.Endpoints {
+			if endpoint.Name == name || (endpoint.ProfileConfig.Domain != "" && endpoint.Name+"."+endpoint.ProfileConfig.Domain == name) {
+				return &endpoint
+			}
+		}
+	}
+	return nil
+}
+
+// findVPCBastion finds the bastion for the vpc in the cached profiles, matching the bastions
+// the same way the cache has been updated unless --bastion-name or --bastion-tag is set
+func findVPCBastion(cache cache.Cache, vpcID string) (*lib.SSHEntry, error) {
+	summaries, err := cache.Load()
+	if err != nil {
+		return nil, err
+	}
+	profiles := viper.GetStringSlice("profiles")
+	for _, summary := range summaries {
+		if len(profiles) > 0 && !contains(profiles, summary.Name) {
+			continue
+		}
+		matcher, err := withBastionFlags(summary.ProfileConfig).BastionMatcher()
+		if err != nil {
+			return nil, fmt.Errorf("can't match the bastions of %s: %s", summary.Name, err)
+		}
+		if bastion := lib.FindVPCBastion(summary.SSHEntries, vpcID, matcher); bastion != nil {
+			return bastion, nil
+		}
+	}
+	return nil, fmt.Errorf("no bastion for %s in cache", vpcID)
+}
+
+func init() {
+	tunnelCmd.Flags().String("vpc", "", "VPC id to select the bastion for instead of the host")
+	tunnelCmd.Flags().StringP("key", "k", "", "Fingerprint or comment of the ssh agent key to push. By default the first key supported by ec2 connect is used")
+	tunnelCmd.Flags().BoolP("ephemeral", "e", false, "Generate a new key for this session instead of using the ssh agent keys. It's kept in memory only")
+
+	rootCmd.AddCommand(tunnelCmd)
+}
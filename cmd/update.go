@@ -20,10 +20,19 @@ var updateCmd = &cobra.Command{
 Cache is important for sophisticated behaviour of "connect" command,
 because it stores metadata like AWS profile and EC2 instance id in it,
 allowing to automatically fill those values in.
+
+Only the queried profiles are updated, so "aws-ssh update -p profile" keeps the rest of the cache,
+whereas "aws-ssh update" removes the profiles which aren't in the config anymore.
+If a profile fails to update, its last good entries are kept and marked as stale.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		cache := cache.NewYAMLCache(viper.GetString("cache-dir"))
-		profileSummaries, err := lib.TraverseProfiles(viper.Get("profilesConfig").([]lib.ProfileConfig), viper.GetBool("no-profile-prefix"))
+		ctx, cancel := signalContext()
+		defer cancel()
+		profileSummaries, err := lib.TraverseProfiles(ctx, viper.Get("profilesConfig").([]lib.ProfileConfig), traverseOptions())
+		for _, summary := range profileSummaries {
+			logSummary(summary)
+		}
 		if err != nil {
 			log.WithError(err).Warn("got some errors")
 		}
@@ -35,9 +44,22 @@ allowing to automatically fill those values in.
 		for _, summary := range profileSummaries {
 			sshEntries = append(sshEntries, summary.SSHEntries...)
 		}
-		if err := cache.Save(profileSummaries); err != nil {
+		save := cache.Save
+		// every profile has been queried, so the ones which aren't there have been removed from the config
+		if len(viper.GetStringSlice("profiles")) == 0 {
+			save = cache.SaveAll
+		}
+		changes, err := save(profileSummaries)
+		if err != nil {
 			log.WithError(err).Fatal("couldn't save cache")
-
+		}
+		log.WithFields(log.Fields{
+			"added":   changes.Added,
+			"removed": changes.Removed,
+			"changed": changes.Changed,
+		}).Info("cache has been updated")
+		for _, profile := range changes.StaleProfiles {
+			log.WithField("profile", profile).Warn("couldn't update the profile, keeping its last good entries")
 		}
 	},
 }
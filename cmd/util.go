@@ -2,13 +2,20 @@ package cmd
 
 import (
 	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/go-ini/ini"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
 )
 
 // gets profiles. The current Go AWS SDK doesn't have this function, whereas python boto3 has it. Why?
@@ -44,6 +51,21 @@ func getProfiles() ([]lib.ProfileConfig, error) {
 					if section.HasKey("aws-ssh-domain") {
 						config.Domain = section.Key("aws-ssh-domain").Value()
 					}
+					if section.HasKey("aws-ssh-regions") {
+						config.Regions = splitList(section.Key("aws-ssh-regions").Value())
+					}
+					if section.HasKey("aws-ssh-transport") {
+						config.Transport = section.Key("aws-ssh-transport").Value()
+					}
+					if section.HasKey("aws-ssh-bastion-profile") {
+						config.BastionProfile = section.Key("aws-ssh-bastion-profile").Value()
+					}
+					if section.HasKey("aws-ssh-bastion-name") {
+						config.BastionName = section.Key("aws-ssh-bastion-name").Value()
+					}
+					if section.HasKey("aws-ssh-bastion-tag") {
+						config.BastionTag = section.Key("aws-ssh-bastion-tag").Value()
+					}
 					log.Debugf("Got profile - %s", name)
 					profiles[name] = config
 				} else {
@@ -70,6 +92,36 @@ func getProfiles() ([]lib.ProfileConfig, error) {
 	return profilesList, nil
 }
 
+// withBastionProfiles adds the profiles set with aws-ssh-bastion-profile to the selected ones,
+// so the bastions of the other accounts are there to route the instances through
+func withBastionProfiles(selected, all []lib.ProfileConfig) []lib.ProfileConfig {
+	var names []string
+	for _, profile := range selected {
+		names = append(names, profile.Name)
+	}
+	// the bastion profiles can have bastion profiles too
+	for n := 0; n < len(selected); n++ {
+		bastionProfile := selected[n].BastionProfile
+		if bastionProfile == "" || contains(names, bastionProfile) {
+			continue
+		}
+		var found bool
+		for _, profile := range all {
+			if profile.Name == bastionProfile {
+				log.Debugf("Adding bastion profile %s of %s", bastionProfile, selected[n].Name)
+				selected = append(selected, profile)
+				names = append(names, profile.Name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("Bastion profile %s of %s isn't found", bastionProfile, selected[n].Name)
+		}
+	}
+	return selected
+}
+
 func contains(slice []string, element string) bool {
 	for _, item := range slice {
 		if item == element {
@@ -78,3 +130,98 @@ func contains(slice []string, element string) bool {
 	}
 	return false
 }
+
+// splitList splits a comma or space separated list, skipping empty items
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// traverseOptions returns TraverseOptions from the command line flags
+func traverseOptions() lib.TraverseOptions {
+	return lib.TraverseOptions{
+		NoProfilePrefix: viper.GetBool("no-profile-prefix"),
+		Concurrency:     viper.GetInt("concurrency"),
+		Timeout:         viper.GetDuration("timeout"),
+		Endpoints:       !viper.GetBool("no-endpoints"),
+		Stopped:         viper.GetBool("stopped"),
+	}
+}
+
+// withBastionFlags returns the profile matching the bastions with --bastion-name and --bastion-tag
+// if either of them is set, as the flags take precedence over the config
+func withBastionFlags(profile lib.ProfileConfig) lib.ProfileConfig {
+	name, tag := viper.GetString("bastion-name"), viper.GetString("bastion-tag")
+	if name == "" && tag == "" {
+		return profile
+	}
+	if _, err := lib.NewBastionMatcher(name, tag); err != nil {
+		log.WithError(err).Fatal("can't match the bastions")
+	}
+	profile.BastionName, profile.BastionTag = name, tag
+	return profile
+}
+
+// signalContext returns a context which gets cancelled on SIGINT or SIGTERM.
+// Only the first signal is caught, so the second one terminates the program as usual.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// logSummary logs the status of the profile summary
+func logSummary(summary lib.ProcessedProfileSummary) {
+	ctx := log.WithFields(log.Fields{
+		"profile":  summary.Name,
+		"status":   summary.Status,
+		"duration": summary.Duration.Round(time.Millisecond),
+	})
+	if summary.Status != lib.ProfileStatusOK {
+		ctx.WithError(summary.Err).Warn("couldn't traverse the profile")
+		return
+	}
+	ctx.Infof("found %d instances and %d service endpoints", summary.InstanceCount, len(summary.Endpoints))
+}
+
+// selectPath probes the ways to reach the first entry and returns the entries of the first reachable one
+// if --auto-path is set, otherwise the cached way is used as is. The port of the instance to probe
+// can be given, like the one ssh connects to through the proxy command, otherwise its ssh port is probed.
+// The probes stop when ctx is done, and so does the program.
+func selectPath(ctx context.Context, cache cache.Cache, sshEntries lib.SSHEntries, port string) lib.SSHEntries {
+	if !viper.GetBool("auto-path") {
+		return sshEntries
+	}
+	selected, selectedPath := lib.SelectPath(ctx, sshEntries, cache, lib.PathOptions{
+		Timeout: viper.GetDuration("probe-timeout"),
+		Port:    port,
+	})
+	if ctx.Err() != nil {
+		log.WithError(ctx.Err()).Fatal("interrupted while probing the paths")
+	}
+	log.WithField("instance_id", selected[0].InstanceID).Infof("Using the %s path to %s", selectedPath, selected[0].Address)
+	return selected
+}
+
+// withJumpHosts returns the entry followed by the chain of its jump hosts from the cache,
+// which is the order ec2connect expects the hops in
+func withJumpHosts(cache cache.Cache, sshEntry lib.SSHEntry) (lib.SSHEntries, error) {
+	sshEntries, err := cache.Chain(sshEntry)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve the jump hosts of %s: %s", sshEntry.Names[0], err)
+	}
+	for _, jumpHost := range sshEntries[1:] {
+		log.WithField("instance_id", jumpHost.InstanceID).Debugf("Got bastion %s", jumpHost.Names[0])
+		if jumpHost.ProfileConfig.Name != sshEntry.ProfileConfig.Name {
+			warnIfStale(cache, jumpHost.ProfileConfig.Name)
+		}
+	}
+	if last := sshEntries[len(sshEntries)-1]; last.ProxyJump != "" && last.Transport == "" {
+		log.WithField("jump_host", last.ProxyJump).Debug("the jump host isn't cached, leaving it to ssh")
+	}
+	return sshEntries, nil
+}
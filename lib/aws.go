@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,204 +23,541 @@ type profileSummary struct {
 	ProfileConfig
 
 	Instances []types.Instance
+	// InstanceRegions maps instance id to the region it runs in
+	InstanceRegions map[string]string
+	// ManagedInstances are the ids of the instances with SSM agent online,
+	// they are only looked up if the ssm transport is used in the profile
+	ManagedInstances map[string]bool
+	// ConnectEndpoints are the instance connect endpoints of the VPCs
+	ConnectEndpoints []InstanceConnectEndpoint
+	Endpoints        []ServiceEndpoint
+	// VpcCIDRs are the CIDR blocks of the VPCs by their ids
+	VpcCIDRs map[string][]string
+	// SharedBastions are the bastions of the other profiles the instances can go through,
+	// they are set once all profiles have been described
+	SharedBastions []types.Instance
+	// Bastions tells the bastions of the profile from the other instances
+	Bastions BastionMatcher
 }
 
+// AllRegions can be used in place of the region list to query all enabled regions
+const AllRegions = "all"
+
+// ProfileStatus is the result of traversing a profile
+type ProfileStatus string
+
+const (
+	// ProfileStatusOK means the profile has been traversed without errors
+	ProfileStatusOK ProfileStatus = "ok"
+	// ProfileStatusTimeout means the profile couldn't be traversed in time
+	ProfileStatusTimeout ProfileStatus = "timeout"
+	// ProfileStatusError means there was an error, including cancellation
+	ProfileStatusError ProfileStatus = "error"
+)
+
 // ProcessedProfileSummary represents profile summary
 // with processed ssh entries, containing instance names, etc
 type ProcessedProfileSummary struct {
 	ProfileConfig
 
 	SSHEntries []SSHEntry
+	// Endpoints are the service endpoints in the VPCs of the profile
+	Endpoints []ServiceEndpoint
+
+	Status   ProfileStatus
+	Err      error         `yaml:"-"` // set if the status isn't ok
+	Duration time.Duration // how long it took to traverse the profile
+	// InstanceCount is the number of instances found
+	InstanceCount int
+}
+
+// TraverseOptions configures TraverseProfiles
+type TraverseOptions struct {
+	NoProfilePrefix bool
+	// Concurrency limits the number of profiles traversed at the same time, 0 means no limit
+	Concurrency int
+	// Timeout limits the time spent on a single profile, 0 means no limit
+	Timeout time.Duration
+	// Endpoints enables discovery of RDS, ElastiCache and OpenSearch endpoints
+	Endpoints bool
+	// Stopped includes the stopped instances, so they can be started on connect
+	Stopped bool
 }
 
-// TraverseProfiles goes through all profiles and returns a list of ProcessedProfileSummary
-func TraverseProfiles(profiles []ProfileConfig, noProfilePrefix bool) ([]ProcessedProfileSummary, error) {
+// TraverseProfiles goes through all profiles and returns a list of ProcessedProfileSummary.
+// It returns a summary for every profile, including the failed ones, so if the context gets cancelled
+// the profiles which have been traversed by then are still there.
+func TraverseProfiles(ctx context.Context, profiles []ProfileConfig, options TraverseOptions) ([]ProcessedProfileSummary, error) {
 	log.Debugf("Traversing through %d profiles", len(profiles))
-	var profileSummaryChan = make(chan profileSummary, len(profiles))
-	var errChan = make(chan error, len(profiles))
+	var concurrency = options.Concurrency
+	if concurrency <= 0 || concurrency > len(profiles) {
+		concurrency = len(profiles)
+	}
 
-	var profileSummaries []profileSummary
-	for _, profile := range profiles {
-		go func(profile ProfileConfig) {
-			DescribeProfile(profile, profileSummaryChan, errChan)
-		}(profile)
+	var processedProfileSummaries = make([]ProcessedProfileSummary, len(profiles))
+	var summaries = make([]profileSummary, len(profiles))
+	var semaphore = make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for n, profile := range profiles {
+		wg.Add(1)
+		go func(n int, profile ProfileConfig) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done(): // cancelled while waiting for a free slot
+				processedProfileSummaries[n] = failedProfileSummary(profile, ProfileStatusError, ctx.Err(), 0)
+				return
+			}
+			summaries[n], processedProfileSummaries[n] = traverseProfile(ctx, profile, options)
+		}(n, profile)
 	}
+	wg.Wait()
+
+	// the instances are processed once all profiles are there, as they can go through the bastions of the others
+	shareBastions(summaries)
+	for n := range processedProfileSummaries {
+		if processedProfileSummaries[n].Status == ProfileStatusOK {
+			processedProfileSummaries[n].SSHEntries = processProfileSummary(summaries[n], options)
+			processedProfileSummaries[n].Endpoints = processEndpoints(summaries[n], options)
+		}
+	}
+	// the bastions can be behind the jump hosts of the other profiles
+	resolveJumpHosts(processedProfileSummaries)
+
+	// sort alphabetically by profile name
+	sort.Slice(processedProfileSummaries, func(i, j int) bool {
+		return processedProfileSummaries[i].Name < processedProfileSummaries[j].Name
+	})
 
 	var errors error // errors collector
+	for _, summary := range processedProfileSummaries {
+		if summary.Err != nil {
+			errors = multierror.Append(errors, summary.Err)
+		}
+	}
+	return processedProfileSummaries, errors
+}
+
+// traverseProfile describes a single profile within the timeout. It returns the described profile
+// and its processed summary without the entries, which are added once all profiles are described.
+func traverseProfile(ctx context.Context, profile ProfileConfig, options TraverseOptions) (profileSummary, ProcessedProfileSummary) {
+	var profileCtx = ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		profileCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		summary profileSummary
+		err     error
+	}
+	var start = time.Now()
+	// the result channel is buffered so the goroutine doesn't leak
+	// if the AWS SDK doesn't respect the context and we give up waiting
+	var resultChan = make(chan result, 1)
+	go func() {
+		summary, err := DescribeProfile(profileCtx, profile, options)
+		resultChan <- result{summary: summary, err: err}
+	}()
+
+	var res result
+	select {
+	case res = <-resultChan:
+	case <-profileCtx.Done():
+		res.err = fmt.Errorf("Couldn't describe '%s': %s", profile.Name, profileCtx.Err())
+	}
+	var duration = time.Since(start)
+	logCtx := log.WithFields(log.Fields{"profile": profile.Name, "duration": duration.Round(time.Millisecond)})
 
-	for n := 0; n < len(profiles); n++ {
-		select {
-		case summary := <-profileSummaryChan:
-			profileSummaries = append(profileSummaries, summary)
-		case err := <-errChan:
-			errors = multierror.Append(errors, err)
+	if res.err != nil {
+		var status = ProfileStatusError
+		// it's a timeout only if the parent context is still fine
+		if profileCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			status = ProfileStatusTimeout
 		}
+		logCtx.WithError(res.err).Debugf("Profile status: %s", status)
+		return profileSummary{}, failedProfileSummary(profile, status, res.err, duration)
 	}
+	logCtx.Debugf("Found %d instances", len(res.summary.Instances))
 
-	// sort alphabetically by profile name
-	sort.Slice(profileSummaries, func(i, j int) bool { return profileSummaries[i].Name < profileSummaries[j].Name })
-
-	var processedProfileSummaries []ProcessedProfileSummary
-	// go through all profileSummaries and
-	// create sshEntries out of it
-	for _, summary := range profileSummaries {
-		var profileSSHEntries []SSHEntry
-
-		ctx := log.WithField("profile", summary.Name)
-		// group instances by VPC
-		ctx.Debug("Grouping instances by VPC")
-
-		var vpcInstances []linq.Group
-
-		// take the instances slice
-		linq.From(summary.Instances).OrderBy(instanceNameSorter). // sort by name first
-										ThenBy(instanceLaunchTimeSorter).         // then by launch time
-										GroupBy(func(i interface{}) interface{} { // and then group by vpc
-				vpcID := i.(types.Instance).VpcId
-				return aws.ToString(vpcID)
-			}, func(i interface{}) interface{} {
-				return i.(types.Instance)
-			}).ToSlice(&vpcInstances)
-
-		var commonBastions []types.Instance
-		linq.From(summary.Instances).OrderBy(instanceNameSorter). // sort by name first
-										ThenBy(instanceLaunchTimeSorter). // then by launch time
-										Where(
-				func(f interface{}) bool {
-					return isBastionFromTags(f.(types.Instance).Tags, true) // check for global tag as well
-				},
-			).ToSlice(&commonBastions)
-
-		ctx.Debugf("Found %d common (global) bastions", len(commonBastions))
-
-		for _, vpcGroup := range vpcInstances { // take the instances grouped by vpc and iterate
-			var vpcBastions []types.Instance
-			linq.From(vpcGroup.Group).Where(
-				func(f interface{}) bool {
-					return isBastionFromTags(f.(types.Instance).Tags, false) // "false" means don't check for global tag
-				},
-			).ToSlice(&vpcBastions)
-
-			ctx.WithField("vpc", vpcGroup.Key).Debugf("Found %d bastions", len(vpcBastions))
-
-			var nameInstances []linq.Group
-			linq.From(vpcGroup.Group).GroupBy(func(i interface{}) interface{} { // now group them by name
-				instanceName := getNameFromTags(i.(types.Instance).Tags)
-				return instanceName
-			}, func(i interface{}) interface{} {
-				return i.(types.Instance)
-			}).ToSlice(&nameInstances)
-
-			// now we have instances, grouped by vpc and name
-			for _, nameGroup := range nameInstances {
-				instanceName := nameGroup.Key.(string)
-
-				for n, instance := range nameGroup.Group {
-					instance := instance.(types.Instance)
-					var entry = SSHEntry{
-						InstanceID: aws.ToString(instance.InstanceId),
-						ProfileConfig: ProfileConfig{
-							Name:   summary.Name,
-							Region: summary.Region,
-							Domain: summary.Domain,
-						},
-					}
-					entry.User = GetUserFromTags(instance.Tags)
-					entry.Port = getPortFromTags(instance.Tags)
-
-					// first try to find a bastion from this vpc
-					bastion := findBestBastion(instanceName, vpcBastions)
-					if bastion == nil { // then try common ones
-						bastion = findBestBastion(instanceName, commonBastions)
-					}
-					entry.Address = aws.ToString(instance.PrivateIpAddress) // get the private address first as we always have one
-					if bastion != nil {                                     // get private address and add proxyhost, which is the bastion ip
-						// refer to the bastion by its instance ID
-						// which we should have a record for
-						entry.ProxyJump = aws.ToString(bastion.InstanceId)
-					} else { // get public IP if we have one
-						if publicIP := aws.ToString(instance.PublicIpAddress); publicIP != "" {
-							entry.Address = aws.ToString(instance.PublicIpAddress)
-						}
-					}
-					var instanceIndex string
-					if len(nameGroup.Group) > 1 {
-						instanceIndex = fmt.Sprintf("%d", n+1)
-					}
-					// add all names of the instance
-					var name = getInstanceCanonicalName(summary.Name, instanceName, instanceIndex)
-					if noProfilePrefix {
-						name = getInstanceCanonicalName("", instanceName, instanceIndex)
-					}
-					entry.Names = append(entry.Names, name, entry.InstanceID, fmt.Sprintf("%s.%s", entry.Address, entry.ProfileConfig.Name))
-					if summary.Domain != "" {
-						entry.Names = append(entry.Names, fmt.Sprintf("%s.%s", name, summary.Domain))
-					}
-					profileSSHEntries = append(profileSSHEntries, entry)
+	return res.summary, ProcessedProfileSummary{
+		ProfileConfig: res.summary.ProfileConfig,
+		Status:        ProfileStatusOK,
+		Duration:      duration,
+		InstanceCount: len(res.summary.Instances),
+	}
+}
+
+func failedProfileSummary(profile ProfileConfig, status ProfileStatus, err error, duration time.Duration) ProcessedProfileSummary {
+	return ProcessedProfileSummary{
+		ProfileConfig: profile,
+		Status:        status,
+		Err:           err,
+		Duration:      duration,
+	}
+}
+
+// newInstanceEntry creates the ssh entry of the instance without the way to reach it
+func newInstanceEntry(summary profileSummary, instance types.Instance) SSHEntry {
+	var entry = SSHEntry{
+		InstanceID: aws.ToString(instance.InstanceId),
+		ProfileConfig: ProfileConfig{
+			Name:   summary.Name,
+			Region: summary.InstanceRegions[aws.ToString(instance.InstanceId)],
+			Domain: summary.Domain,
+			// they are kept in the cache, so the choice of the bastion can be explained
+			// and the bastions can be found the same way later on
+			BastionProfile: summary.BastionProfile,
+			BastionName:    summary.BastionName,
+			BastionTag:     summary.BastionTag,
+		},
+	}
+	entry.User = GetUserFromTags(instance.Tags)
+	entry.Port = GetPortFromTags(instance.Tags)
+	entry.Tags = getTagsMap(instance.Tags)
+	entry.Metadata = getInstanceMetadata(instance)
+	entry.Metadata.VpcCIDR = vpcCIDR(summary.VpcCIDRs[entry.Metadata.VpcID], entry.Metadata.PrivateIPAddress)
+	return entry
+}
+
+// processProfileSummary creates ssh entries out of the instances of the profile
+func processProfileSummary(summary profileSummary, options TraverseOptions) []SSHEntry {
+	var profileSSHEntries []SSHEntry
+
+	ctx := log.WithField("profile", summary.Name)
+	// group instances by VPC
+	ctx.Debug("Grouping instances by VPC")
+
+	var vpcInstances []linq.Group
+
+	// take the instances slice
+	linq.From(summary.Instances).OrderBy(instanceNameSorter). // sort by name first
+									ThenBy(instanceLaunchTimeSorter).         // then by launch time
+									GroupBy(func(i interface{}) interface{} { // and then group by vpc
+			vpcID := i.(types.Instance).VpcId
+			return aws.ToString(vpcID)
+		}, func(i interface{}) interface{} {
+			return i.(types.Instance)
+		}).ToSlice(&vpcInstances)
+
+	var router = newRouter(summary, options)
+	ctx.Debugf("Found %d common (global) bastions and %d routed ones", len(router.commonBastions), len(router.routedBastions))
+
+	for _, vpcGroup := range vpcInstances { // take the instances grouped by vpc and iterate
+		ctx.WithField("vpc", vpcGroup.Key).Debugf("Found %d bastions", len(router.vpcBastions[vpcGroup.Key.(string)]))
+
+		var nameInstances []linq.Group
+		linq.From(vpcGroup.Group).GroupBy(func(i interface{}) interface{} { // now group them by name
+			instanceName := getNameFromTags(i.(types.Instance).Tags)
+			return instanceName
+		}, func(i interface{}) interface{} {
+			return i.(types.Instance)
+		}).ToSlice(&nameInstances)
+
+		// now we have instances, grouped by vpc and name
+		for _, nameGroup := range nameInstances {
+			instanceName := nameGroup.Key.(string)
+
+			for n, instance := range nameGroup.Group {
+				instance := instance.(types.Instance)
+				entry := newInstanceEntry(summary, instance)
+				router.route(&entry, instance, instanceName, nil)
+
+				var instanceIndex string
+				if len(nameGroup.Group) > 1 {
+					instanceIndex = fmt.Sprintf("%d", n+1)
+				}
+				// add all names of the instance
+				var name = getInstanceCanonicalName(summary.Name, instanceName, instanceIndex)
+				if options.NoProfilePrefix {
+					name = getInstanceCanonicalName("", instanceName, instanceIndex)
+				}
+				entry.Names = append(entry.Names, name, entry.InstanceID, fmt.Sprintf("%s.%s", entry.Address, entry.ProfileConfig.Name))
+				if summary.Domain != "" {
+					entry.Names = append(entry.Names, fmt.Sprintf("%s.%s", name, summary.Domain))
 				}
+				profileSSHEntries = append(profileSSHEntries, entry)
 			}
 		}
-		// sort by the first (main) name alphabetically
-		sort.SliceStable(profileSSHEntries, func(i, j int) bool { return profileSSHEntries[i].Names[0] < profileSSHEntries[j].Names[0] })
+	}
+	// sort by the first (main) name alphabetically
+	sort.SliceStable(profileSSHEntries, func(i, j int) bool { return profileSSHEntries[i].Names[0] < profileSSHEntries[j].Names[0] })
 
-		processedProfileSummaries = append(processedProfileSummaries, ProcessedProfileSummary{
-			ProfileConfig: ProfileConfig{
-				Name:   summary.Name,
-				Region: summary.Region,
-				Domain: summary.Domain,
-			},
-			SSHEntries: profileSSHEntries,
-		})
+	return profileSSHEntries
+}
+
+// processEndpoints names the service endpoints of the profile and routes them through
+// the bastions the same way as the instances in the same VPC
+func processEndpoints(summary profileSummary, options TraverseOptions) []ServiceEndpoint {
+	var router = newRouter(summary, options)
+
+	var endpoints []ServiceEndpoint
+	for _, endpoint := range summary.Endpoints {
+		var prefix = summary.Name
+		if options.NoProfilePrefix {
+			prefix = ""
+		}
+		endpoint.Name = getInstanceCanonicalName(prefix, endpointNamePrefixes[endpoint.Service]+"-"+strings.ToLower(endpoint.ID), "")
+		endpoint.ProfileConfig.Name = summary.Name
+		endpoint.ProfileConfig.Domain = summary.Domain
+
+		// the endpoints can be listed by their names in x-aws-ssh-bastion-for too
+		bastion := findBestBastion(endpoint.Name, bastionsFor(endpoint.Name, "", router.routedBastions))
+		if bastion == nil {
+			bastion = findBestBastion(endpoint.Name, router.vpcBastions[endpoint.VpcID])
+		}
+		if bastion == nil {
+			bastion = findBestBastion(endpoint.Name, router.commonBastions)
+		}
+		if bastion == nil { // the endpoints have no public addresses, so the shared bastions are always fine
+			bastion = findBestBastion(endpoint.Name, summary.SharedBastions)
+		}
+		if bastion != nil {
+			endpoint.ProxyJump = aws.ToString(bastion.InstanceId)
+		}
+		endpoints = append(endpoints, endpoint)
 	}
-	return processedProfileSummaries, errors
+	sort.SliceStable(endpoints, func(i, j int) bool { return endpoints[i].Name < endpoints[j].Name })
+	return endpoints
+}
+
+// EndpointEntries returns the ssh entries forwarding the local ports to the service endpoints of the profile.
+// The entries are the bastions of the endpoints renamed after them, so "ssh -N <endpoint name>" opens the tunnel.
+// The endpoints without a bastion are skipped.
+func EndpointEntries(summary ProcessedProfileSummary) []SSHEntry {
+	var bastions = make(map[string]SSHEntry)
+	for _, entry := range summary.SSHEntries {
+		bastions[entry.InstanceID] = entry
+	}
+
+	var entries []SSHEntry
+	for _, endpoint := range summary.Endpoints {
+		bastion, ok := bastions[endpoint.ProxyJump]
+		if !ok {
+			continue
+		}
+		var entry = bastion
+		entry.Names = []string{endpoint.Name}
+		if endpoint.ProfileConfig.Domain != "" {
+			entry.Names = append(entry.Names, fmt.Sprintf("%s.%s", endpoint.Name, endpoint.ProfileConfig.Domain))
+		}
+		entry.LocalForwards = []string{endpoint.LocalForward()}
+		entries = append(entries, entry)
+	}
+	return entries
 }
 
 // DescribeProfile describes the specified profile
-func DescribeProfile(profile ProfileConfig, sum chan profileSummary, errChan chan error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
+func DescribeProfile(ctx context.Context, profile ProfileConfig, options TraverseOptions) (profileSummary, error) {
+	bastions, err := profile.BastionMatcher()
+	if err != nil {
+		return profileSummary{}, fmt.Errorf("can't match the bastions of '%s': %s", profile.Name, err)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithSharedConfigProfile(profile.Name))
 
 	if err != nil {
-		errChan <- fmt.Errorf("Couldn't create session for '%s': %s", profile.Name, err)
-		return
+		return profileSummary{}, fmt.Errorf("Couldn't create session for '%s': %s", profile.Name, err)
 	}
 
-	profileSummary := profileSummary{
+	summary := profileSummary{
 		ProfileConfig: ProfileConfig{
-			Name:   profile.Name,
-			Region: cfg.Region,
-			Domain: profile.Domain,
+			Name:      profile.Name,
+			Region:    cfg.Region,
+			Domain:    profile.Domain,
+			Regions:   profile.Regions,
+			Transport: profile.Transport,
+			// the bastions of the profile are shared once all profiles are described
+			BastionProfile: profile.BastionProfile,
+			BastionName:    profile.BastionName,
+			BastionTag:     profile.BastionTag,
 		},
+		Bastions:         bastions,
+		InstanceRegions:  make(map[string]string),
+		ManagedInstances: make(map[string]bool),
+		VpcCIDRs:         make(map[string][]string),
+	}
+
+	regions, err := getProfileRegions(ctx, cfg, profile.Regions)
+	if err != nil {
+		return profileSummary{}, fmt.Errorf("Can't get regions for '%s': %s", profile.Name, err)
+	}
+	log.WithField("profile", profile.Name).Debugf("Querying regions %s", strings.Join(regions, ", "))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protects summary and errors
+	var errors error
+
+	for _, region := range regions {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			instances, err := describeRegionInstances(ctx, cfg, region, options.Stopped)
+			var managed map[string]bool
+			if err == nil && usesSSMTransport(instances, profile.Transport) {
+				// without the ssm data the instances are still reachable through the bastions
+				var ssmErr error
+				if managed, ssmErr = describeManagedInstances(ctx, cfg, region); ssmErr != nil {
+					log.WithFields(log.Fields{"profile": profile.Name, "region": region}).WithError(ssmErr).Warn("can't get SSM managed instances")
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errors = multierror.Append(errors, fmt.Errorf("%s: %s", region, err))
+				return
+			}
+			for instanceID := range managed {
+				summary.ManagedInstances[instanceID] = true
+			}
+			for _, instance := range instances {
+				summary.Instances = append(summary.Instances, instance)
+				summary.InstanceRegions[aws.ToString(instance.InstanceId)] = region
+			}
+		}(region)
+
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			endpoints, err := describeInstanceConnectEndpoints(ctx, cfg, region)
+			// the bastions are used without them, and many users aren't allowed to see them at all
+			if err != nil {
+				logCtx := log.WithFields(log.Fields{"profile": profile.Name, "region": region}).WithError(err)
+				if strings.Contains(err.Error(), "UnauthorizedOperation") {
+					logCtx.Debug("not allowed to get instance connect endpoints")
+				} else {
+					logCtx.Warn("can't get instance connect endpoints")
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			summary.ConnectEndpoints = append(summary.ConnectEndpoints, endpoints...)
+		}(region)
+
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			cidrs, err := describeVpcCIDRs(ctx, cfg, region)
+			// they are only used to cache the probes of the private addresses
+			if err != nil {
+				log.WithFields(log.Fields{"profile": profile.Name, "region": region}).WithError(err).Debug("can't get the VPC CIDR blocks")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for vpcID, vpcCIDRs := range cidrs {
+				summary.VpcCIDRs[vpcID] = vpcCIDRs
+			}
+		}(region)
+
+		if options.Endpoints {
+			wg.Add(1)
+			go func(region string) {
+				defer wg.Done()
+				endpoints, err := describeRegionEndpoints(ctx, cfg, region)
+				// the endpoints are nice to have, so the profile is fine without them
+				if err != nil {
+					log.WithFields(log.Fields{"profile": profile.Name, "region": region}).WithError(err).Warn("can't get all service endpoints")
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				summary.Endpoints = append(summary.Endpoints, endpoints...)
+			}(region)
+		}
 	}
+	wg.Wait()
 
-	svc := ec2.NewFromConfig(cfg)
+	if errors != nil {
+		return summary, fmt.Errorf("Can't get full information for '%s': %s", profile.Name, errors)
+	}
+	return summary, nil
+}
+
+// getProfileRegions returns the list of regions to query for a profile.
+// If no regions are configured, the region of the profile is used.
+func getProfileRegions(ctx context.Context, cfg aws.Config, regions []string) ([]string, error) {
+	if len(regions) == 0 {
+		return []string{cfg.Region}, nil
+	}
+	for _, region := range regions {
+		if region == AllRegions {
+			svc := ec2.NewFromConfig(cfg)
+			result, err := svc.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+			if err != nil {
+				return nil, err
+			}
+			var allRegions []string
+			for _, region := range result.Regions {
+				allRegions = append(allRegions, aws.ToString(region.RegionName))
+			}
+			sort.Strings(allRegions)
+			return allRegions, nil
+		}
+	}
+	return regions, nil
+}
+
+// describeRegionInstances returns all running instances in the region,
+// and the stopped ones too if stopped is set
+func describeRegionInstances(ctx context.Context, cfg aws.Config, region string, stopped bool) ([]types.Instance, error) {
+	regionCfg := cfg.Copy()
+	regionCfg.Region = region
+
+	var states = []string{string(types.InstanceStateNameRunning)}
+	if stopped {
+		states = append(states, string(types.InstanceStateNameStopped))
+	}
+	svc := ec2.NewFromConfig(regionCfg)
 	input := &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
 			{
 				Name:   aws.String("instance-state-name"),
-				Values: []string{string(types.InstanceStateNameRunning)},
+				Values: states,
 			},
 		},
 	}
 
+	var instances []types.Instance
 	paginator := ec2.NewDescribeInstancesPaginator(svc, input)
 	for paginator.HasMorePages() {
-		result, subErr := paginator.NextPage(context.TODO())
-		if subErr != nil {
-			err = subErr
-			break
-		} else {
-			for _, reservation := range result.Reservations {
-				for _, instance := range reservation.Instances {
-					profileSummary.Instances = append(profileSummary.Instances, instance)
-				}
-			}
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range result.Reservations {
+			instances = append(instances, reservation.Instances...)
 		}
 	}
+	return instances, nil
+}
 
-	if err != nil {
-		errChan <- fmt.Errorf("Can't get full information for '%s': %s", profile, err)
-	} else {
-		sum <- profileSummary
+// describeVpcCIDRs returns the CIDR blocks of the VPCs in the region by their ids, the primary one goes first
+func describeVpcCIDRs(ctx context.Context, cfg aws.Config, region string) (map[string][]string, error) {
+	regionCfg := cfg.Copy()
+	regionCfg.Region = region
+
+	var cidrs = make(map[string][]string)
+	paginator := ec2.NewDescribeVpcsPaginator(ec2.NewFromConfig(regionCfg), &ec2.DescribeVpcsInput{})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, vpc := range result.Vpcs {
+			vpcID := aws.ToString(vpc.VpcId)
+			cidrs[vpcID] = append(cidrs[vpcID], aws.ToString(vpc.CidrBlock))
+			for _, association := range vpc.CidrBlockAssociationSet {
+				if cidr := aws.ToString(association.CidrBlock); cidr != aws.ToString(vpc.CidrBlock) {
+					cidrs[vpcID] = append(cidrs[vpcID], cidr)
+				}
+			}
+		}
 	}
+	return cidrs, nil
 }
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Tags routing the instances through the bastions
+const (
+	// bastionTag set to true makes the instance a bastion, set to false it never is one
+	bastionTag = "x-aws-ssh-bastion"
+	// bastionForTag makes the instance a bastion only for the instances with matching names or subnets
+	bastionForTag = "x-aws-ssh-bastion-for"
+	// proxyJumpTag sets the host to reach the instance through
+	proxyJumpTag = "x-aws-ssh-proxyjump"
+)
+
+// BastionMatcher tells the bastions from the other instances. Regardless of the matcher,
+// the instances with x-aws-ssh-bastion set to true or with x-aws-ssh-bastion-for are bastions,
+// and the ones with x-aws-ssh-bastion set to false are not.
+type BastionMatcher struct {
+	// Name is matched against the lowercased Name tag
+	Name *regexp.Regexp
+	// TagKey and TagValue match the bastions by the tag, the empty value matches any
+	TagKey,
+	TagValue string
+}
+
+// DefaultBastionMatcher matches the instances with "bastion" in their names,
+// it's used if neither the name nor the tag is set
+var DefaultBastionMatcher = BastionMatcher{Name: regexp.MustCompile(bastionCanonicalName)}
+
+// NewBastionMatcher returns the matcher of the name regular expression and the tag in key[=value] format,
+// either of them can be empty
+func NewBastionMatcher(name, tag string) (BastionMatcher, error) {
+	var matcher BastionMatcher
+	if name != "" {
+		var err error
+		if matcher.Name, err = regexp.Compile(name); err != nil {
+			return matcher, fmt.Errorf("invalid bastion name %q: %s", name, err)
+		}
+	}
+	if tag != "" {
+		parts := strings.SplitN(tag, "=", 2)
+		if parts[0] == "" {
+			return matcher, fmt.Errorf("invalid bastion tag %q, should be key[=value]", tag)
+		}
+		matcher.TagKey = parts[0]
+		if len(parts) > 1 {
+			matcher.TagValue = parts[1]
+		}
+	}
+	return matcher, nil
+}
+
+// BastionMatcher returns the matcher of the bastions of the profile
+func (p ProfileConfig) BastionMatcher() (BastionMatcher, error) {
+	return NewBastionMatcher(p.BastionName, p.BastionTag)
+}
+
+// IsBastion returns true if the instance is a bastion. If checkGlobal is set,
+// it also has to have the global tag, so it can be used for all VPCs.
+func (m BastionMatcher) IsBastion(tags []types.Tag, checkGlobal bool) bool {
+	if !m.isBastion(tags) {
+		return false
+	}
+	return !checkGlobal || isGlobalFromTags(tags)
+}
+
+func (m BastionMatcher) isBastion(tags []types.Tag) bool {
+	if value := getTagValue(bastionTag, tags); value != "" {
+		return isTrue(value)
+	}
+	if getTagValue(bastionForTag, tags) != "" {
+		return true
+	}
+	if m.Name == nil && m.TagKey == "" {
+		m = DefaultBastionMatcher
+	}
+	if m.Name != nil && m.Name.MatchString(getNameFromTags(tags)) {
+		return true
+	}
+	if m.TagKey != "" {
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == m.TagKey && (m.TagValue == "" || aws.ToString(tag.Value) == m.TagValue) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRoutedBastion returns true if the bastion is only for the instances listed in its x-aws-ssh-bastion-for tag
+func isRoutedBastion(tags []types.Tag) bool {
+	return getTagValue(bastionForTag, tags) != ""
+}
+
+// bastionsFor returns the bastions with x-aws-ssh-bastion-for tag listing the name or the subnet.
+// The tag is a comma or space separated list of the subnet ids and the name globs.
+func bastionsFor(name, subnetID string, bastions []types.Instance) []types.Instance {
+	var found []types.Instance
+	for _, bastion := range bastions {
+		targets := strings.FieldsFunc(getTagValue(bastionForTag, bastion.Tags), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		for _, target := range targets {
+			var matched bool
+			if strings.HasPrefix(target, "subnet-") {
+				matched = subnetID != "" && target == subnetID
+			} else {
+				matched, _ = path.Match(strings.ToLower(target), name)
+			}
+			if matched {
+				found = append(found, bastion)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// GetProxyJumpFromTags gets the host to reach the instance through from tags
+func GetProxyJumpFromTags(tags []types.Tag) string {
+	return getTagValue(proxyJumpTag, tags)
+}
@@ -0,0 +1,233 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func tags(keyValues ...string) []types.Tag {
+	var tags []types.Tag
+	for n := 0; n+1 < len(keyValues); n += 2 {
+		tags = append(tags, types.Tag{Key: aws.String(keyValues[n]), Value: aws.String(keyValues[n+1])})
+	}
+	return tags
+}
+
+func TestBastionMatcher(t *testing.T) {
+	jump, err := NewBastionMatcher("^(jump|gateway)", "role=bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		matcher     BastionMatcher
+		tags        []types.Tag
+		checkGlobal bool
+		want        bool
+		description string
+	}{
+		{BastionMatcher{}, tags("Name", "prod-bastion"), false, true, "default name"},
+		{BastionMatcher{}, tags("Name", "prod-bastion"), true, false, "default name, not global"},
+		{BastionMatcher{}, tags("Name", "prod-bastion", "x-aws-ssh-global", "yes"), true, true, "default name, global"},
+		{BastionMatcher{}, tags("Name", "bastion-metrics-exporter", "x-aws-ssh-bastion", "false"), false, false, "opted out"},
+		{BastionMatcher{}, tags("Name", "proxy", "x-aws-ssh-bastion", "true"), false, true, "opted in"},
+		{BastionMatcher{}, tags("Name", "proxy", "x-aws-ssh-bastion-for", "web-*"), false, true, "routed"},
+		{jump, tags("Name", "Jump-1"), false, true, "name regexp"},
+		{jump, tags("Name", "prod-bastion"), false, false, "default name is replaced"},
+		{jump, tags("Name", "proxy", "role", "bastion"), false, true, "tag"},
+		{jump, tags("Name", "proxy", "role", "web"), false, false, "tag value"},
+	}
+	for _, test := range tests {
+		if got := test.matcher.IsBastion(test.tags, test.checkGlobal); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.description, got, test.want)
+		}
+	}
+
+	for _, spec := range [][2]string{{"(", ""}, {"", "=value"}} {
+		if _, err := NewBastionMatcher(spec[0], spec[1]); err == nil {
+			t.Errorf("%v: no error", spec)
+		}
+	}
+}
+
+// TestBastionRouting checks the routing tags take precedence over the bastions chosen by the names
+func TestBastionRouting(t *testing.T) {
+	instance := func(id, subnetID string, keyValues ...string) types.Instance {
+		return types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String("vpc-1"),
+			SubnetId:         aws.String(subnetID),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			Tags:             tags(keyValues...),
+		}
+	}
+	summary := profileSummary{
+		ProfileConfig: ProfileConfig{Name: "prod"},
+		Instances: []types.Instance{
+			instance("i-1", "subnet-1", "Name", "bastion"),
+			instance("i-2", "subnet-1", "Name", "bastion-metrics-exporter", "x-aws-ssh-bastion", "false"),
+			instance("i-3", "subnet-1", "Name", "web-jump", "x-aws-ssh-bastion-for", "web-*, subnet-2"),
+			instance("i-4", "subnet-1", "Name", "web-1"),
+			instance("i-5", "subnet-2", "Name", "app"),
+			instance("i-6", "subnet-1", "Name", "worker"),
+			instance("i-7", "subnet-1", "Name", "db", "x-aws-ssh-proxyjump", "prod-web-1"),
+		},
+		ConnectEndpoints: []InstanceConnectEndpoint{{ID: "eice-1", DNSName: "eice-1.example.com", VpcID: "vpc-1"}},
+	}
+
+	var want = map[string][2]string{ // proxy jump and transport
+		"i-1": {"", TransportEICE}, // no public address
+		"i-2": {"", TransportEICE}, // not a bastion, so it would go through i-1
+		"i-3": {"", TransportEICE},
+		"i-4": {"i-3", ""}, // name glob
+		"i-5": {"i-3", ""}, // subnet
+		"i-6": {"", TransportEICE},
+		"i-7": {"prod-web-1", ""},
+	}
+	for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+		if got := [2]string{entry.ProxyJump, entry.Transport}; got != want[entry.InstanceID] {
+			t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+		}
+	}
+
+	// without the endpoint the others go through the bastion chosen by the name
+	summary.ConnectEndpoints = nil
+	want["i-1"] = [2]string{"", ""}
+	want["i-2"] = [2]string{"i-1", ""}
+	want["i-3"] = [2]string{"", ""}
+	want["i-6"] = [2]string{"i-1", ""}
+	for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+		if got := [2]string{entry.ProxyJump, entry.Transport}; got != want[entry.InstanceID] {
+			t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+		}
+	}
+
+	// the profile matches its bastions differently, which is kept in the cache along with the entries
+	summary.ProfileConfig.BastionName = "^worker$"
+	summary.Bastions, _ = summary.BastionMatcher()
+	want["i-1"] = [2]string{"i-6", ""}
+	want["i-2"] = [2]string{"i-6", ""}
+	want["i-6"] = [2]string{"", ""}
+	entries := processProfileSummary(summary, TraverseOptions{})
+	for _, entry := range entries {
+		if got := [2]string{entry.ProxyJump, entry.Transport}; got != want[entry.InstanceID] {
+			t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+		}
+	}
+	cached := summaryFromEntries(ProcessedProfileSummary{ProfileConfig: entries[0].ProfileConfig, SSHEntries: entries})
+	if !cached.Bastions.IsBastion(tags("Name", "worker"), false) || cached.Bastions.IsBastion(tags("Name", "bastion"), false) {
+		t.Errorf("the cached entries don't keep the bastion matcher of the profile: %+v", entries[0].ProfileConfig)
+	}
+}
+
+func TestResolveJumpHosts(t *testing.T) {
+	entry := func(instanceID, name, proxyJump, transport string) SSHEntry {
+		return SSHEntry{InstanceID: instanceID, Names: []string{name, instanceID}, ProxyJump: proxyJump, Transport: transport}
+	}
+	var summaries = []ProcessedProfileSummary{
+		{SSHEntries: []SSHEntry{
+			entry("i-1", "prod-db", "i-2", ""),
+			entry("i-2", "prod-bastion", "shared-bastion", ""),
+			entry("i-3", "prod-web", "i-2", TransportSSM),
+			entry("i-4", "prod-loop-1", "i-5", ""),
+			entry("i-5", "prod-loop-2", "prod-loop-1", ""),
+			entry("i-6", "prod-app", "i-7", ""),
+			entry("i-7", "prod-ssm-bastion", "i-2", TransportSSM),
+		}},
+		{SSHEntries: []SSHEntry{
+			// from another profile, it's referred by the name
+			entry("i-8", "shared-bastion", "external.example.com", ""),
+		}},
+	}
+	resolveJumpHosts(summaries)
+
+	var want = map[string]string{
+		"i-1": "external.example.com,shared-bastion,i-2",
+		"i-2": "external.example.com,shared-bastion",
+		"i-3": "i-2",         // transport ignores jump hosts
+		"i-4": "i-5",         // loop
+		"i-5": "prod-loop-1", // loop
+		"i-6": "i-7",         // the bastion is reached with the transport
+		"i-7": "i-2",
+		"i-8": "external.example.com",
+	}
+	for _, summary := range summaries {
+		for _, entry := range summary.SSHEntries {
+			if got := strings.Join(entry.JumpHosts(), ","); got != want[entry.InstanceID] {
+				t.Errorf("%s: got %s, want %s", entry.InstanceID, got, want[entry.InstanceID])
+			}
+		}
+	}
+}
+
+// TestSharedBastions checks the instances go through the bastions of the bastion profile,
+// and through the global bastions of the other profiles only if they have no public addresses
+func TestSharedBastions(t *testing.T) {
+	instance := func(id, vpcID, publicIP string, keyValues ...string) types.Instance {
+		return types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String(vpcID),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			PublicIpAddress:  aws.String(publicIP),
+			Tags:             tags(keyValues...),
+		}
+	}
+	summaries := []profileSummary{
+		{
+			ProfileConfig: ProfileConfig{Name: "network"},
+			Instances: []types.Instance{
+				instance("i-1", "vpc-1", "54.0.0.1", "Name", "bastion"),
+				instance("i-2", "vpc-1", "54.0.0.2", "Name", "global-bastion", "Global", "yes"),
+				instance("i-3", "vpc-1", "54.0.0.3", "Name", "web-jump", "x-aws-ssh-bastion-for", "web"),
+			},
+		},
+		{
+			ProfileConfig: ProfileConfig{Name: "workload", BastionProfile: "network"},
+			Instances: []types.Instance{
+				instance("i-4", "vpc-2", "", "Name", "app"),
+				instance("i-5", "vpc-2", "54.0.0.5", "Name", "web"),
+			},
+		},
+		{
+			ProfileConfig: ProfileConfig{Name: "other"},
+			Instances: []types.Instance{
+				instance("i-6", "vpc-3", "", "Name", "app"),
+				instance("i-7", "vpc-3", "54.0.0.7", "Name", "web"),
+			},
+		},
+		{
+			// the profile has its own bastion
+			ProfileConfig: ProfileConfig{Name: "own", BastionProfile: "network"},
+			Instances: []types.Instance{
+				instance("i-8", "vpc-4", "54.0.0.8", "Name", "bastion"),
+				instance("i-9", "vpc-4", "", "Name", "app"),
+			},
+		},
+	}
+	shareBastions(summaries)
+
+	var want = map[string][2]string{ // proxy jump and address
+		"i-1": {"", "54.0.0.1"},
+		"i-4": {"i-1", "10.0.0.4"}, // the least similar name wins
+		"i-5": {"i-1", "10.0.0.5"}, // the bastions of the bastion profile are used even with the public address
+		"i-6": {"i-2", "10.0.0.6"}, // only the global bastion is shared without the bastion profile
+		"i-7": {"", "54.0.0.7"},
+		"i-9": {"i-8", "10.0.0.9"},
+	}
+	for _, summary := range summaries {
+		for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+			want, ok := want[entry.InstanceID]
+			if !ok {
+				continue
+			}
+			if got := [2]string{entry.ProxyJump, entry.Address}; got != want {
+				t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want)
+			}
+		}
+	}
+	if len(summaries[0].SharedBastions) != 0 {
+		t.Errorf("network shouldn't get the bastions of the others: %d", len(summaries[0].SharedBastions))
+	}
+}
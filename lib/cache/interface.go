@@ -2,18 +2,47 @@ package cache
 
 import (
 	"aws-ssh/lib"
+	"time"
 )
 
 // Cache represents the cache for profiles
 type Cache interface {
 	// Load() loads the cache
 	Load() ([]lib.ProcessedProfileSummary, error)
-	// Save() saves the cache
-	Save([]lib.ProcessedProfileSummary) error
+	// Save() saves the cache and returns what has changed
+	Save([]lib.ProcessedProfileSummary) (Changes, error)
+	// SaveAll() saves the cache of all profiles, removing the profiles which aren't in it anymore
+	SaveAll([]lib.ProcessedProfileSummary) (Changes, error)
 	// Lookup looks up ssh entry by its name
 	// If name is empty or there is no exact match,
 	// it switches to the fuzzy search mode
 	Lookup(name string) (lib.SSHEntry, error)
+	// Get gets ssh entry by its exact name or address, without falling back to the fuzzy search
+	Get(name string) (lib.SSHEntry, error)
+	// Chain returns the entry followed by its jump hosts, resolving their ProxyJumps recursively,
+	// so the last one is connected to first. The jump hosts which aren't cached are left to ssh.
+	Chain(sshEntry lib.SSHEntry) (lib.SSHEntries, error)
 	// ListCanonicalNames() returns all known canonical host names from the cache
 	ListCanonicalNames() ([]string, error)
+	// ProfileState() returns the state of the profile in the cache
+	ProfileState(profile string) (ProfileState, bool)
+	// ProbeCache keeps the probe results of the private networks for the path selection
+	lib.ProbeCache
+}
+
+// Changes represents the number of instances changed by Save()
+type Changes struct {
+	Added, Removed, Changed int
+	// StaleProfiles are the profiles which failed to update, so their last good entries have been kept
+	StaleProfiles []string
+}
+
+// ProfileState represents the state of a profile in the cache
+type ProfileState struct {
+	// Updated is when the profile has been successfully updated last time
+	Updated time.Time
+	// Stale means the last update has failed
+	Stale bool
+	// Error is the error of the last update, if it failed
+	Error string `yaml:",omitempty"`
 }
@@ -2,19 +2,32 @@ package cache
 
 import (
 	"aws-ssh/lib"
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/apex/log"
 	"github.com/hashicorp/go-multierror"
 	fuzzyfinder "github.com/ktr0731/go-fuzzyfinder"
 )
 
-const instancesDir = "instances"
+const (
+	instancesDir = "instances"
+	// endpointsDir has the service endpoints, a file per profile
+	endpointsDir = "endpoints"
+	// probesFile has the probe results of the private networks
+	probesFile = "probes.yaml"
+)
+
+var errNoCache = fmt.Errorf("cache doesn't exist, try \"aws-ssh update\"")
 
 type YAMLCache struct {
 	basedir string
@@ -25,27 +38,19 @@ type YAMLCacheIndex struct {
 	Time           time.Time
 	InstancesIndex map[string]string
 	CanonicalNames []string
+	// Profiles has the state of every profile in the cache
+	Profiles map[string]ProfileState
 }
 
 func (y *YAMLCache) saveIndex() error {
 	// save index
 	var indexFileName = path.Join(y.basedir, fmt.Sprintf("index.yaml"))
 
-	indexFile, err := os.OpenFile(indexFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return fmt.Errorf("can't open %s: %s", indexFileName, err)
-	}
-
-	defer indexFile.Close()
-	encoder := yaml.NewEncoder(indexFile)
-	err = encoder.Encode(&y.index)
+	data, err := yaml.Marshal(&y.index)
 	if err != nil {
 		return fmt.Errorf("can't encode %s: %s", indexFileName, err)
 	}
-	if err := encoder.Close(); err != nil {
-		return fmt.Errorf("can't close %s: %s", indexFileName, err)
-	}
-	return nil
+	return writeFileAtomic(indexFileName, data, 0644)
 }
 
 func (y *YAMLCache) loadIndex() error {
@@ -58,7 +63,7 @@ func (y *YAMLCache) loadIndex() error {
 	indexFile, err := os.OpenFile(indexFileName, os.O_RDONLY, 0644)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("cache doesn't exist, try \"aws-ssh update\"")
+			return errNoCache
 		}
 		return fmt.Errorf("can't open %s: %s", indexFileName, err)
 	}
@@ -72,63 +77,400 @@ func (y *YAMLCache) loadIndex() error {
 	return nil
 }
 
-func (y *YAMLCache) Load() ([]lib.ProcessedProfileSummary, error) { return nil, nil }
-func (y *YAMLCache) Save(profileSummaries []lib.ProcessedProfileSummary) error {
+// Load loads all cached entries grouped by profile.
+// The profiles which failed to update last time have the error status.
+func (y *YAMLCache) Load() ([]lib.ProcessedProfileSummary, error) {
+	if err := y.loadIndex(); err != nil {
+		return nil, err
+	}
+	entries, err := y.loadEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := y.loadEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries = make(map[string]*lib.ProcessedProfileSummary)
+	getSummary := func(profile lib.ProfileConfig) *lib.ProcessedProfileSummary {
+		summary, ok := summaries[profile.Name]
+		if !ok {
+			summary = &lib.ProcessedProfileSummary{
+				ProfileConfig: lib.ProfileConfig{
+					Name:           profile.Name,
+					Domain:         profile.Domain,
+					BastionProfile: profile.BastionProfile,
+					BastionName:    profile.BastionName,
+					BastionTag:     profile.BastionTag,
+				},
+				Status: lib.ProfileStatusOK,
+			}
+			if state := y.index.Profiles[profile.Name]; state.Stale {
+				summary.Status = lib.ProfileStatusError
+				summary.Err = errors.New(state.Error)
+			}
+			summaries[profile.Name] = summary
+		}
+		return summary
+	}
+	for _, entry := range entries {
+		summary := getSummary(entry.ProfileConfig)
+		summary.SSHEntries = append(summary.SSHEntries, entry)
+		summary.InstanceCount++
+	}
+	for _, profileEndpoints := range endpoints {
+		for _, endpoint := range profileEndpoints {
+			summary := getSummary(endpoint.ProfileConfig)
+			summary.Endpoints = append(summary.Endpoints, endpoint)
+		}
+	}
+
+	var profileSummaries = make([]lib.ProcessedProfileSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		sort.Slice(summary.SSHEntries, func(i, j int) bool { return summary.SSHEntries[i].Names[0] < summary.SSHEntries[j].Names[0] })
+		profileSummaries = append(profileSummaries, *summary)
+	}
+	sort.Slice(profileSummaries, func(i, j int) bool { return profileSummaries[i].Name < profileSummaries[j].Name })
+	return profileSummaries, nil
+}
+
+// Save merges the ssh entries of the profile summaries into the cache.
+// The entries of the successfully traversed profiles replace the cached ones, whereas the failed profiles
+// keep their last good entries and get marked as stale. The profiles not in the summaries are kept as they are.
+// The index is rebuilt from scratch, and the instances which are not in the cache anymore are removed.
+func (y *YAMLCache) Save(profileSummaries []lib.ProcessedProfileSummary) (Changes, error) {
+	return y.save(profileSummaries, false)
+}
+
+// SaveAll saves the summaries of all profiles like Save does,
+// but the profiles which aren't in the summaries are removed, as they are gone from the config.
+func (y *YAMLCache) SaveAll(profileSummaries []lib.ProcessedProfileSummary) (Changes, error) {
+	return y.save(profileSummaries, true)
+}
+
+func (y *YAMLCache) save(profileSummaries []lib.ProcessedProfileSummary, prune bool) (Changes, error) {
+	var changes Changes
 	var instancesPath = path.Join(y.basedir, instancesDir)
-	// map of all aliases -> instance id
-	var index = make(map[string]string)
+	var now = time.Now()
 
 	err := os.MkdirAll(instancesPath, 0700)
 	if err != nil {
-		return err
+		return changes, err
+	}
+	// the previous index has the state of the profiles,
+	// it's fine to start from scratch if there isn't any
+	if err := y.loadIndex(); err != nil && err != errNoCache {
+		return changes, err
+	}
+	existingEntries, err := y.loadEntries()
+	if err != nil {
+		return changes, err
+	}
+
+	var index = YAMLCacheIndex{
+		Time: now,
+		// map of all aliases -> instance id
+		InstancesIndex: make(map[string]string),
+		Profiles:       make(map[string]ProfileState),
+	}
+	var refreshed = make(map[string]bool)
+	var described = make(map[string]bool)
+	var sshEntries []lib.SSHEntry // all entries to be in the cache
+	for _, summary := range profileSummaries {
+		described[summary.Name] = true
+		if summary.Status == lib.ProfileStatusOK {
+			refreshed[summary.Name] = true
+			index.Profiles[summary.Name] = ProfileState{Updated: now}
+			sshEntries = append(sshEntries, summary.SSHEntries...)
+		}
+	}
+
+	// keep the entries of the profiles which haven't been refreshed
+	var keptIDs = make(map[string]bool)
+	for instanceID, entry := range existingEntries {
+		if prune && !described[entry.ProfileConfig.Name] {
+			continue
+		}
+		if !refreshed[entry.ProfileConfig.Name] {
+			keptIDs[instanceID] = true
+			sshEntries = append(sshEntries, entry)
+		}
+	}
+	// sort them, so that the index doesn't depend on the order of files on the disk
+	sort.SliceStable(sshEntries, func(i, j int) bool {
+		if sshEntries[i].ProfileConfig.Name != sshEntries[j].ProfileConfig.Name {
+			return sshEntries[i].ProfileConfig.Name < sshEntries[j].ProfileConfig.Name
+		}
+		return sshEntries[i].Names[0] < sshEntries[j].Names[0]
+	})
+	for _, summary := range profileSummaries {
+		if summary.Status == lib.ProfileStatusOK {
+			continue
+		}
+		state, ok := y.index.Profiles[summary.Name]
+		if !ok && !y.hasProfile(existingEntries, summary.Name) {
+			continue // nothing to keep
+		}
+		state.Stale = true
+		if summary.Err != nil {
+			state.Error = summary.Err.Error()
+		}
+		index.Profiles[summary.Name] = state
+		changes.StaleProfiles = append(changes.StaleProfiles, summary.Name)
+	}
+	// and the state of profiles which haven't been in the summaries
+	for name, state := range y.index.Profiles {
+		if _, ok := index.Profiles[name]; !ok && !prune && y.hasProfile(existingEntries, name) {
+			index.Profiles[name] = state
+		}
 	}
+
+	var savedIDs = make(map[string]bool)
 	var errors error
 	// every ssh entry is self-contained
-	for _, summary := range profileSummaries {
-		for _, sshEntry := range summary.SSHEntries {
+	for _, sshEntry := range sshEntries {
+		if !keptIDs[sshEntry.InstanceID] {
 			if err := func() error {
 				var fileName = path.Join(instancesPath, fmt.Sprintf("%s.yaml", sshEntry.InstanceID))
-				file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0644)
-				if err != nil {
-					return fmt.Errorf("can't open %s: %s", fileName, err)
-				}
-
-				defer file.Close()
-				encoder := yaml.NewEncoder(file)
-				err = encoder.Encode(&sshEntry)
+				data, err := yaml.Marshal(&sshEntry)
 				if err != nil {
 					return fmt.Errorf("can't encode %s: %s", fileName, err)
 				}
-				if err := encoder.Close(); err != nil {
-					return fmt.Errorf("can't close %s: %s", fileName, err)
-				}
 
-				// add every instance name to the index and resolve to instance id
-				for n, name := range sshEntry.Names {
-					if name != sshEntry.InstanceID {
-						index[name] = sshEntry.InstanceID
-						// add the first name to canonical names
-						if n == 0 {
-							y.index.CanonicalNames = append(y.index.CanonicalNames, name)
-						}
-					} else {
-						index[name] = ""
+				if _, ok := existingEntries[sshEntry.InstanceID]; ok {
+					existing, err := ioutil.ReadFile(fileName)
+					if err == nil && bytes.Equal(existing, data) {
+						return nil
 					}
+					changes.Changed++
+				} else if !savedIDs[sshEntry.InstanceID] {
+					changes.Added++
 				}
-				return nil
+				return writeFileAtomic(fileName, data, 0644)
 			}(); err != nil {
 				errors = multierror.Append(errors, err)
+				continue
+			}
+		}
+		savedIDs[sshEntry.InstanceID] = true
+
+		// add every instance name to the index and resolve to instance id
+		for n, name := range sshEntry.Names {
+			if name != sshEntry.InstanceID {
+				index.InstancesIndex[name] = sshEntry.InstanceID
+				// add the first name to canonical names
+				if n == 0 {
+					index.CanonicalNames = append(index.CanonicalNames, name)
+				}
+			} else {
+				index.InstancesIndex[name] = ""
+			}
+		}
+	}
+	// the endpoints of the profiles which haven't been refreshed are kept as they are
+	for _, summary := range profileSummaries {
+		if summary.Status == lib.ProfileStatusOK {
+			if err := y.saveEndpoints(summary.Name, summary.Endpoints); err != nil {
+				errors = multierror.Append(errors, err)
 			}
 		}
 	}
+	if prune {
+		if err := y.pruneEndpoints(described); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+	}
 	if errors != nil {
-		return errors
+		return changes, errors
+	}
+	sort.Strings(index.CanonicalNames)
+	sort.Strings(changes.StaleProfiles)
+	y.index = index
+
+	if err := y.saveIndex(); err != nil {
+		return changes, err
+	}
+
+	// the new index doesn't refer to the stale instances anymore, so it's safe to remove them,
+	// as well as the files which couldn't be loaded
+	instanceIDs, err := y.listInstanceIDs()
+	if err != nil {
+		return changes, multierror.Append(errors, err)
+	}
+	for instanceID := range instanceIDs {
+		if savedIDs[instanceID] {
+			continue
+		}
+		var fileName = path.Join(instancesPath, fmt.Sprintf("%s.yaml", instanceID))
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			errors = multierror.Append(errors, fmt.Errorf("can't remove %s: %s", fileName, err))
+			continue
+		}
+		changes.Removed++
 	}
-	sort.Strings(y.index.CanonicalNames)
-	y.index.InstancesIndex = index
+	return changes, errors
+}
 
-	return y.saveIndex()
+func (y *YAMLCache) hasProfile(entries map[string]lib.SSHEntry, profile string) bool {
+	for _, entry := range entries {
+		if entry.ProfileConfig.Name == profile {
+			return true
+		}
+	}
+	return false
 }
+
+// loadEntries loads all instances from the cache dir.
+// The instances which can't be loaded are skipped, so a single broken file doesn't break the whole cache.
+func (y *YAMLCache) loadEntries() (map[string]lib.SSHEntry, error) {
+	var entries = make(map[string]lib.SSHEntry)
+	instanceIDs, err := y.listInstanceIDs()
+	if err != nil {
+		return nil, err
+	}
+	for instanceID := range instanceIDs {
+		entry, err := y.loadEntry(instanceID)
+		if err != nil {
+			log.WithError(err).Warn("skipping the cached instance")
+			continue
+		}
+		entries[instanceID] = entry
+	}
+	return entries, nil
+}
+
+// loadEntry loads the instance from the cache dir
+func (y *YAMLCache) loadEntry(instanceID string) (lib.SSHEntry, error) {
+	var entry lib.SSHEntry
+	var fileName = path.Join(
+		y.basedir,
+		instancesDir,
+		fmt.Sprintf("%s.yaml", instanceID),
+	)
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err != nil {
+		return entry, fmt.Errorf("can't open %s: %s", fileName, err)
+	}
+
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	err = decoder.Decode(&entry)
+	if err != nil {
+		return entry, fmt.Errorf("can't decode %s: %s", fileName, err)
+	}
+
+	return entry, nil
+}
+
+// saveEndpoints replaces the endpoints of the profile
+func (y *YAMLCache) saveEndpoints(profile string, endpoints []lib.ServiceEndpoint) error {
+	var fileName = path.Join(y.basedir, endpointsDir, fmt.Sprintf("%s.yaml", profile))
+	if len(endpoints) == 0 {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't remove %s: %s", fileName, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(endpoints)
+	if err != nil {
+		return fmt.Errorf("can't encode %s: %s", fileName, err)
+	}
+	return writeFileAtomic(fileName, data, 0644)
+}
+
+// pruneEndpoints removes the endpoints of the profiles which aren't in the list
+func (y *YAMLCache) pruneEndpoints(profiles map[string]bool) error {
+	endpoints, err := y.loadEndpoints()
+	if err != nil {
+		return err
+	}
+	var errors error
+	for profile := range endpoints {
+		if !profiles[profile] {
+			if err := y.saveEndpoints(profile, nil); err != nil {
+				errors = multierror.Append(errors, err)
+			}
+		}
+	}
+	return errors
+}
+
+// loadEndpoints loads the endpoints of all profiles from the cache dir
+func (y *YAMLCache) loadEndpoints() (map[string][]lib.ServiceEndpoint, error) {
+	var endpoints = make(map[string][]lib.ServiceEndpoint)
+	files, err := ioutil.ReadDir(path.Join(y.basedir, endpointsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return endpoints, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, ".yaml") {
+			continue
+		}
+		var fileName = path.Join(y.basedir, endpointsDir, name)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %s", fileName, err)
+		}
+		var profileEndpoints []lib.ServiceEndpoint
+		if err := yaml.Unmarshal(data, &profileEndpoints); err != nil {
+			return nil, fmt.Errorf("can't decode %s: %s", fileName, err)
+		}
+		endpoints[strings.TrimSuffix(name, ".yaml")] = profileEndpoints
+	}
+	return endpoints, nil
+}
+
+// listInstanceIDs returns the ids of all instances in the cache dir
+func (y *YAMLCache) listInstanceIDs() (map[string]bool, error) {
+	var instanceIDs = make(map[string]bool)
+	files, err := ioutil.ReadDir(path.Join(y.basedir, instancesDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return instanceIDs, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if name := file.Name(); !file.IsDir() && strings.HasSuffix(name, ".yaml") {
+			instanceIDs[strings.TrimSuffix(name, ".yaml")] = true
+		}
+	}
+	return instanceIDs, nil
+}
+
+// writeFileAtomic writes the file via a temporary file, so readers never see it half-written
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(path.Dir(fileName), "."+path.Base(fileName))
+	if err != nil {
+		return fmt.Errorf("can't create temporary file for %s: %s", fileName, err)
+	}
+	defer os.Remove(tmpFile.Name()) // it's gone after the rename anyway
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("can't write %s: %s", tmpFile.Name(), err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("can't close %s: %s", tmpFile.Name(), err)
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return fmt.Errorf("can't chmod %s: %s", tmpFile.Name(), err)
+	}
+	if err := os.Rename(tmpFile.Name(), fileName); err != nil {
+		return fmt.Errorf("can't move %s to %s: %s", tmpFile.Name(), fileName, err)
+	}
+	return nil
+}
+
 func (y *YAMLCache) Lookup(name string) (lib.SSHEntry, error) {
 	var entry lib.SSHEntry
 	err := y.loadIndex()
@@ -142,9 +484,24 @@ func (y *YAMLCache) Lookup(name string) (lib.SSHEntry, error) {
 		if len(y.index.CanonicalNames) == 0 {
 			return entry, fmt.Errorf("no names in index, try \"aws-ssh update\"")
 		}
+		// load all entries for the preview
+		entries, err := y.loadEntries()
+		if err != nil {
+			return entry, err
+		}
 		idx, err := fuzzyfinder.Find(y.index.CanonicalNames, func(i int) string {
-			return fmt.Sprintf("%s", y.index.CanonicalNames[i])
-		})
+			name := y.index.CanonicalNames[i]
+			// show the state of the instances which aren't running, they get started on connect
+			if entry, ok := entries[y.index.InstancesIndex[name]]; ok && !entry.Running() {
+				return fmt.Sprintf("%s (%s)", name, entry.Metadata.State)
+			}
+			return name
+		}, fuzzyfinder.WithPreviewWindow(func(i, width, height int) string {
+			if i == -1 {
+				return ""
+			}
+			return entries[y.index.InstancesIndex[y.index.CanonicalNames[i]]].Details()
+		}))
 		if err == fuzzyfinder.ErrAbort {
 			return entry, fmt.Errorf("nothing was selected in fuzzy match")
 		}
@@ -158,24 +515,112 @@ func (y *YAMLCache) Lookup(name string) (lib.SSHEntry, error) {
 		}
 	}
 
-	var fileName = path.Join(
-		y.basedir,
-		instancesDir,
-		fmt.Sprintf("%s.yaml", instanceID),
-	)
-	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	return y.loadEntry(instanceID)
+}
+
+func (y *YAMLCache) Chain(sshEntry lib.SSHEntry) (lib.SSHEntries, error) {
+	var sshEntries = lib.SSHEntries{&sshEntry}
+	var visited = map[string]bool{sshEntry.InstanceID: true}
+	for entry := &sshEntry; entry.ProxyJump != "" && entry.Transport == ""; {
+		jumpHost, err := y.Get(entry.ProxyJump)
+		if err != nil {
+			// it can be a host from the ssh config, not an instance
+			break
+		}
+		if visited[jumpHost.InstanceID] {
+			return nil, fmt.Errorf("ProxyJump loop at %s", entry.ProxyJump)
+		}
+		visited[jumpHost.InstanceID] = true
+		sshEntries = append(sshEntries, &jumpHost)
+		entry = &jumpHost
+	}
+	return sshEntries, nil
+}
+
+func (y *YAMLCache) Get(name string) (lib.SSHEntry, error) {
+	if err := y.loadIndex(); err != nil {
+		return lib.SSHEntry{}, err
+	}
+	if instanceID, ok := y.index.InstancesIndex[name]; ok {
+		// if key is instanceid then value will be empty
+		if instanceID == "" {
+			instanceID = name
+		}
+		return y.loadEntry(instanceID)
+	}
+
+	// it can be the address, then it has to be unique
+	entries, err := y.loadEntries()
 	if err != nil {
-		return entry, fmt.Errorf("can't open %s: %s", fileName, err)
+		return lib.SSHEntry{}, err
+	}
+	var found []lib.SSHEntry
+	for _, entry := range entries {
+		if entry.Address == name || entry.Metadata.PrivateIPAddress == name || entry.Metadata.PublicIPAddress == name {
+			found = append(found, entry)
+		}
 	}
+	switch len(found) {
+	case 0:
+		return lib.SSHEntry{}, fmt.Errorf("%s isn't in the cache, try \"aws-ssh update\"", name)
+	case 1:
+		return found[0], nil
+	}
+	return lib.SSHEntry{}, fmt.Errorf("%s matches %d instances in the cache, use the instance name instead", name, len(found))
+}
 
-	defer file.Close()
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&entry)
+func (y *YAMLCache) ProfileState(profile string) (ProfileState, bool) {
+	if err := y.loadIndex(); err != nil {
+		return ProfileState{}, false
+	}
+	state, ok := y.index.Profiles[profile]
+	return state, ok
+}
+
+// ProbeResult returns the last probe result of the private network
+func (y *YAMLCache) ProbeResult(network string) (lib.ProbeResult, bool) {
+	probes, err := y.loadProbes()
 	if err != nil {
-		return entry, fmt.Errorf("can't decode %s: %s", fileName, err)
+		return lib.ProbeResult{}, false
 	}
+	result, ok := probes[network]
+	return result, ok
+}
 
-	return entry, nil
+// SaveProbeResult saves the probe result of the private network, keeping the other ones
+func (y *YAMLCache) SaveProbeResult(network string, result lib.ProbeResult) error {
+	probes, err := y.loadProbes()
+	if err != nil {
+		// the broken file is replaced, the probes are cheap to redo
+		probes = make(map[string]lib.ProbeResult)
+	}
+	probes[network] = result
+
+	if err := os.MkdirAll(y.basedir, 0700); err != nil {
+		return fmt.Errorf("can't create %s: %s", y.basedir, err)
+	}
+	var probesFileName = path.Join(y.basedir, probesFile)
+	data, err := yaml.Marshal(probes)
+	if err != nil {
+		return fmt.Errorf("can't encode %s: %s", probesFileName, err)
+	}
+	return writeFileAtomic(probesFileName, data, 0644)
+}
+
+func (y *YAMLCache) loadProbes() (map[string]lib.ProbeResult, error) {
+	var probes = make(map[string]lib.ProbeResult)
+	var probesFileName = path.Join(y.basedir, probesFile)
+	data, err := ioutil.ReadFile(probesFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return probes, nil
+		}
+		return nil, fmt.Errorf("can't read %s: %s", probesFileName, err)
+	}
+	if err := yaml.Unmarshal(data, &probes); err != nil {
+		return nil, fmt.Errorf("can't decode %s: %s", probesFileName, err)
+	}
+	return probes, nil
 }
 
 func (y *YAMLCache) ListCanonicalNames() ([]string, error) {
@@ -0,0 +1,368 @@
+package cache
+
+import (
+	"aws-ssh/lib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func summaryWithEntries(profile string, names ...string) lib.ProcessedProfileSummary {
+	var summary = lib.ProcessedProfileSummary{
+		ProfileConfig: lib.ProfileConfig{Name: profile},
+		Status:        lib.ProfileStatusOK,
+	}
+	for _, name := range names {
+		summary.SSHEntries = append(summary.SSHEntries, lib.SSHEntry{
+			ProfileConfig: lib.ProfileConfig{Name: profile},
+			InstanceID:    "i-" + name,
+			Address:       "10.0.0.1",
+			Names:         []string{profile + "-" + name, "i-" + name},
+		})
+	}
+	return summary
+}
+
+func checkChanges(t *testing.T, changes Changes, added, removed, changed int) {
+	t.Helper()
+	if changes.Added != added || changes.Removed != removed || changes.Changed != changed {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
+
+// TestSavePrunesInstances makes sure that the instances which disappeared
+// are removed from the cache and the index is rebuilt from scratch
+func TestSavePrunesInstances(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	cache := NewYAMLCache(basedir)
+	changes, err := cache.Save([]lib.ProcessedProfileSummary{summaryWithEntries("test", "web", "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, 2, 0, 0)
+
+	summary := summaryWithEntries("test", "web")
+	summary.SSHEntries[0].Address = "10.0.0.2"
+	changes, err = cache.Save([]lib.ProcessedProfileSummary{summary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, 0, 1, 1)
+
+	if _, err := os.Stat(path.Join(basedir, instancesDir, "i-db.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("stale instance file hasn't been removed: %v", err)
+	}
+
+	// read the index from the disk
+	names, err := NewYAMLCache(basedir).ListCanonicalNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "test-web" {
+		t.Fatalf("unexpected canonical names: %v", names)
+	}
+}
+
+// TestSaveMergesProfiles makes sure that the profiles which haven't been updated
+// or failed to update keep their entries
+func TestSaveMergesProfiles(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	cache := NewYAMLCache(basedir)
+	if _, err := cache.Save([]lib.ProcessedProfileSummary{
+		summaryWithEntries("one", "web"),
+		summaryWithEntries("two", "db"),
+		summaryWithEntries("three", "app"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// "two" fails and "three" isn't updated at all
+	changes, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{
+		summaryWithEntries("one", "web", "worker"),
+		{
+			ProfileConfig: lib.ProfileConfig{Name: "two"},
+			Status:        lib.ProfileStatusTimeout,
+			Err:           fmt.Errorf("timeout"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, 1, 0, 0)
+	if len(changes.StaleProfiles) != 1 || changes.StaleProfiles[0] != "two" {
+		t.Fatalf("unexpected stale profiles: %v", changes.StaleProfiles)
+	}
+
+	cache = NewYAMLCache(basedir)
+	names, err := cache.ListCanonicalNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "one-web one-worker three-app two-db" {
+		t.Fatalf("unexpected canonical names: %v", names)
+	}
+	if state, ok := cache.ProfileState("two"); !ok || !state.Stale || state.Updated.IsZero() {
+		t.Fatalf("profile two isn't stale: %+v", state)
+	}
+	if state, ok := cache.ProfileState("three"); !ok || state.Stale {
+		t.Fatalf("profile three is stale: %+v", state)
+	}
+	if _, err := cache.Lookup("two-db"); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := cache.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 3 || summaries[0].Name != "one" || summaries[0].InstanceCount != 2 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+	if summaries[2].Name != "two" || summaries[2].Status != lib.ProfileStatusError {
+		t.Fatalf("profile two should have the error status: %+v", summaries[2])
+	}
+}
+
+// TestSaveAllPrunesProfiles makes sure the profiles which are gone from the config are removed
+// on the full update, whereas the failed ones are kept
+func TestSaveAllPrunesProfiles(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	removed := summaryWithEntries("removed", "app")
+	removed.Endpoints = []lib.ServiceEndpoint{{ProfileConfig: lib.ProfileConfig{Name: "removed"}, Name: "removed-es"}}
+	if _, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{
+		summaryWithEntries("one", "web"),
+		summaryWithEntries("two", "db"),
+		removed,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := NewYAMLCache(basedir).SaveAll([]lib.ProcessedProfileSummary{
+		summaryWithEntries("one", "web"),
+		{
+			ProfileConfig: lib.ProfileConfig{Name: "two"},
+			Status:        lib.ProfileStatusError,
+			Err:           fmt.Errorf("access denied"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, 0, 1, 0)
+
+	cache := NewYAMLCache(basedir)
+	names, err := cache.ListCanonicalNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "one-web two-db" {
+		t.Fatalf("unexpected canonical names: %v", names)
+	}
+	if _, ok := cache.ProfileState("removed"); ok {
+		t.Fatal("the removed profile is still in the index")
+	}
+	if _, err := os.Stat(path.Join(basedir, endpointsDir, "removed.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("the endpoints of the removed profile haven't been removed: %v", err)
+	}
+}
+
+// TestSaveSkipsBrokenInstances makes sure an instance file which can't be decoded
+// doesn't break the cache and gets removed on the next update
+func TestSaveSkipsBrokenInstances(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	if _, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{summaryWithEntries("test", "web")}); err != nil {
+		t.Fatal(err)
+	}
+	var brokenFile = path.Join(basedir, instancesDir, "i-broken.yaml")
+	if err := ioutil.WriteFile(brokenFile, []byte("names: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewYAMLCache(basedir)
+	summaries, err := cache.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].InstanceCount != 1 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+
+	changes, err := cache.Save([]lib.ProcessedProfileSummary{summaryWithEntries("test", "web", "db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(t, changes, 1, 1, 0)
+	if _, err := os.Stat(brokenFile); !os.IsNotExist(err) {
+		t.Fatalf("the broken instance file hasn't been removed: %v", err)
+	}
+}
+
+// TestLoadKeepsBastionMatcher makes sure the bastions can be found the same way they have been on update
+func TestLoadKeepsBastionMatcher(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	summary := summaryWithEntries("test", "jump")
+	summary.SSHEntries[0].ProfileConfig.BastionName = "^test-jump$"
+	summary.SSHEntries[0].ProfileConfig.BastionTag = "role=bastion"
+	if _, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{summary}); err != nil {
+		t.Fatal(err)
+	}
+	summaries, err := NewYAMLCache(basedir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].BastionName != "^test-jump$" || summaries[0].BastionTag != "role=bastion" {
+		t.Fatalf("the bastion matcher hasn't been kept: %+v", summaries)
+	}
+}
+
+// TestSaveEndpoints makes sure the endpoints are replaced for the updated profiles only
+func TestSaveEndpoints(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	withEndpoint := func(summary lib.ProcessedProfileSummary, name string) lib.ProcessedProfileSummary {
+		summary.Endpoints = append(summary.Endpoints, lib.ServiceEndpoint{
+			ProfileConfig: summary.ProfileConfig,
+			Name:          name,
+			Service:       lib.ServiceRDS,
+			Address:       name + ".rds.amazonaws.com",
+			Port:          "5432",
+		})
+		return summary
+	}
+	if _, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{
+		withEndpoint(summaryWithEntries("one", "bastion1"), "one-db-main"),
+		withEndpoint(summaryWithEntries("two", "bastion2"), "two-db-main"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// "one" has no endpoints anymore, "two" fails
+	if _, err := NewYAMLCache(basedir).Save([]lib.ProcessedProfileSummary{
+		summaryWithEntries("one", "bastion1"),
+		{ProfileConfig: lib.ProfileConfig{Name: "two"}, Status: lib.ProfileStatusError, Err: fmt.Errorf("failed")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := NewYAMLCache(basedir).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || len(summaries[0].Endpoints) != 0 || len(summaries[1].Endpoints) != 1 {
+		t.Fatalf("unexpected summaries: %+v", summaries)
+	}
+	if endpoint := summaries[1].Endpoints[0]; endpoint.Name != "two-db-main" || endpoint.Port != "5432" {
+		t.Errorf("unexpected endpoint: %+v", endpoint)
+	}
+}
+
+// TestChain makes sure the jump hosts are followed recursively across the profiles
+// and the loops are reported
+func TestChain(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	one := summaryWithEntries("one", "db", "bastion", "loop1", "loop2")
+	one.SSHEntries[0].ProxyJump = "i-bastion"
+	one.SSHEntries[1].ProxyJump = "two-jump"
+	one.SSHEntries[2].ProxyJump = "i-loop2"
+	one.SSHEntries[3].ProxyJump = "one-loop1"
+	two := summaryWithEntries("two", "jump")
+	two.SSHEntries[0].ProxyJump = "external.example.com"
+	cache := NewYAMLCache(basedir)
+	if _, err := cache.Save([]lib.ProcessedProfileSummary{one, two}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := cache.Get("one-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshEntries, err := cache.Chain(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, sshEntry := range sshEntries {
+		ids = append(ids, sshEntry.InstanceID)
+	}
+	// the external host isn't in the cache, so the chain ends with the entry which jumps to it
+	if got := strings.Join(ids, ","); got != "i-db,i-bastion,i-jump" {
+		t.Fatalf("unexpected chain: %s", got)
+	}
+	if sshEntries[2].ProfileConfig.Name != "two" {
+		t.Errorf("the last jump host should be from profile two: %+v", sshEntries[2])
+	}
+
+	if entry, err = cache.Get("one-loop1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Chain(entry); err == nil {
+		t.Error("the loop should be an error")
+	}
+}
+
+// TestProbeResults makes sure the probe results are kept by the network
+func TestProbeResults(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	cache := NewYAMLCache(path.Join(basedir, "new"))
+	if _, ok := cache.ProbeResult("10.0.0.0/16"); ok {
+		t.Fatal("there are no probes yet")
+	}
+	var checked = time.Now().Round(time.Second)
+	if err := cache.SaveProbeResult("10.0.0.0/16", lib.ProbeResult{Reachable: true, Checked: checked}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SaveProbeResult("vpc-2", lib.ProbeResult{Checked: checked}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache = NewYAMLCache(path.Join(basedir, "new"))
+	if result, ok := cache.ProbeResult("10.0.0.0/16"); !ok || !result.Reachable || !result.Checked.Equal(checked) {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result, ok := cache.ProbeResult("vpc-2"); !ok || result.Reachable {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
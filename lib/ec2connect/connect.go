@@ -2,65 +2,111 @@ package ec2connect
 
 import (
 	"aws-ssh/lib"
+	"aws-ssh/lib/sshclient"
 	"context"
-
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
-	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultUser = "ec2-user"
+	defaultPort = 22
 )
 
-const defaultUser = "ec2-user"
+// ConnectOptions are additional options for ConnectEC2
+type ConnectOptions struct {
+	// SecurityGroupID is the security group to temporarily allow ssh from your public IP address in.
+	// If it's empty, the aws-ssh-security-group-id tag of the first hop instance is checked.
+	SecurityGroupID string
+	// Key selects the ssh agent key to push by its fingerprint or comment.
+	// If it's empty, the first key supported by ec2 connect is used.
+	Key string
+	// Ephemeral generates a new key for the session instead of using the ssh agent keys
+	Ephemeral bool
+	// Native uses the built-in ssh client instead of running ssh with the generated config,
+	// the args are the command to run on the instance then
+	Native bool
+	// Start starts the instances cached as stopped without asking
+	Start bool
+}
 
 // ConnectEC2 connects to an EC2 instance by pushing your public key onto it first
-// using EC2 connect feature and then runs ssh.
-func ConnectEC2(sshEntries lib.SSHEntries, sshConfigPath string, args []string) {
-	// get the pub key from the ssh agent first
-	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// using EC2 connect feature and then runs ssh. The ctx limits the AWS calls made before ssh starts.
+func ConnectEC2(ctx context.Context, sshEntries lib.SSHEntries, sshConfigPath string, args []string, options ConnectOptions) {
+	key, err := getSessionKey(options)
 	if err != nil {
-		log.WithError(err).Fatal("can't connect to ssh agent, maybe SSH_AUTH_SOCK is unset?")
+		log.WithError(err).Fatal("can't get the key to push")
+	}
+	pubkey := key.publicKey
+
+	var cleanups []func()
+	if key.cleanup != nil {
+		cleanups = append(cleanups, key.cleanup)
+	}
+	// the key isn't in the agent, so ssh should be told where it is
+	if key.identityFile != "" {
+		for _, sshEntry := range sshEntries {
+			sshEntry.IdentityFile = key.identityFile
+		}
+	}
+
+	configs := newAWSConfigs()
+	if err := startStoppedInstances(ctx, configs, sshEntries, options); err != nil {
+		runCleanups(cleanups)
+		log.WithError(err).Fatal("can't start the instance")
 	}
 
-	keys, err := agent.NewClient(sshAgent).List()
-	if err != nil || len(keys) < 1 {
-		log.Fatal("Can't get public keys from ssh agent. Please ensure you have the ssh-agent running and have at least one identity added (with ssh-add)")
+	// push the pub key to all instances at once,
+	// as the key is only valid for 60 seconds
+	instances, err := pushKeys(ctx, configs, sshEntries, pubkey)
+	if err != nil {
+		runCleanups(cleanups)
+		log.WithError(err).Fatal("can't push ssh key to the instances")
 	}
-	pubkey := keys[0].String()
 
-	// push the pub key to those instances one after each other
-	// TODO: maybe make it parallel
-	for _, sshEntry := range sshEntries {
-		var instanceName = sshEntry.InstanceID
-		if len(sshEntry.Names) > 0 {
-			instanceName = sshEntry.Names[0]
+	// then generate ssh config for all instances in sshEntries
+	// save the dynamic ssh config first, unless ssh isn't used at all
+	if !options.Native {
+		if err := sshEntries.SaveConfig(sshConfigPath); err != nil {
+			runCleanups(cleanups)
+			log.WithError(err).Fatal("can't save ssh config for ec2 connect")
 		}
-		log.WithField("instance", instanceName).Info("trying to do ec2 connect...")
-		instanceIPAddress, instanceUser, err := pushEC2Connect(sshEntry.ProfileConfig.Name, sshEntry.InstanceID, sshEntry.User, pubkey)
+	}
+
+	// the first hop is the one we connect to directly, which is the last bastion if there is any
+	firstHop := sshEntries[len(sshEntries)-1]
+	securityGroupID := options.SecurityGroupID
+	if securityGroupID == "" {
+		securityGroupID = lib.GetSecurityGroupFromTags(instances[firstHop.InstanceID].Tags)
+	}
+	// session manager and instance connect endpoints don't need the ssh port to be open to the world,
+	// and the jump hosts which aren't instances can't be allowed
+	if securityGroupID != "" && firstHop.Transport == "" && firstHop.ProxyJump == "" {
+		revoke, err := allowFirstHopIngress(ctx, configs, firstHop, instances[firstHop.InstanceID], securityGroupID)
 		if err != nil {
-			log.WithError(err).Fatal("can't push ssh key to the instance")
+			runCleanups(cleanups)
+			log.WithError(err).Fatal("can't allow ssh access in the security group")
 		}
-		// if the address is empty we set to the value we got from ec2 connect push
-		if sshEntry.Address == "" {
-			sshEntry.Address = instanceIPAddress
-		}
-		if sshEntry.User == "" {
-			sshEntry.User = instanceUser
+		if revoke != nil {
+			cleanups = append(cleanups, revoke)
 		}
 	}
 
-	// then generate ssh config for all instances in sshEntries
-	// save the dynamic ssh config first
-	if err := sshEntries.SaveConfig(sshConfigPath); err != nil {
-		log.WithError(err).Fatal("can't save ssh config for ec2 connect")
+	if options.Native {
+		runNative(configs, sshEntries, key.signer, args, cleanups)
 	}
 
 	var instanceName = sshEntries[0].InstanceID
@@ -79,6 +125,7 @@ func ConnectEC2(sshEntries lib.SSHEntries, sshConfigPath string, args []string)
 
 	command, err := exec.LookPath(args[0])
 	if err != nil {
+		runCleanups(cleanups)
 		log.WithError(err).Fatal("Can't find the binary in the PATH")
 	}
 
@@ -92,31 +139,127 @@ func ConnectEC2(sshEntries lib.SSHEntries, sshConfigPath string, args []string)
 	}
 	log.WithField("instance_id", sshEntries[0].InstanceID).Infof("Connecting to the instance using '%s'", strings.Join(newArgs, " "))
 
-	if err := syscall.Exec(command, newArgs, os.Environ()); err != nil {
-		log.WithFields(log.Fields{"command": command}).WithError(err).Fatal("can't run the command")
+	runCommand(command, newArgs, cleanups)
+}
+
+// runCommand replaces the current process with the command.
+// If there is anything to clean up afterwards, it runs the command as a child process instead
+// and exits with its exit code after the cleanup.
+func runCommand(command string, args []string, cleanups []func()) {
+	ctx := log.WithFields(log.Fields{"command": command})
+	if len(cleanups) == 0 {
+		if err := syscall.Exec(command, args, os.Environ()); err != nil {
+			ctx.WithError(err).Fatal("can't run the command")
+		}
 	}
+
+	// let the child process handle the signals, but don't die before cleaning up
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(command, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	runCleanups(cleanups)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		ctx.WithError(err).Fatal("can't run the command")
+	}
+	os.Exit(0)
 }
 
-// pushEC2Connect pushes the ssh key to a given profile and instance ID
-// and returns the public (or private if public doesn't exist) address of the EC2 instance
-func pushEC2Connect(profile, instanceID, instanceUser, pubKey string) (string, string, error) {
-	ctx := log.WithField("instance_id", instanceID)
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithSharedConfigProfile(profile))
+// runNative connects to the instance through the bastions with the built-in ssh client
+// and runs the command or an interactive shell, then exits with the remote exit code
+func runNative(configs *awsConfigs, sshEntries lib.SSHEntries, signer ssh.Signer, args []string, cleanups []func()) {
+	ctx := log.WithField("instance_id", sshEntries[0].InstanceID)
+	// there is no child process to handle the signals, so clean up and exit on them,
+	// unless the terminal is in the raw mode and ^C goes to the remote shell
+	var once sync.Once
+	cleanup := func() { once.Do(func() { runCleanups(cleanups) }) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		ctx.Warnf("Got %s, cleaning up", sig)
+		cleanup()
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+
+	hops, err := sshclient.HopsFromEntries(sshEntries)
+	if err != nil {
+		cleanup()
+		log.WithError(err).Fatal("can't get the hosts to connect through")
+	}
+	ctx.Infof("Connecting to the instance using the built-in ssh client")
 
+	// the signals are handled above, so nothing has to cancel the dial
+	client, err := sshclient.DialWith(hopDialer(context.Background(), configs, sshEntries), hops, signer)
+	if err != nil {
+		cleanup()
+		ctx.WithError(err).Fatal("can't connect to the instance")
+	}
+	exitCode, err := sshclient.Run(client.Client, strings.Join(args, " "))
+	client.Close()
+	cleanup()
 	if err != nil {
-		return "", "", fmt.Errorf("can't get aws session: %s", err)
+		ctx.WithError(err).Fatal("can't run the command")
+	}
+	os.Exit(exitCode)
+}
+
+func runCleanups(cleanups []func()) {
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+}
+
+// allowFirstHopIngress allows access to the ssh port of the first hop from the public IP address of this machine
+func allowFirstHopIngress(ctx context.Context, configs *awsConfigs, firstHop *lib.SSHEntry, instance types.Instance, securityGroupID string) (func(), error) {
+	var port int32 = defaultPort
+	portTag := firstHop.Port
+	if portTag == "" {
+		portTag = lib.GetPortFromTags(instance.Tags)
 	}
+	if portTag != "" {
+		parsed, err := strconv.ParseInt(portTag, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %s", portTag, err)
+		}
+		port = int32(parsed)
+	}
+	cfg, err := configs.get(firstHop.ProfileConfig)
+	if err != nil {
+		return nil, err
+	}
+	return allowSSHIngress(ctx, cfg, securityGroupID, port)
+}
+
+// instanceAddress returns the public address of the instance, or the private one if there is no public address
+func instanceAddress(instance types.Instance) string {
+	var address = aws.ToString(instance.PrivateIpAddress)
+	if aws.ToString(instance.PublicIpAddress) != "" {
+		address = aws.ToString(instance.PublicIpAddress)
+	}
+	return address
+}
+
+// pushEC2Connect pushes the ssh key to a given instance ID using the aws config
+// and returns the EC2 instance and the user the key has been pushed for
+func pushEC2Connect(ctx context.Context, cfg aws.Config, instanceID, instanceUser, pubKey string) (types.Instance, string, error) {
+	logCtx := log.WithField("instance_id", instanceID)
 	ec2Svc := ec2.NewFromConfig(cfg)
-	ec2Result, err := ec2Svc.DescribeInstances(context.TODO(), &ec2.DescribeInstancesInput{
+	ec2Result, err := ec2Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	})
 	if err != nil {
-		return "", "", fmt.Errorf("can't get ec2 instance: %s", err)
+		return types.Instance{}, "", fmt.Errorf("can't get ec2 instance: %s", err)
 	}
 
 	if len(ec2Result.Reservations) == 0 || len(ec2Result.Reservations[0].Instances) == 0 {
-		return "", "", fmt.Errorf("Couldn't find the instance %s", instanceID)
+		return types.Instance{}, "", fmt.Errorf("Couldn't find the instance %s", instanceID)
 	}
 
 	ec2Instance := ec2Result.Reservations[0].Instances[0]
@@ -124,30 +267,26 @@ func pushEC2Connect(profile, instanceID, instanceUser, pubKey string) (string, s
 
 	// no username has been provided, so we try to get it fom the instance tag first
 	if instanceUser == "" {
-		ctx.Debug("no user has been set provided, trying to get it from the tags")
+		logCtx.Debug("no user has been set provided, trying to get it from the tags")
 		// next try to get username from the instance tags
 		if instanceUser = lib.GetUserFromTags(ec2Instance.Tags); instanceUser == "" {
 			// otherwise fallback to default
-			ctx.WithField("user", defaultUser).Debugf("got no user from the instance tags, setting to default")
+			logCtx.WithField("user", defaultUser).Debugf("got no user from the instance tags, setting to default")
 			instanceUser = defaultUser
 		} else {
-			ctx.WithField("user", instanceUser).Debugf("got username from tags")
+			logCtx.WithField("user", instanceUser).Debugf("got username from tags")
 		}
 	}
 
-	ctx.WithField("user", instanceUser).Info("pushing SSH key...")
+	logCtx.WithField("user", instanceUser).Info("pushing SSH key...")
 
-	if _, err := ec2ICSvc.SendSSHPublicKey(context.TODO(), &ec2instanceconnect.SendSSHPublicKeyInput{
+	if _, err := ec2ICSvc.SendSSHPublicKey(ctx, &ec2instanceconnect.SendSSHPublicKeyInput{
 		InstanceId:       ec2Instance.InstanceId,
 		InstanceOSUser:   aws.String(instanceUser),
 		AvailabilityZone: ec2Instance.Placement.AvailabilityZone,
 		SSHPublicKey:     aws.String(pubKey),
 	}); err != nil {
-		return "", "", fmt.Errorf("can't push ssh key: %s", err)
-	}
-	var address = aws.ToString(ec2Instance.PrivateIpAddress)
-	if aws.ToString(ec2Instance.PublicIpAddress) != "" {
-		address = aws.ToString(ec2Instance.PublicIpAddress)
+		return types.Instance{}, "", fmt.Errorf("can't push ssh key: %s", err)
 	}
-	return address, instanceUser, nil
+	return ec2Instance, instanceUser, nil
 }
@@ -0,0 +1,176 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	linq "gopkg.in/ahmetb/go-linq.v3"
+)
+
+// CopyOptions are additional options for Copy
+type CopyOptions struct {
+	ConnectOptions
+	// Recursive copies the directories
+	Recursive bool
+	// Parallelism limits the number of hosts copied to at the same time, 0 means no limit
+	Parallelism int
+}
+
+// Copy runs scp for every host, where a host is the instance followed by its bastion.
+// The {host} placeholder in args is replaced with the host name, like "{host}:/tmp/".
+// The key is pushed right before running scp for every host, and scp gets the config
+// generated for the host and its bastion only. It returns the results in the same order as the hosts.
+func Copy(ctx context.Context, hosts []lib.SSHEntries, args []string, options CopyOptions) ([]ExecResult, error) {
+	command, err := exec.LookPath("scp")
+	if err != nil {
+		return nil, fmt.Errorf("can't find scp in the PATH: %s", err)
+	}
+	key, err := getSessionKey(options.ConnectOptions)
+	if err != nil {
+		return nil, err
+	}
+	if key.cleanup != nil {
+		defer key.cleanup()
+	}
+
+	var parallelism = options.Parallelism
+	if parallelism <= 0 || parallelism > len(hosts) {
+		parallelism = len(hosts)
+	}
+	var scpFlags []string
+	if options.Recursive {
+		scpFlags = append(scpFlags, "-r")
+	}
+	// the progress of many hosts at once is unreadable
+	if len(hosts) > 1 {
+		scpFlags = append(scpFlags, "-q")
+	}
+
+	var results = make([]ExecResult, len(hosts))
+	var configs = newAWSConfigs()
+	var semaphore = make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for n, sshEntries := range hosts {
+		wg.Add(1)
+		go func(n int, sshEntries lib.SSHEntries) {
+			defer wg.Done()
+			results[n].Name = sshEntries[0].Names[0]
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				results[n].Err = ctx.Err()
+				return
+			}
+
+			results[n].ExitCode, results[n].Err = copyHost(ctx, configs, sshEntries, key, command, hostArgs(scpFlags, args, sshEntries[0].Names[0]))
+		}(n, sshEntries)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// hostArgs returns the scp args for the host, replacing the {host} placeholder with its name
+func hostArgs(scpFlags, args []string, host string) []string {
+	var hostArgs = append([]string{}, scpFlags...)
+	for _, arg := range args {
+		hostArgs = append(hostArgs, strings.ReplaceAll(arg, "{host}", host))
+	}
+	return hostArgs
+}
+
+// SplitRemotePath splits host:path like scp does, so a colon after a slash doesn't count,
+// and neither does the one after a Windows drive letter, like C:\Users
+func SplitRemotePath(arg string) (string, string, bool) {
+	n := strings.Index(arg, ":")
+	if n <= 0 || strings.Contains(arg[:n], "/") {
+		return "", "", false
+	}
+	if n == 1 && isDriveLetter(arg[0]) && len(arg) > 2 && (arg[2] == '\\' || arg[2] == '/') {
+		return "", "", false
+	}
+	return arg[:n], arg[n+1:], true
+}
+
+func isDriveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// FindCopyHosts returns the host by its name or address, or all hosts matching the glob
+// in the given profiles, or in all of them if there are none
+func FindCopyHosts(cache cache.Cache, host string, profiles []string) ([]lib.SSHEntry, error) {
+	if !strings.ContainsAny(host, "*?[") {
+		entry, err := cache.Get(host)
+		if err != nil {
+			return nil, err
+		}
+		return []lib.SSHEntry{entry}, nil
+	}
+
+	summaries, err := cache.Load()
+	if err != nil {
+		return nil, err
+	}
+	var entries []lib.SSHEntry
+	for _, summary := range summaries {
+		if len(profiles) > 0 && !linq.From(profiles).Contains(summary.Name) {
+			continue
+		}
+		for _, entry := range summary.SSHEntries {
+			for _, name := range entry.Names {
+				if matched, _ := path.Match(host, name); matched {
+					entries = append(entries, entry)
+					break
+				}
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no hosts match %s", host)
+	}
+	return entries, nil
+}
+
+// copyHost pushes the key to the host and its bastion, then runs scp with the config for them
+func copyHost(ctx context.Context, configs *awsConfigs, sshEntries lib.SSHEntries, key *sessionKey, command string, args []string) (int, error) {
+	// the key isn't in the agent, so scp should be told where it is
+	if key.identityFile != "" {
+		for _, sshEntry := range sshEntries {
+			sshEntry.IdentityFile = key.identityFile
+		}
+	}
+	if _, err := pushKeys(ctx, configs, sshEntries, key.publicKey); err != nil {
+		return 0, err
+	}
+
+	configFile, err := ioutil.TempFile("", "aws-ssh-config")
+	if err != nil {
+		return 0, fmt.Errorf("can't create ssh config: %s", err)
+	}
+	configFile.Close()
+	defer os.Remove(configFile.Name())
+	if err := sshEntries.SaveConfig(configFile.Name()); err != nil {
+		return 0, err
+	}
+
+	args = append([]string{"-F", configFile.Name()}, args...)
+	log.WithField("instance_id", sshEntries[0].InstanceID).Debugf("running scp %s", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,102 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/cache"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSplitRemotePath(t *testing.T) {
+	var testCases = []struct {
+		arg, host, path string
+		remote          bool
+	}{
+		{"prod-web-1:/tmp/", "prod-web-1", "/tmp/", true},
+		{"prod-web-1:", "prod-web-1", "", true},
+		{"10.0.0.1:app.conf", "10.0.0.1", "app.conf", true},
+		{"prod-web-*:/tmp/a:b", "prod-web-*", "/tmp/a:b", true},
+		{"{host}:/tmp/", "{host}", "/tmp/", true},
+		{"app.conf", "", "", false},
+		{"./a:b", "", "", false},
+		{"/tmp/a:b", "", "", false},
+		{":/tmp/", "", "", false},
+		{`C:\Users\app.conf`, "", "", false},
+		{"c:/Users/app.conf", "", "", false},
+		{"1:/tmp/", "1", "/tmp/", true},
+	}
+	for _, testCase := range testCases {
+		host, path, remote := SplitRemotePath(testCase.arg)
+		if host != testCase.host || path != testCase.path || remote != testCase.remote {
+			t.Errorf("%s: got %q, %q, %t, want %q, %q, %t", testCase.arg,
+				host, path, remote, testCase.host, testCase.path, testCase.remote)
+		}
+	}
+}
+
+func TestHostArgs(t *testing.T) {
+	args := hostArgs([]string{"-r"}, []string{"./logs", "{host}:/var/log/{host}"}, "prod-web-1")
+	if got, want := strings.Join(args, " "), "-r ./logs prod-web-1:/var/log/prod-web-1"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestFindCopyHosts(t *testing.T) {
+	basedir, err := ioutil.TempDir("", "aws-ssh-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basedir)
+
+	summary := func(profile string, names ...string) lib.ProcessedProfileSummary {
+		var summary = lib.ProcessedProfileSummary{ProfileConfig: lib.ProfileConfig{Name: profile}, Status: lib.ProfileStatusOK}
+		for n, name := range names {
+			summary.SSHEntries = append(summary.SSHEntries, lib.SSHEntry{
+				ProfileConfig: lib.ProfileConfig{Name: profile},
+				InstanceID:    "i-" + name,
+				Address:       fmt.Sprintf("10.0.0.%d", n+1),
+				Names:         []string{name, "i-" + name},
+			})
+		}
+		return summary
+	}
+	hosts := cache.NewYAMLCache(basedir)
+	if _, err := hosts.Save([]lib.ProcessedProfileSummary{
+		summary("prod", "prod-web-1", "prod-web-2", "prod-db"),
+		summary("dev", "dev-web-1"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		host     string
+		profiles []string
+		want     string
+		err      bool
+	}{
+		{"prod-db", nil, "prod-db", false},
+		{"i-prod-web-2", nil, "prod-web-2", false},
+		{"*-web-*", nil, "dev-web-1 prod-web-1 prod-web-2", false},
+		{"*-web-*", []string{"dev"}, "dev-web-1", false},
+		{"prod-web-[12]", nil, "prod-web-1 prod-web-2", false},
+		{"staging-*", nil, "", true},
+		{"staging-web-1", nil, "", true},
+	}
+	for _, testCase := range testCases {
+		entries, err := FindCopyHosts(hosts, testCase.host, testCase.profiles)
+		if (err != nil) != testCase.err {
+			t.Errorf("%s: got error %v", testCase.host, err)
+			continue
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Names[0])
+		}
+		if got := strings.Join(names, " "); got != testCase.want {
+			t.Errorf("%s %v: got %s, want %s", testCase.host, testCase.profiles, got, testCase.want)
+		}
+	}
+}
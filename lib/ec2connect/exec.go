@@ -0,0 +1,194 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/sshclient"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// ExecOptions are additional options for Exec
+type ExecOptions struct {
+	ConnectOptions
+	// Parallelism limits the number of hosts the command runs on at the same time, 0 means no limit
+	Parallelism int
+	// Group prints the output of every host at once when the command is done there,
+	// otherwise every line is printed as soon as it's there, prefixed with the host name
+	Group bool
+}
+
+// ExecResult is the result of running the command on a host
+type ExecResult struct {
+	Name     string
+	ExitCode int
+	// Err is set if the command couldn't be run at all
+	Err error
+}
+
+// Exec runs the command on every host, where a host is the instance followed by its bastion,
+// and returns the results in the same order. The key is pushed right before connecting to every host,
+// as ec2 connect keeps it for 60 seconds only. The output goes to stdout and stderr.
+func Exec(ctx context.Context, hosts []lib.SSHEntries, command string, options ExecOptions, stdout, stderr io.Writer) ([]ExecResult, error) {
+	// the built-in client is used, so the key is never needed outside
+	options.Native = true
+	key, err := getSessionKey(options.ConnectOptions)
+	if err != nil {
+		return nil, err
+	}
+	if key.cleanup != nil {
+		defer key.cleanup()
+	}
+
+	var parallelism = options.Parallelism
+	if parallelism <= 0 || parallelism > len(hosts) {
+		parallelism = len(hosts)
+	}
+	var nameWidth int
+	for _, sshEntries := range hosts {
+		if len(sshEntries[0].Names[0]) > nameWidth {
+			nameWidth = len(sshEntries[0].Names[0])
+		}
+	}
+
+	var results = make([]ExecResult, len(hosts))
+	var configs = newAWSConfigs()
+	var semaphore = make(chan struct{}, parallelism)
+	var outputMu sync.Mutex // the output of different hosts shouldn't get mixed up
+	var wg sync.WaitGroup
+	for n, sshEntries := range hosts {
+		wg.Add(1)
+		go func(n int, sshEntries lib.SSHEntries) {
+			defer wg.Done()
+			name := sshEntries[0].Names[0]
+			results[n].Name = name
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				results[n].Err = ctx.Err()
+				return
+			}
+
+			var hostStdout, hostStderr io.Writer
+			var buffer bytes.Buffer
+			if options.Group {
+				// stdout and stderr are written by different goroutines of the session
+				writer := &lockedWriter{writer: &buffer}
+				hostStdout, hostStderr = writer, writer
+			} else {
+				prefix := fmt.Sprintf("%-*s | ", nameWidth, name)
+				stdoutWriter := &prefixWriter{prefix: prefix, writer: stdout, mu: &outputMu}
+				stderrWriter := &prefixWriter{prefix: prefix, writer: stderr, mu: &outputMu}
+				defer stdoutWriter.Flush()
+				defer stderrWriter.Flush()
+				hostStdout, hostStderr = stdoutWriter, stderrWriter
+			}
+
+			results[n].ExitCode, results[n].Err = execHost(ctx, configs, sshEntries, key, command, hostStdout, hostStderr)
+			if options.Group {
+				outputMu.Lock()
+				defer outputMu.Unlock()
+				fmt.Fprintf(stdout, "==> %s <==\n", name)
+				stdout.Write(buffer.Bytes())
+				if buffer.Len() > 0 && !bytes.HasSuffix(buffer.Bytes(), []byte("\n")) {
+					fmt.Fprintln(stdout)
+				}
+			}
+		}(n, sshEntries)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// execHost pushes the key to the host and its bastion, then runs the command on it
+func execHost(ctx context.Context, configs *awsConfigs, sshEntries lib.SSHEntries, key *sessionKey, command string, stdout, stderr io.Writer) (int, error) {
+	logCtx := log.WithField("instance_id", sshEntries[0].InstanceID)
+	if _, err := pushKeys(ctx, configs, sshEntries, key.publicKey); err != nil {
+		return 0, err
+	}
+	hops, err := sshclient.HopsFromEntries(sshEntries)
+	if err != nil {
+		return 0, err
+	}
+	client, err := sshclient.DialWith(hopDialer(ctx, configs, sshEntries), hops, key.signer)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	// the session ends when the client is closed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	logCtx.Debugf("running %s", command)
+	exitCode, err := sshclient.Exec(client.Client, command, stdout, stderr)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return exitCode, err
+}
+
+// lockedWriter serializes the writes to the writer
+type lockedWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Write(data)
+}
+
+// prefixWriter writes every line with the prefix. The incomplete lines are kept until
+// they are complete or Flush is called, so the lines of different writers don't get mixed up.
+type prefixWriter struct {
+	prefix string
+	writer io.Writer
+	mu     *sync.Mutex // shared by all writers to the same writer
+	line   []byte
+}
+
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.line = append(w.line, data...)
+	for {
+		n := bytes.IndexByte(w.line, '\n')
+		if n < 0 {
+			return len(data), nil
+		}
+		if err := w.writeLine(w.line[:n+1]); err != nil {
+			return 0, err
+		}
+		w.line = w.line[n+1:]
+	}
+}
+
+// Flush writes the incomplete line if there is any
+func (w *prefixWriter) Flush() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	line := append(w.line, '\n')
+	w.line = nil
+	return w.writeLine(line)
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := io.WriteString(w.writer, w.prefix+strings.TrimRight(string(line), "\r\n")+"\n")
+	return err
+}
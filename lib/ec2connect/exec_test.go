@@ -0,0 +1,46 @@
+package ec2connect
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var output bytes.Buffer
+	var mu sync.Mutex
+	one := &prefixWriter{prefix: "one | ", writer: &output, mu: &mu}
+	two := &prefixWriter{prefix: "two | ", writer: &output, mu: &mu}
+
+	fmt.Fprint(one, "first ")
+	fmt.Fprint(two, "hello\r\nworld\n")
+	fmt.Fprint(one, "line\nsecond")
+	one.Flush()
+	two.Flush()
+
+	want := "two | hello\ntwo | world\none | first line\none | second\n"
+	if output.String() != want {
+		t.Errorf("got %q, want %q", output.String(), want)
+	}
+}
+
+func TestLockedWriter(t *testing.T) {
+	var output bytes.Buffer
+	writer := &lockedWriter{writer: &output}
+	var wg sync.WaitGroup
+	for _, line := range []string{"stdout\n", "stderr\n"} {
+		wg.Add(1)
+		go func(line string) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				fmt.Fprint(writer, line)
+			}
+		}(line)
+	}
+	wg.Wait()
+
+	if got := bytes.Count(output.Bytes(), []byte("\n")); got != 200 || output.Len() != 1400 {
+		t.Errorf("got %d lines of %d bytes, want 200 lines of 1400 bytes", got, output.Len())
+	}
+}
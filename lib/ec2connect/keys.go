@@ -0,0 +1,240 @@
+package ec2connect
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ephemeralKeyLifetime is how long the ephemeral key stays in the ssh agent.
+// EC2 connect keeps the pushed key for 60 seconds, so ssh should have logged in by then.
+const ephemeralKeyLifetime = 2 * time.Minute
+
+// supportedKeyTypes are the key types EC2 connect accepts
+var supportedKeyTypes = []string{ssh.KeyAlgoRSA, ssh.KeyAlgoED25519}
+
+// sessionKey is the key pushed to the instances
+type sessionKey struct {
+	// publicKey is in the authorized_keys format
+	publicKey string
+	// identityFile is the private key file if the key isn't in the agent
+	identityFile string
+	// cleanup removes the key after the session, can be nil
+	cleanup func()
+	// signer signs with the key, it's used by the native ssh client
+	signer ssh.Signer
+}
+
+// getSessionKey returns the key to push to the instances, either
+// from the ssh agent or a new ephemeral one depending on the options
+func getSessionKey(options ConnectOptions) (*sessionKey, error) {
+	if options.Ephemeral {
+		// the native client doesn't need the key to be anywhere but in memory
+		return ephemeralKey(options.Native)
+	}
+
+	// the connection is kept open for the signer
+	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to ssh agent, maybe SSH_AUTH_SOCK is unset? %s", err)
+	}
+	agentClient := agent.NewClient(sshAgent)
+
+	keys, err := agentClient.List()
+	if err != nil || len(keys) < 1 {
+		return nil, fmt.Errorf("Can't get public keys from ssh agent. Please ensure you have the ssh-agent running and have at least one identity added (with ssh-add)")
+	}
+	key, err := selectAgentKey(keys, options.Key)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"fingerprint": ssh.FingerprintSHA256(key), "comment": key.Comment}).Debug("using the key from ssh agent")
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("can't get signers from ssh agent: %s", err)
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			return &sessionKey{publicKey: key.String(), signer: signer}, nil
+		}
+	}
+	return nil, fmt.Errorf("can't find the signer for the key in ssh agent")
+}
+
+// selectAgentKey returns the first supported key matching the selector,
+// which is either the key fingerprint or its comment. If the selector is empty, any key matches.
+func selectAgentKey(keys []*agent.Key, selector string) (*agent.Key, error) {
+	for _, key := range keys {
+		if selector != "" && !keyMatches(key, selector) {
+			continue
+		}
+		if !isSupportedKey(key) {
+			log.WithFields(log.Fields{"type": key.Type(), "comment": key.Comment}).Debug("skipping the key not supported by ec2 connect")
+			continue
+		}
+		return key, nil
+	}
+	if selector != "" {
+		return nil, fmt.Errorf("can't find a supported key matching %q in ssh agent", selector)
+	}
+	return nil, fmt.Errorf("can't find a key supported by ec2 connect (%s) in ssh agent", strings.Join(supportedKeyTypes, ", "))
+}
+
+func keyMatches(key *agent.Key, selector string) bool {
+	if key.Comment == selector {
+		return true
+	}
+	sha256 := ssh.FingerprintSHA256(key)
+	return sha256 == selector || strings.TrimPrefix(sha256, "SHA256:") == selector ||
+		ssh.FingerprintLegacyMD5(key) == strings.TrimPrefix(selector, "MD5:")
+}
+
+func isSupportedKey(key ssh.PublicKey) bool {
+	for _, keyType := range supportedKeyTypes {
+		if key.Type() == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// ephemeralKey generates a new ed25519 key for the session.
+// Unless it's only needed in memory, it's added to the ssh agent with a short lifetime
+// if the agent is running, otherwise it's written to a temporary file.
+func ephemeralKey(inMemory bool) (*sessionKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate ephemeral key: %s", err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert ephemeral key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't create signer for ephemeral key: %s", err)
+	}
+	var key = &sessionKey{
+		publicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))),
+		signer:    signer,
+	}
+	if inMemory {
+		return key, nil
+	}
+
+	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+		defer sshAgent.Close()
+		if err := agent.NewClient(sshAgent).Add(agent.AddedKey{
+			PrivateKey:   privateKey,
+			Comment:      "aws-ssh ephemeral key",
+			LifetimeSecs: uint32(ephemeralKeyLifetime.Seconds()),
+		}); err == nil {
+			log.WithField("fingerprint", ssh.FingerprintSHA256(sshPublicKey)).Debug("added ephemeral key to ssh agent")
+			return key, nil
+		}
+		log.WithError(err).Debug("can't add ephemeral key to ssh agent, using a temporary file")
+	}
+
+	identityFile, err := writePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("identity_file", identityFile).Debug("saved ephemeral key")
+	key.identityFile = identityFile
+	key.cleanup = func() {
+		if err := os.Remove(identityFile); err != nil {
+			log.WithError(err).WithField("identity_file", identityFile).Error("can't remove ephemeral key")
+		}
+	}
+	return key, nil
+}
+
+// writePrivateKey writes the key to a temporary file only readable by the user
+func writePrivateKey(privateKey ed25519.PrivateKey) (string, error) {
+	block, err := marshalED25519PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	// TempFile creates files with 0600 permissions
+	file, err := ioutil.TempFile("", "aws-ssh-key")
+	if err != nil {
+		return "", fmt.Errorf("can't create file for ephemeral key: %s", err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, block); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("can't write ephemeral key: %s", err)
+	}
+	return file.Name(), nil
+}
+
+// marshalED25519PrivateKey encodes the key in the OpenSSH format,
+// which is the only format ssh reads ed25519 keys in.
+// See PROTOCOL.key in the OpenSSH sources for details.
+func marshalED25519PrivateKey(privateKey ed25519.PrivateKey) (*pem.Block, error) {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	checkInt := uint32(check[0])<<24 | uint32(check[1])<<16 | uint32(check[2])<<8 | uint32(check[3])
+
+	privateKeySection := struct {
+		Check1, Check2 uint32
+		KeyType        string
+		PublicKey      []byte
+		PrivateKey     []byte
+		Comment        string
+		Pad            []byte `ssh:"rest"`
+	}{
+		Check1:     checkInt,
+		Check2:     checkInt,
+		KeyType:    ssh.KeyAlgoED25519,
+		PublicKey:  []byte(publicKey),
+		PrivateKey: []byte(privateKey),
+		Comment:    "aws-ssh ephemeral key",
+	}
+	// the section is padded to the cipher block size, which is 8 for "none"
+	if padLen := len(ssh.Marshal(privateKeySection)) % 8; padLen != 0 {
+		for n := 1; n <= 8-padLen; n++ {
+			privateKeySection.Pad = append(privateKeySection.Pad, byte(n))
+		}
+	}
+
+	key := struct {
+		CipherName  string
+		KdfName     string
+		KdfOpts     string
+		NumKeys     uint32
+		PublicKey   []byte
+		PrivateKeys []byte
+	}{
+		CipherName:  "none",
+		KdfName:     "none",
+		NumKeys:     1,
+		PublicKey:   sshPublicKey.Marshal(),
+		PrivateKeys: ssh.Marshal(privateKeySection),
+	}
+
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(key)...),
+	}, nil
+}
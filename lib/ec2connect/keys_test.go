@@ -0,0 +1,64 @@
+package ec2connect
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// TestMarshalED25519PrivateKey makes sure the ephemeral key file can be read back
+func TestMarshalED25519PrivateKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := marshalED25519PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedKey, ok := parsed.(*ed25519.PrivateKey); !ok || !reflect.DeepEqual(*parsedKey, privateKey) {
+		t.Fatalf("parsed key doesn't match: %#v", parsed)
+	}
+}
+
+// TestSelectAgentKey makes sure unsupported keys are skipped
+func TestSelectAgentKey(t *testing.T) {
+	newKey := func(keyType, comment string) *agent.Key {
+		publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPublicKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &agent.Key{Format: keyType, Blob: sshPublicKey.Marshal(), Comment: comment}
+	}
+	keys := []*agent.Key{
+		newKey("sk-ssh-ed25519@openssh.com", "yubikey"),
+		newKey(ssh.KeyAlgoED25519, "laptop"),
+		newKey(ssh.KeyAlgoED25519, "work"),
+	}
+
+	if key, err := selectAgentKey(keys, ""); err != nil || key.Comment != "laptop" {
+		t.Fatalf("expected the first supported key, got %v, %v", key, err)
+	}
+	if key, err := selectAgentKey(keys, "work"); err != nil || key.Comment != "work" {
+		t.Fatalf("expected the key selected by comment, got %v, %v", key, err)
+	}
+	if key, err := selectAgentKey(keys, ssh.FingerprintSHA256(keys[2])); err != nil || key.Comment != "work" {
+		t.Fatalf("expected the key selected by fingerprint, got %v, %v", key, err)
+	}
+	if _, err := selectAgentKey(keys, "yubikey"); err == nil {
+		t.Fatal("unsupported key has been selected")
+	}
+}
@@ -0,0 +1,92 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/apex/log"
+)
+
+// ProxyCommand is meant to be used as ssh ProxyCommand. It pushes the key to the instance
+// and then connects stdin and stdout to the ssh port of the instance, either directly or,
+// if the instance has a bastion, through it with "ssh -W" so that the bastion gets its key pushed too.
+// The instances with the ssm transport are reached through Session Manager,
+// and the ones with the eice transport through the instance connect endpoint.
+func ProxyCommand(ctx context.Context, sshEntry lib.SSHEntry, port string, options ConnectOptions) error {
+	key, err := getSessionKey(options)
+	if err != nil {
+		return err
+	}
+	if key.identityFile != "" {
+		if key.cleanup != nil {
+			key.cleanup()
+		}
+		return fmt.Errorf("ssh agent is required to use ephemeral keys with proxy command")
+	}
+
+	configs := newAWSConfigs()
+	if _, err := pushKeys(ctx, configs, lib.SSHEntries{&sshEntry}, key.publicKey); err != nil {
+		return err
+	}
+
+	if sshEntry.Transport == lib.TransportSSM {
+		log.WithField("instance_id", sshEntry.InstanceID).Debugf("starting ssm session to port %s", port)
+		session, err := startSSMSession(ctx, configs, &sshEntry, port)
+		if err != nil {
+			return err
+		}
+		return pipe(session)
+	}
+	if sshEntry.Transport == lib.TransportEICE {
+		log.WithField("instance_id", sshEntry.InstanceID).Debugf("opening the tunnel to port %s", port)
+		conn, err := openEICETunnel(ctx, configs, &sshEntry, port)
+		if err != nil {
+			return err
+		}
+		return pipe(conn)
+	}
+	address := net.JoinHostPort(sshEntry.Address, port)
+	if sshEntry.ProxyJump != "" {
+		// the bastion is in the ssh config too, so let ssh handle it
+		return proxyJump(address, sshEntry.ProxyJump)
+	}
+	log.Debugf("connecting to %s", address)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return fmt.Errorf("can't connect to %s: %s", address, err)
+	}
+	return pipe(conn)
+}
+
+// proxyJump replaces the current process with ssh forwarding stdin and stdout to the address via the jump host
+func proxyJump(address, jumpHost string) error {
+	command, err := exec.LookPath("ssh")
+	if err != nil {
+		return fmt.Errorf("can't find ssh in the PATH: %s", err)
+	}
+	args := []string{"ssh", "-W", address, jumpHost}
+	log.WithField("jump_host", jumpHost).Debugf("connecting to %s", address)
+	return syscall.Exec(command, args, os.Environ())
+}
+
+// pipe connects stdin and stdout to the connection
+func pipe(conn net.Conn) error {
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		// let the other side know there is nothing more to send
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+	// ssh is done when the connection is closed by the server
+	_, err := io.Copy(os.Stdout, conn)
+	return err
+}
@@ -0,0 +1,104 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// awsConfigs loads aws config once per profile, so all hops in the same profile share it
+type awsConfigs struct {
+	mu      sync.Mutex
+	configs map[string]*profileAWSConfig
+}
+
+type profileAWSConfig struct {
+	once sync.Once
+	cfg  aws.Config
+	err  error
+}
+
+func newAWSConfigs() *awsConfigs {
+	return &awsConfigs{configs: make(map[string]*profileAWSConfig)}
+}
+
+// get returns aws config for the profile.
+// If the profile has a region set, it is used instead of the profile default one.
+func (c *awsConfigs) get(profile lib.ProfileConfig) (aws.Config, error) {
+	c.mu.Lock()
+	profileConfig, ok := c.configs[profile.Name]
+	if !ok {
+		profileConfig = &profileAWSConfig{}
+		c.configs[profile.Name] = profileConfig
+	}
+	c.mu.Unlock()
+
+	profileConfig.once.Do(func() {
+		profileConfig.cfg, profileConfig.err = config.LoadDefaultConfig(context.TODO(),
+			config.WithSharedConfigProfile(profile.Name))
+	})
+	if profileConfig.err != nil {
+		return aws.Config{}, fmt.Errorf("can't get aws session: %s", profileConfig.err)
+	}
+
+	cfg := profileConfig.cfg.Copy()
+	if profile.Region != "" {
+		cfg.Region = profile.Region
+	}
+	return cfg, nil
+}
+
+// pushKeys pushes the key to all hops at the same time and fills in
+// their addresses and users if they are not set yet.
+// It returns the instances by their ids, or the errors of all failed hops.
+func pushKeys(ctx context.Context, configs *awsConfigs, sshEntries lib.SSHEntries, pubkey string) (map[string]types.Instance, error) {
+	var instances = make(map[string]types.Instance)
+	var errors error
+	var mu sync.Mutex // protects instances and errors
+	var wg sync.WaitGroup
+
+	for _, sshEntry := range sshEntries {
+		wg.Add(1)
+		go func(sshEntry *lib.SSHEntry) {
+			defer wg.Done()
+			var instanceName = sshEntry.InstanceID
+			if len(sshEntry.Names) > 0 {
+				instanceName = sshEntry.Names[0]
+			}
+			log.WithField("instance", instanceName).Info("trying to do ec2 connect...")
+
+			instance, instanceUser, err := func() (types.Instance, string, error) {
+				cfg, err := configs.get(sshEntry.ProfileConfig)
+				if err != nil {
+					return types.Instance{}, "", err
+				}
+				return pushEC2Connect(ctx, cfg, sshEntry.InstanceID, sshEntry.User, pubkey)
+			}()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errors = multierror.Append(errors, fmt.Errorf("%s: %s", instanceName, err))
+				return
+			}
+			instances[sshEntry.InstanceID] = instance
+			// if the address is empty we set to the value we got from ec2 connect push
+			if sshEntry.Address == "" {
+				sshEntry.Address = instanceAddress(instance)
+			}
+			if sshEntry.User == "" {
+				sshEntry.User = instanceUser
+			}
+		}(sshEntry)
+	}
+	wg.Wait()
+
+	return instances, errors
+}
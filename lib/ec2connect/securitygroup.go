@@ -0,0 +1,212 @@
+package ec2connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	publicIPURL = "https://checkip.amazonaws.com"
+	// securityGroupRuleExpiryTag is set on the rules added by aws-ssh,
+	// so the rules left by crashed sessions can be cleaned up later
+	securityGroupRuleExpiryTag = "aws-ssh-expires"
+	securityGroupRuleTTL       = time.Hour
+)
+
+// getPublicIP returns the public IP address of this machine as AWS sees it
+func getPublicIP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicIPURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't get public ip address: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read public ip address: %s", err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("got invalid public ip address from %s: %q", publicIPURL, body)
+	}
+	return ip, nil
+}
+
+// allowSSHIngress adds a temporary rule to the security group allowing the port from the public IP address
+// of this machine. It returns a function revoking the rule, which is nil if the rule hasn't been added by aws-ssh.
+// A rule left by an earlier session is adopted, so it's revoked when this one ends.
+func allowSSHIngress(ctx context.Context, cfg aws.Config, groupID string, port int32) (func(), error) {
+	logCtx := log.WithFields(log.Fields{"security_group_id": groupID, "port": port})
+	svc := ec2.NewFromConfig(cfg)
+
+	// clean up after the sessions which couldn't do it themselves
+	if err := revokeExpiredRules(ctx, svc, groupID); err != nil {
+		logCtx.WithError(err).Warn("can't revoke expired security group rules")
+	}
+
+	ip, err := getPublicIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var permission = types.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int32(port),
+		ToPort:     aws.Int32(port),
+	}
+	var description = aws.String("aws-ssh temporary access")
+	var cidr string
+	if ip.To4() != nil {
+		cidr = ip.String() + "/32"
+		permission.IpRanges = []types.IpRange{{CidrIp: aws.String(cidr), Description: description}}
+	} else {
+		cidr = ip.String() + "/128"
+		permission.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(cidr), Description: description}}
+	}
+	logCtx = logCtx.WithField("ip", ip.String())
+	var expiryTag = types.Tag{
+		Key:   aws.String(securityGroupRuleExpiryTag),
+		Value: aws.String(time.Now().Add(securityGroupRuleTTL).UTC().Format(time.RFC3339)),
+	}
+
+	logCtx.Info("adding temporary security group rule...")
+	var ruleIDs []string
+	result, err := svc.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: []types.IpPermission{permission},
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypeSecurityGroupRule, Tags: []types.Tag{expiryTag}},
+		},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
+		// the rule can be left by a session which crashed, or be added by another one,
+		// so it's ours if it has the expiry tag, otherwise it's not for us to revoke
+		ruleID, err := findTemporaryRule(ctx, svc, groupID, cidr, port)
+		if err != nil {
+			return nil, fmt.Errorf("can't find the existing security group rule: %s", err)
+		}
+		if ruleID == "" {
+			logCtx.Info("the security group rule exists already")
+			return nil, nil
+		}
+		logCtx = logCtx.WithField("security_group_rule_id", ruleID)
+		logCtx.Info("extending the existing temporary security group rule")
+		if _, err := svc.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{ruleID}, Tags: []types.Tag{expiryTag}}); err != nil {
+			return nil, fmt.Errorf("can't extend security group rule: %s", err)
+		}
+		ruleIDs = []string{ruleID}
+	} else if err != nil {
+		return nil, fmt.Errorf("can't add security group rule: %s", err)
+	} else {
+		for _, rule := range result.SecurityGroupRules {
+			ruleIDs = append(ruleIDs, aws.ToString(rule.SecurityGroupRuleId))
+		}
+	}
+
+	return func() {
+		logCtx.Info("revoking temporary security group rule...")
+		// use a fresh context, as the original one can be cancelled by now
+		if err := revokeRules(context.Background(), svc, groupID, ruleIDs); err != nil {
+			logCtx.WithError(err).Error("can't revoke security group rule")
+		}
+	}, nil
+}
+
+// findTemporaryRule returns the ID of the ingress rule added by aws-ssh to the group allowing the port from the CIDR,
+// or an empty string if there is no such rule
+func findTemporaryRule(ctx context.Context, svc *ec2.Client, groupID, cidr string, port int32) (string, error) {
+	paginator := ec2.NewDescribeSecurityGroupRulesPaginator(svc, &ec2.DescribeSecurityGroupRulesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("group-id"), Values: []string{groupID}},
+			{Name: aws.String("tag-key"), Values: []string{securityGroupRuleExpiryTag}},
+		},
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		if rule, ok := matchIngressRule(result.SecurityGroupRules, cidr, port); ok {
+			return aws.ToString(rule.SecurityGroupRuleId), nil
+		}
+	}
+	return "", nil
+}
+
+// matchIngressRule returns the TCP ingress rule allowing exactly the port from the CIDR
+func matchIngressRule(rules []types.SecurityGroupRule, cidr string, port int32) (types.SecurityGroupRule, bool) {
+	for _, rule := range rules {
+		if aws.ToBool(rule.IsEgress) || aws.ToString(rule.IpProtocol) != "tcp" ||
+			aws.ToInt32(rule.FromPort) != port || aws.ToInt32(rule.ToPort) != port {
+			continue
+		}
+		if aws.ToString(rule.CidrIpv4) == cidr || aws.ToString(rule.CidrIpv6) == cidr {
+			return rule, true
+		}
+	}
+	return types.SecurityGroupRule{}, false
+}
+
+// revokeExpiredRules revokes the rules added by aws-ssh which have expired
+func revokeExpiredRules(ctx context.Context, svc *ec2.Client, groupID string) error {
+	var expiredIDs []string
+	paginator := ec2.NewDescribeSecurityGroupRulesPaginator(svc, &ec2.DescribeSecurityGroupRulesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("group-id"), Values: []string{groupID}},
+			{Name: aws.String("tag-key"), Values: []string{securityGroupRuleExpiryTag}},
+		},
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, rule := range result.SecurityGroupRules {
+			for _, tag := range rule.Tags {
+				if aws.ToString(tag.Key) != securityGroupRuleExpiryTag {
+					continue
+				}
+				expires, err := time.Parse(time.RFC3339, aws.ToString(tag.Value))
+				if err != nil || expires.Before(time.Now()) {
+					expiredIDs = append(expiredIDs, aws.ToString(rule.SecurityGroupRuleId))
+				}
+			}
+		}
+	}
+	if len(expiredIDs) == 0 {
+		return nil
+	}
+	log.WithField("security_group_id", groupID).Infof("revoking %d expired security group rules", len(expiredIDs))
+	return revokeRules(ctx, svc, groupID, expiredIDs)
+}
+
+func revokeRules(ctx context.Context, svc *ec2.Client, groupID string, ruleIDs []string) error {
+	if len(ruleIDs) == 0 {
+		return nil
+	}
+	_, err := svc.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+		GroupId:              aws.String(groupID),
+		SecurityGroupRuleIds: ruleIDs,
+	})
+	return err
+}
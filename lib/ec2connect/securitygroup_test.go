@@ -0,0 +1,50 @@
+package ec2connect
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestMatchIngressRule(t *testing.T) {
+	rule := func(id, cidr string, from, to int32, egress bool) types.SecurityGroupRule {
+		var rule = types.SecurityGroupRule{
+			SecurityGroupRuleId: aws.String(id),
+			IpProtocol:          aws.String("tcp"),
+			FromPort:            aws.Int32(from),
+			ToPort:              aws.Int32(to),
+			IsEgress:            aws.Bool(egress),
+		}
+		if strings.HasSuffix(cidr, "/128") {
+			rule.CidrIpv6 = aws.String(cidr)
+		} else {
+			rule.CidrIpv4 = aws.String(cidr)
+		}
+		return rule
+	}
+	rules := []types.SecurityGroupRule{
+		rule("sgr-egress", "203.0.113.1/32", 22, 22, true),
+		rule("sgr-range", "203.0.113.1/32", 0, 65535, false),
+		rule("sgr-other", "203.0.113.2/32", 22, 22, false),
+		rule("sgr-v4", "203.0.113.1/32", 22, 22, false),
+		rule("sgr-v6", "2001:db8::1/128", 22, 22, false),
+	}
+	var testCases = []struct {
+		cidr string
+		port int32
+		want string
+	}{
+		{"203.0.113.1/32", 22, "sgr-v4"},
+		{"2001:db8::1/128", 22, "sgr-v6"},
+		{"203.0.113.1/32", 2222, ""},
+		{"203.0.113.3/32", 22, ""},
+	}
+	for _, testCase := range testCases {
+		got, ok := matchIngressRule(rules, testCase.cidr, testCase.port)
+		if ok != (testCase.want != "") || aws.ToString(got.SecurityGroupRuleId) != testCase.want {
+			t.Errorf("%s:%d: got %s, want %s", testCase.cidr, testCase.port, aws.ToString(got.SecurityGroupRuleId), testCase.want)
+		}
+	}
+}
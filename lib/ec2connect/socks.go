@@ -0,0 +1,48 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/sshclient"
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// SOCKS serves SOCKS5 proxy on the local address through the first of sshEntries until ctx is done,
+// reconnecting the same way as Tunnel
+func SOCKS(ctx context.Context, sshEntries lib.SSHEntries, address string, options ConnectOptions) error {
+	connect, err := nativeConnector(ctx, sshEntries, options)
+	if err != nil {
+		return err
+	}
+	return sshclient.ServeSOCKS(ctx, address, connect)
+}
+
+// VPCCIDRs returns the IPv4 CIDR blocks associated with the vpc
+func VPCCIDRs(ctx context.Context, profile lib.ProfileConfig, vpcID string) ([]string, error) {
+	cfg, err := newAWSConfigs().get(profile)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ec2.NewFromConfig(cfg).DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
+		VpcIds: []string{vpcID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't describe vpc %s: %s", vpcID, err)
+	}
+	if len(result.Vpcs) == 0 {
+		return nil, fmt.Errorf("couldn't find vpc %s", vpcID)
+	}
+
+	var cidrs []string
+	for _, association := range result.Vpcs[0].CidrBlockAssociationSet {
+		if association.CidrBlockState != nil && association.CidrBlockState.State != types.VpcCidrBlockStateCodeAssociated {
+			continue
+		}
+		cidrs = append(cidrs, aws.ToString(association.CidrBlock))
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,184 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/term"
+)
+
+const (
+	// startTimeout limits the time to wait for the started instance to get running and open its ssh port
+	startTimeout = 5 * time.Minute
+	// probeInterval is the delay between the attempts to connect to the ssh port of the started instance
+	probeInterval = 2 * time.Second
+)
+
+// startStoppedInstances starts the entries cached as stopped, asking first unless options.Start is set,
+// and waits for them to get running. The entries get the new addresses of the instances,
+// as the public ones change on every start.
+func startStoppedInstances(ctx context.Context, configs *awsConfigs, sshEntries lib.SSHEntries, options ConnectOptions) error {
+	for _, sshEntry := range sshEntries {
+		if sshEntry.Running() {
+			continue
+		}
+		var instanceName = sshEntry.InstanceID
+		if len(sshEntry.Names) > 0 {
+			instanceName = sshEntry.Names[0]
+		}
+		cfg, err := configs.get(sshEntry.ProfileConfig)
+		if err != nil {
+			return err
+		}
+		startCtx, cancel := context.WithTimeout(ctx, startTimeout)
+		err = startInstance(startCtx, cfg, sshEntry, instanceName, options.Start)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %s", instanceName, err)
+		}
+	}
+	return nil
+}
+
+// startInstance starts the instance of the entry if it's stopped and waits until it's running
+// and, if it's connected to directly, its ssh port accepts connections
+func startInstance(ctx context.Context, cfg aws.Config, sshEntry *lib.SSHEntry, instanceName string, start bool) error {
+	logCtx := log.WithField("instance_id", sshEntry.InstanceID)
+	svc := ec2.NewFromConfig(cfg)
+
+	instance, err := describeInstance(ctx, svc, sshEntry.InstanceID)
+	if err != nil {
+		return err
+	}
+	state := instanceState(instance)
+	if state == types.InstanceStateNameStopping {
+		logCtx.Info("waiting for the instance to stop before starting it")
+		if err := ec2.NewInstanceStoppedWaiter(svc).Wait(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []string{sshEntry.InstanceID},
+		}, startTimeout); err != nil {
+			return fmt.Errorf("can't wait for the instance to stop: %s", err)
+		}
+		state = types.InstanceStateNameStopped
+	}
+
+	switch state {
+	case types.InstanceStateNameRunning, types.InstanceStateNamePending:
+		// someone has started it since the cache update
+	case types.InstanceStateNameStopped:
+		if !start {
+			// the signals cancel ctx instead of killing the process, so don't wait for the answer after that
+			answer := make(chan bool, 1)
+			go func() { answer <- confirm(os.Stdin, os.Stderr, fmt.Sprintf("%s is stopped, start it?", instanceName)) }()
+			select {
+			case yes := <-answer:
+				if !yes {
+					return fmt.Errorf("the instance is stopped, use --start to start it")
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		logCtx.Info("starting the instance")
+		if _, err := svc.StartInstances(ctx, &ec2.StartInstancesInput{
+			InstanceIds: []string{sshEntry.InstanceID},
+		}); err != nil {
+			return fmt.Errorf("can't start the instance: %s", err)
+		}
+	default:
+		return fmt.Errorf("the instance is %s", state)
+	}
+
+	logCtx.Info("waiting for the instance to get running")
+	if err := ec2.NewInstanceRunningWaiter(svc).Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{sshEntry.InstanceID},
+	}, startTimeout); err != nil {
+		return fmt.Errorf("can't wait for the instance to get running: %s", err)
+	}
+	if instance, err = describeInstance(ctx, svc, sshEntry.InstanceID); err != nil {
+		return err
+	}
+	sshEntry.Metadata.State = lib.InstanceStateRunning
+	sshEntry.Metadata.PrivateIPAddress = aws.ToString(instance.PrivateIpAddress)
+	sshEntry.Metadata.PublicIPAddress = aws.ToString(instance.PublicIpAddress)
+
+	// the bastions, session manager and instance connect endpoints reach the instance by its private address,
+	// which doesn't change, and the ssh port can't be probed through them
+	if sshEntry.ProxyJump != "" || sshEntry.Transport != "" {
+		return nil
+	}
+	sshEntry.Address = instanceAddress(instance)
+	var port = sshEntry.Port
+	if port == "" {
+		port = fmt.Sprint(defaultPort)
+	}
+	logCtx.Info("waiting for the ssh port to open")
+	return waitForPort(ctx, net.JoinHostPort(sshEntry.Address, port), probeInterval)
+}
+
+// describeInstance returns the instance by its id
+func describeInstance(ctx context.Context, svc *ec2.Client, instanceID string) (types.Instance, error) {
+	result, err := svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return types.Instance{}, fmt.Errorf("can't get ec2 instance: %s", err)
+	}
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return types.Instance{}, fmt.Errorf("Couldn't find the instance %s", instanceID)
+	}
+	return result.Reservations[0].Instances[0], nil
+}
+
+func instanceState(instance types.Instance) types.InstanceStateName {
+	if instance.State == nil {
+		return ""
+	}
+	return instance.State.Name
+}
+
+// waitForPort tries to connect to the address every interval until it succeeds or ctx is done
+func waitForPort(ctx context.Context, address string, interval time.Duration) error {
+	var dialer net.Dialer
+	for {
+		dialCtx, cancel := context.WithTimeout(ctx, interval)
+		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		cancel()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		log.WithError(err).Debugf("%s isn't reachable yet", address)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s isn't reachable: %s", address, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// confirm asks the question and returns true if the answer is yes.
+// It's always false if the input isn't a terminal, so the scripts don't hang.
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	if file, ok := in.(*os.File); ok && !term.IsTerminal(int(file.Fd())) {
+		return false
+	}
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
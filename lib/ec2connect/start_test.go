@@ -0,0 +1,65 @@
+package ec2connect
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWaitForPort checks the port is probed until it opens, and the waiting stops with the context
+func TestWaitForPort(t *testing.T) {
+	// take a free port and open it a bit later
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return
+		}
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := waitForPort(ctx, address, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := waitForPort(ctx, address, 20*time.Millisecond); err == nil {
+		t.Fatal("closed port is reported as open")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, want := range map[string]bool{
+		"y\n":   true,
+		"Yes\n": true,
+		"yes":   true,
+		"\n":    false,
+		"n\n":   false,
+		"":      false,
+	} {
+		var out bytes.Buffer
+		if got := confirm(strings.NewReader(answer), &out, "start it?"); got != want {
+			t.Errorf("%q: got %v, want %v", answer, got, want)
+		}
+		if out.String() != "start it? [y/N] " {
+			t.Errorf("unexpected prompt %q", out.String())
+		}
+	}
+}
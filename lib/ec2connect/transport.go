@@ -0,0 +1,83 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/eice"
+	"aws-ssh/lib/sshclient"
+	"aws-ssh/lib/ssmsession"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/apex/log"
+)
+
+// hopDialer connects to the first hop directly or, depending on its transport,
+// through Session Manager or the instance connect endpoint. The ctx limits starting the session or the tunnel.
+func hopDialer(ctx context.Context, configs *awsConfigs, sshEntries lib.SSHEntries) sshclient.HopDialer {
+	return func(hop sshclient.Hop) (net.Conn, error) {
+		if hop.Transport == "" {
+			return sshclient.DialDirect(hop)
+		}
+		for _, sshEntry := range sshEntries {
+			if sshEntry.InstanceID != hop.InstanceID {
+				continue
+			}
+			_, port, err := net.SplitHostPort(hop.Address)
+			if err != nil {
+				return nil, err
+			}
+			switch hop.Transport {
+			case lib.TransportSSM:
+				return startSSMSession(ctx, configs, sshEntry, port)
+			case lib.TransportEICE:
+				return openEICETunnel(ctx, configs, sshEntry, port)
+			}
+			return nil, fmt.Errorf("unknown transport %q of %s", hop.Transport, hop.Name)
+		}
+		return nil, fmt.Errorf("unknown instance %s", hop.InstanceID)
+	}
+}
+
+// startSSMSession starts Session Manager session forwarding the connection to the port of the instance
+func startSSMSession(ctx context.Context, configs *awsConfigs, sshEntry *lib.SSHEntry, port string) (*ssmsession.Session, error) {
+	cfg, err := configs.get(sshEntry.ProfileConfig)
+	if err != nil {
+		return nil, err
+	}
+	return ssmsession.Start(ctx, cfg, sshEntry.InstanceID, ssmsession.SSHDocument, map[string][]string{
+		"portNumber": {port},
+	})
+}
+
+// openEICETunnel opens the tunnel to the port of the instance through its instance connect endpoint
+func openEICETunnel(ctx context.Context, configs *awsConfigs, sshEntry *lib.SSHEntry, port string) (net.Conn, error) {
+	if sshEntry.InstanceConnectEndpoint == nil {
+		return nil, fmt.Errorf("%s has no instance connect endpoint", sshEntry.InstanceID)
+	}
+	cfg, err := configs.get(sshEntry.ProfileConfig)
+	if err != nil {
+		return nil, err
+	}
+	address := sshEntry.Metadata.PrivateIPAddress
+	if address == "" {
+		address = sshEntry.Address
+	}
+	endpoint := sshEntry.InstanceConnectEndpoint
+	return eice.OpenTunnel(ctx, cfg, endpoint.ID, endpoint.DNSName, address, port)
+}
+
+// EICETunnel connects stdin and stdout to the port of the host through the instance connect endpoint,
+// it's meant to be used as ssh ProxyCommand
+func EICETunnel(ctx context.Context, profile lib.ProfileConfig, endpoint lib.InstanceConnectEndpoint, host, port string) error {
+	cfg, err := newAWSConfigs().get(profile)
+	if err != nil {
+		return err
+	}
+	log.WithField("endpoint", endpoint.ID).Debugf("opening the tunnel to %s", net.JoinHostPort(host, port))
+	conn, err := eice.OpenTunnel(ctx, cfg, endpoint.ID, endpoint.DNSName, host, port)
+	if err != nil {
+		return err
+	}
+	return pipe(conn)
+}
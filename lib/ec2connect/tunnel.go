@@ -0,0 +1,40 @@
+package ec2connect
+
+import (
+	"aws-ssh/lib"
+	"aws-ssh/lib/sshclient"
+	"context"
+)
+
+// Tunnel forwards the local ports through the first of sshEntries, reaching it through the others,
+// until ctx is done. The key is pushed to all hops on every reconnect, as ec2 connect keeps it for 60 seconds only.
+func Tunnel(ctx context.Context, sshEntries lib.SSHEntries, forwards []sshclient.Forward, options ConnectOptions) error {
+	connect, err := nativeConnector(ctx, sshEntries, options)
+	if err != nil {
+		return err
+	}
+	return sshclient.ServeForwards(ctx, forwards, connect)
+}
+
+// nativeConnector returns the connector to the first of sshEntries with the built-in ssh client,
+// which pushes the key to all hops before connecting. The ctx limits starting the transports of the first hop.
+func nativeConnector(ctx context.Context, sshEntries lib.SSHEntries, options ConnectOptions) (sshclient.Connector, error) {
+	// the built-in client is used, so the key is never needed outside
+	options.Native = true
+	key, err := getSessionKey(options)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := newAWSConfigs()
+	return func() (*sshclient.Client, error) {
+		if _, err := pushKeys(ctx, configs, sshEntries, key.publicKey); err != nil {
+			return nil, err
+		}
+		hops, err := sshclient.HopsFromEntries(sshEntries)
+		if err != nil {
+			return nil, err
+		}
+		return sshclient.DialWith(hopDialer(ctx, configs, sshEntries), hops, key.signer)
+	}, nil
+}
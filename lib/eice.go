@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// TransportEICE connects through EC2 Instance Connect Endpoint of the VPC instead of the bastion
+const TransportEICE = "eice"
+
+// InstanceConnectEndpoint is EC2 Instance Connect Endpoint, which opens tunnels to the instances of its VPC
+type InstanceConnectEndpoint struct {
+	ID,
+	DNSName,
+	VpcID string
+}
+
+// EICETunnelArgs returns aws-ssh command forwarding stdin and stdout to the port of the host through the endpoint of the entry
+func EICETunnelArgs(entry SSHEntry, host, port string) []string {
+	args := []string{"aws-ssh", "eice-tunnel"}
+	if entry.ProfileConfig.Name != "" {
+		args = append(args, "-p", entry.ProfileConfig.Name)
+	}
+	if entry.ProfileConfig.Region != "" {
+		args = append(args, "--region", entry.ProfileConfig.Region)
+	}
+	return append(args, entry.InstanceConnectEndpoint.ID, entry.InstanceConnectEndpoint.DNSName, host, port)
+}
+
+// describeInstanceConnectEndpoints returns the instance connect endpoints in the region which are ready to use
+func describeInstanceConnectEndpoints(ctx context.Context, cfg aws.Config, region string) ([]InstanceConnectEndpoint, error) {
+	regionCfg := cfg.Copy()
+	regionCfg.Region = region
+
+	var endpoints []InstanceConnectEndpoint
+	var nextToken string
+	for {
+		params := url.Values{
+			"Action":  {"DescribeInstanceConnectEndpoints"},
+			"Version": {"2016-11-15"},
+			// the endpoints being created or deleted can't be used
+			"Filter.1.Name":    {"state"},
+			"Filter.1.Value.1": {"create-complete"},
+		}
+		if nextToken != "" {
+			params.Set("NextToken", nextToken)
+		}
+		var output struct {
+			Endpoints []struct {
+				ID      string `xml:"instanceConnectEndpointId"`
+				DNSName string `xml:"dnsName"`
+				VpcID   string `xml:"vpcId"`
+			} `xml:"instanceConnectEndpointSet>item"`
+			NextToken string `xml:"nextToken"`
+		}
+		if err := ec2QueryRequest(ctx, regionCfg, params, &output); err != nil {
+			return nil, err
+		}
+		for _, endpoint := range output.Endpoints {
+			endpoints = append(endpoints, InstanceConnectEndpoint{ID: endpoint.ID, DNSName: endpoint.DNSName, VpcID: endpoint.VpcID})
+		}
+		if nextToken = output.NextToken; nextToken == "" {
+			break
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].ID < endpoints[j].ID })
+	return endpoints, nil
+}
+
+// ec2QueryRequest calls the EC2 query API. The SDK version aws-ssh uses
+// doesn't have the instance connect endpoints yet, so the call is sent with sendAPIRequest.
+func ec2QueryRequest(ctx context.Context, cfg aws.Config, params url.Values, output interface{}) error {
+	data, err := sendAPIRequest(ctx, cfg, apiRequest{
+		ServiceID:   ec2.ServiceID,
+		SigningName: "ec2",
+		Operation:   params.Get("Action"),
+		Method:      http.MethodPost,
+		Path:        "/",
+		ContentType: "application/x-www-form-urlencoded; charset=utf-8",
+		Body:        []byte(params.Encode()),
+	})
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, output)
+}
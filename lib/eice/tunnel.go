@@ -0,0 +1,125 @@
+// Package eice opens tunnels to the instances through EC2 Instance Connect Endpoints,
+// like "aws ec2-instance-connect open-tunnel" does.
+package eice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	signingName = "ec2-instance-connect"
+	// presignExpiry is how long the signed url is valid, the tunnel itself lasts longer
+	presignExpiry = time.Minute
+	// maxTunnelDuration is the longest tunnel the endpoints allow
+	maxTunnelDuration = time.Hour
+	dialTimeout       = 10 * time.Second
+)
+
+// OpenTunnel opens the tunnel to the port of the private address through the endpoint
+func OpenTunnel(ctx context.Context, cfg aws.Config, endpointID, dnsName, address, port string) (net.Conn, error) {
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't get aws credentials: %s", err)
+	}
+	return openTunnel(ctx, "wss://"+dnsName, credentials, cfg.Region, endpointID, address, port)
+}
+
+// openTunnel connects to the websocket of the endpoint at baseURL with the presigned url
+func openTunnel(ctx context.Context, baseURL string, credentials aws.Credentials, region, endpointID, address, port string) (net.Conn, error) {
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	query := url.Values{
+		"instanceConnectEndpointId": {endpointID},
+		"maxTunnelDuration":         {strconv.Itoa(int(maxTunnelDuration / time.Second))},
+		"privateIpAddress":          {address},
+		"remotePort":                {port},
+		"X-Amz-Expires":             {strconv.Itoa(int(presignExpiry / time.Second))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/openTunnel?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	signedURL, _, err := v4.NewSigner().PresignHTTP(ctx, credentials, req, "UNSIGNED-PAYLOAD", signingName, region, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("can't sign the tunnel request: %s", err)
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = dialTimeout
+	conn, resp, err := dialer.DialContext(ctx, signedURL, nil)
+	if err != nil {
+		if resp != nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return nil, fmt.Errorf("can't open the tunnel through %s: %s %s", endpointID, resp.Status, body)
+		}
+		return nil, fmt.Errorf("can't open the tunnel through %s: %s", endpointID, err)
+	}
+	return &tunnelConn{Conn: conn}, nil
+}
+
+// tunnelConn is the tunnel stream, which goes as binary websocket messages both ways
+type tunnelConn struct {
+	*websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex // websocket supports only one writer at a time
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader != nil {
+			n, err := c.reader.Read(b)
+			if err != io.EOF {
+				return n, err
+			}
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		messageType, reader, err := c.Conn.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if messageType == websocket.BinaryMessage {
+			c.reader = reader
+		}
+	}
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,114 @@
+package eice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/gorilla/websocket"
+)
+
+var testCredentials = aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "token"}
+
+// newTestEndpoint starts the websocket server standing in for the endpoint, which checks the signature
+// of the request and echoes the data back, and returns its url
+func newTestEndpoint(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/openTunnel" || query.Get("instanceConnectEndpointId") != "eice-1" ||
+			query.Get("privateIpAddress") != "10.0.0.1" || query.Get("remotePort") != "22" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(query.Get("X-Amz-Credential"), "/eu-west-1/ec2-instance-connect/aws4_request") ||
+			query.Get("X-Amz-Security-Token") != "token" {
+			http.Error(w, "unexpected credentials", http.StatusForbidden)
+			return
+		}
+
+		// sign the request again the same way to check the signature
+		signature := query.Get("X-Amz-Signature")
+		signingTime, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		for _, param := range []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-SignedHeaders", "X-Amz-Security-Token", "X-Amz-Signature"} {
+			query.Del(param)
+		}
+		unsigned, _ := http.NewRequest(http.MethodGet, "ws://"+r.Host+r.URL.Path+"?"+query.Encode(), nil)
+		signed, _, err := v4.NewSigner().PresignHTTP(r.Context(), testCredentials, unsigned, "UNSIGNED-PAYLOAD", signingName, "eu-west-1", signingTime)
+		if err != nil || !strings.Contains(signed, "X-Amz-Signature="+signature) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestOpenTunnel(t *testing.T) {
+	url := newTestEndpoint(t)
+	conn, err := openTunnel(context.Background(), url, testCredentials, "eu-west-1", "eice-1", "10.0.0.1", "22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, data := range []string{"ping", "SSH-2.0-Test"} {
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		// read in small pieces to go through the message boundaries
+		var got []byte
+		var buf = make([]byte, 3)
+		for len(got) < len(data) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, buf[:n]...)
+		}
+		if string(got) != data {
+			t.Errorf("got %q back, want %q", got, data)
+		}
+	}
+}
+
+func TestOpenTunnelRejected(t *testing.T) {
+	url := newTestEndpoint(t)
+	// another secret key doesn't match the signature
+	var credentials = testCredentials
+	credentials.SecretAccessKey = "another"
+	_, err := openTunnel(context.Background(), url, credentials, "eu-west-1", "eice-1", "10.0.0.1", "22")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected the tunnel to be rejected, got %v", err)
+	}
+
+	if _, err := openTunnel(context.Background(), url, testCredentials, "eu-west-1", "eice-1", "10.0.0.1", "ssh"); err == nil {
+		t.Error("expected an error for the invalid port")
+	}
+}
@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/elasticache"
+	elasticacheTypes "github.com/aws/aws-sdk-go-v2/service/elasticache/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Services of the endpoints
+const (
+	ServiceRDS         = "rds"
+	ServiceElastiCache = "elasticache"
+	ServiceOpenSearch  = "opensearch"
+)
+
+// endpointNamePrefixes are added to the endpoint names, so they don't clash with the instance ones
+var endpointNamePrefixes = map[string]string{
+	ServiceRDS:         "db",
+	ServiceElastiCache: "cache",
+	ServiceOpenSearch:  "search",
+}
+
+// describeRegionEndpoints returns the endpoints of all supported services in the region.
+// It returns the endpoints it has found even if some services have failed.
+func describeRegionEndpoints(ctx context.Context, cfg aws.Config, region string) ([]ServiceEndpoint, error) {
+	regionCfg := cfg.Copy()
+	regionCfg.Region = region
+
+	var endpoints []ServiceEndpoint
+	var errors error
+	for service, describe := range map[string]func(context.Context, aws.Config) ([]ServiceEndpoint, error){
+		ServiceRDS:         describeRDSEndpoints,
+		ServiceElastiCache: describeElastiCacheEndpoints,
+		ServiceOpenSearch:  describeOpenSearchEndpoints,
+	} {
+		serviceEndpoints, err := describe(ctx, regionCfg)
+		if err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("%s: %s", service, err))
+			continue
+		}
+		for n := range serviceEndpoints {
+			serviceEndpoints[n].Service = service
+			serviceEndpoints[n].ProfileConfig.Region = region
+		}
+		endpoints = append(endpoints, serviceEndpoints...)
+	}
+	return endpoints, errors
+}
+
+// describeRDSEndpoints returns the endpoints of the db instances and clusters.
+// The instances of the clusters are skipped, as the cluster endpoints should be used instead.
+func describeRDSEndpoints(ctx context.Context, cfg aws.Config) ([]ServiceEndpoint, error) {
+	svc := rds.NewFromConfig(cfg)
+
+	var endpoints []ServiceEndpoint
+	// clusters don't have the vpc id, so it's taken from their instances
+	var clusterVpcs = make(map[string]string)
+	instances := rds.NewDescribeDBInstancesPaginator(svc, &rds.DescribeDBInstancesInput{})
+	for instances.HasMorePages() {
+		result, err := instances.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range result.DBInstances {
+			var vpcID string
+			if instance.DBSubnetGroup != nil {
+				vpcID = aws.ToString(instance.DBSubnetGroup.VpcId)
+			}
+			if clusterID := aws.ToString(instance.DBClusterIdentifier); clusterID != "" {
+				clusterVpcs[clusterID] = vpcID
+				continue
+			}
+			if instance.Endpoint == nil || aws.ToString(instance.Endpoint.Address) == "" {
+				continue // still being created
+			}
+			endpoints = append(endpoints, ServiceEndpoint{
+				ID:      aws.ToString(instance.DBInstanceIdentifier),
+				Address: aws.ToString(instance.Endpoint.Address),
+				Port:    strconv.Itoa(int(instance.Endpoint.Port)),
+				VpcID:   vpcID,
+			})
+		}
+	}
+
+	clusters := rds.NewDescribeDBClustersPaginator(svc, &rds.DescribeDBClustersInput{})
+	for clusters.HasMorePages() {
+		result, err := clusters.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range result.DBClusters {
+			clusterID := aws.ToString(cluster.DBClusterIdentifier)
+			port := strconv.Itoa(int(aws.ToInt32(cluster.Port)))
+			if address := aws.ToString(cluster.Endpoint); address != "" {
+				endpoints = append(endpoints, ServiceEndpoint{ID: clusterID, Address: address, Port: port, VpcID: clusterVpcs[clusterID]})
+			}
+			if address := aws.ToString(cluster.ReaderEndpoint); address != "" {
+				endpoints = append(endpoints, ServiceEndpoint{ID: clusterID + "-ro", Address: address, Port: port, VpcID: clusterVpcs[clusterID]})
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// describeElastiCacheEndpoints returns the endpoints of the replication groups and the standalone cache clusters
+func describeElastiCacheEndpoints(ctx context.Context, cfg aws.Config) ([]ServiceEndpoint, error) {
+	svc := elasticache.NewFromConfig(cfg)
+
+	var subnetGroupVpcs = make(map[string]string)
+	subnetGroups := elasticache.NewDescribeCacheSubnetGroupsPaginator(svc, &elasticache.DescribeCacheSubnetGroupsInput{})
+	for subnetGroups.HasMorePages() {
+		result, err := subnetGroups.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range result.CacheSubnetGroups {
+			subnetGroupVpcs[aws.ToString(group.CacheSubnetGroupName)] = aws.ToString(group.VpcId)
+		}
+	}
+
+	var endpoints []ServiceEndpoint
+	// replication groups don't have the vpc id, so it's taken from their clusters
+	var replicationGroupVpcs = make(map[string]string)
+	cacheClusters := elasticache.NewDescribeCacheClustersPaginator(svc, &elasticache.DescribeCacheClustersInput{
+		ShowCacheNodeInfo: aws.Bool(true),
+	})
+	for cacheClusters.HasMorePages() {
+		result, err := cacheClusters.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range result.CacheClusters {
+			vpcID := subnetGroupVpcs[aws.ToString(cluster.CacheSubnetGroupName)]
+			if groupID := aws.ToString(cluster.ReplicationGroupId); groupID != "" {
+				replicationGroupVpcs[groupID] = vpcID
+				continue
+			}
+			// memcached clusters have the configuration endpoint, redis ones have a single node
+			var endpoint = cluster.ConfigurationEndpoint
+			if endpoint == nil && len(cluster.CacheNodes) > 0 {
+				endpoint = cluster.CacheNodes[0].Endpoint
+			}
+			if endpoint := elastiCacheEndpoint(aws.ToString(cluster.CacheClusterId), endpoint, vpcID); endpoint != nil {
+				endpoints = append(endpoints, *endpoint)
+			}
+		}
+	}
+
+	replicationGroups := elasticache.NewDescribeReplicationGroupsPaginator(svc, &elasticache.DescribeReplicationGroupsInput{})
+	for replicationGroups.HasMorePages() {
+		result, err := replicationGroups.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range result.ReplicationGroups {
+			groupID := aws.ToString(group.ReplicationGroupId)
+			vpcID := replicationGroupVpcs[groupID]
+			// cluster mode enabled groups have the configuration endpoint, the others have the primary one
+			var endpoint = group.ConfigurationEndpoint
+			if endpoint == nil && len(group.NodeGroups) > 0 {
+				endpoint = group.NodeGroups[0].PrimaryEndpoint
+			}
+			if endpoint := elastiCacheEndpoint(groupID, endpoint, vpcID); endpoint != nil {
+				endpoints = append(endpoints, *endpoint)
+			}
+			if group.ConfigurationEndpoint == nil && len(group.NodeGroups) > 0 {
+				if endpoint := elastiCacheEndpoint(groupID+"-ro", group.NodeGroups[0].ReaderEndpoint, vpcID); endpoint != nil {
+					endpoints = append(endpoints, *endpoint)
+				}
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+func elastiCacheEndpoint(id string, endpoint *elasticacheTypes.Endpoint, vpcID string) *ServiceEndpoint {
+	if endpoint == nil || aws.ToString(endpoint.Address) == "" {
+		return nil
+	}
+	return &ServiceEndpoint{
+		ID:      id,
+		Address: aws.ToString(endpoint.Address),
+		Port:    strconv.Itoa(int(endpoint.Port)),
+		VpcID:   vpcID,
+	}
+}
+
+// openSearchDomainStatus is the part of the OpenSearch domain status aws-ssh needs
+type openSearchDomainStatus struct {
+	DomainName string
+	Endpoints  map[string]string
+	VPCOptions struct {
+		VPCId string
+	}
+}
+
+// describeOpenSearchEndpoints returns the endpoints of the OpenSearch (and Elasticsearch) domains in VPCs.
+// The public domains don't need a bastion, so they are skipped.
+func describeOpenSearchEndpoints(ctx context.Context, cfg aws.Config) ([]ServiceEndpoint, error) {
+	var domainNames struct {
+		DomainNames []struct {
+			DomainName string
+		}
+	}
+	if err := openSearchRequest(ctx, cfg, http.MethodGet, "/2021-01-01/domain", nil, &domainNames); err != nil {
+		return nil, err
+	}
+
+	var endpoints []ServiceEndpoint
+	// the domains can only be described 5 at a time
+	for start := 0; start < len(domainNames.DomainNames); start += 5 {
+		var input struct {
+			DomainNames []string
+		}
+		for n := start; n < start+5 && n < len(domainNames.DomainNames); n++ {
+			input.DomainNames = append(input.DomainNames, domainNames.DomainNames[n].DomainName)
+		}
+		var output struct {
+			DomainStatusList []openSearchDomainStatus
+		}
+		if err := openSearchRequest(ctx, cfg, http.MethodPost, "/2021-01-01/opensearch/domain-info", input, &output); err != nil {
+			return nil, err
+		}
+		for _, domain := range output.DomainStatusList {
+			if address, ok := domain.Endpoints["vpc"]; ok {
+				endpoints = append(endpoints, ServiceEndpoint{
+					ID:      domain.DomainName,
+					Address: address,
+					Port:    "443",
+					VpcID:   domain.VPCOptions.VPCId,
+				})
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// openSearchRequest calls the OpenSearch configuration API. The SDK version aws-ssh uses
+// doesn't have the OpenSearch client, so the two calls needed are sent with sendAPIRequest.
+func openSearchRequest(ctx context.Context, cfg aws.Config, method, path string, input, output interface{}) error {
+	var body []byte
+	if input != nil {
+		var err error
+		if body, err = json.Marshal(input); err != nil {
+			return err
+		}
+	}
+	data, err := sendAPIRequest(ctx, cfg, apiRequest{
+		ServiceID:   "OpenSearch",
+		SigningName: "es",
+		Operation:   method + " " + path,
+		Method:      method,
+		Path:        path,
+		ContentType: "application/json",
+		Body:        body,
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, output)
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	linq "gopkg.in/ahmetb/go-linq.v3"
+)
+
+// Explanation tells how the way to reach the instance has been chosen
+type Explanation struct {
+	// Entry is the entry as it's chosen now, it can differ from the cached one
+	Entry SSHEntry
+	// Candidates are the bastions considered for the instance
+	Candidates []BastionCandidate
+	// Steps are the choices in the order they've been made
+	Steps []string
+	// Tags are the tags of the instance aws-ssh uses, by their keys
+	Tags map[string]string
+}
+
+// BastionCandidate is a bastion considered for the instance
+type BastionCandidate struct {
+	InstanceID,
+	Name string
+	// Source is BastionSourceRouted, BastionSourceVPC, BastionSourceGlobal or BastionSourceShared
+	Source string
+	// Score is the length of the longest common subsequence of the bastion and the instance names
+	Score  int
+	Chosen bool
+}
+
+// addf adds the step to the explanation, it does nothing if the explanation is nil
+func (e *Explanation) addf(format string, args ...interface{}) {
+	if e != nil {
+		e.Steps = append(e.Steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// Explain re-runs the choice of the bastion and the address for the instance from the cached profile summaries,
+// the bastions of the other profiles are shared the same way as on update.
+// The cache doesn't keep the instances which have been skipped, so the choice can differ from the live one.
+func Explain(summaries []ProcessedProfileSummary, instanceID string, options TraverseOptions) (Explanation, error) {
+	var described = make([]profileSummary, len(summaries))
+	for n := range summaries {
+		described[n] = summaryFromEntries(summaries[n])
+	}
+	return explain(described, instanceID, options)
+}
+
+// ExplainLive re-runs the choice of the bastion and the address for the instance with the profiles described right now.
+// Only the bastions of the given profiles are shared, so they should include the bastion profile of the instance one.
+func ExplainLive(ctx context.Context, profiles []ProfileConfig, instanceID string, options TraverseOptions) (Explanation, error) {
+	var described []profileSummary
+	for _, profile := range profiles {
+		summary, err := DescribeProfile(ctx, profile, options)
+		if err != nil {
+			return Explanation{}, err
+		}
+		described = append(described, summary)
+	}
+	return explain(described, instanceID, options)
+}
+
+func explain(summaries []profileSummary, instanceID string, options TraverseOptions) (Explanation, error) {
+	shareBastions(summaries)
+
+	var summary profileSummary
+	var instance *types.Instance
+	for m := range summaries {
+		for n := range summaries[m].Instances {
+			if aws.ToString(summaries[m].Instances[n].InstanceId) == instanceID {
+				summary, instance = summaries[m], &summaries[m].Instances[n]
+				break
+			}
+		}
+	}
+	if instance == nil {
+		return Explanation{}, fmt.Errorf("%s isn't found in the profiles", instanceID)
+	}
+
+	var explanation = Explanation{Tags: make(map[string]string)}
+	for _, tag := range instance.Tags {
+		key := aws.ToString(tag.Key)
+		if strings.HasPrefix(key, "x-aws-ssh-") || strings.HasPrefix(key, "aws-ssh-") || key == "Global" {
+			explanation.Tags[key] = aws.ToString(tag.Value)
+		}
+	}
+	if !isRunning(*instance) {
+		explanation.addf("it's %s, so it's never used as a bastion", instance.State.Name)
+	}
+	explanation.Entry = newInstanceEntry(summary, *instance)
+	newRouter(summary, options).route(&explanation.Entry, *instance, getNameFromTags(instance.Tags), &explanation)
+	return explanation, nil
+}
+
+// summaryFromEntries rebuilds the profile summary from the cached entries, as far as they have the data
+func summaryFromEntries(summary ProcessedProfileSummary) profileSummary {
+	var result = profileSummary{
+		ProfileConfig:    summary.ProfileConfig,
+		InstanceRegions:  make(map[string]string),
+		ManagedInstances: make(map[string]bool),
+		VpcCIDRs:         make(map[string][]string),
+	}
+	// the matcher has been checked when the profile was described
+	result.Bastions, _ = summary.BastionMatcher()
+	var endpoints = make(map[string]InstanceConnectEndpoint)
+	for _, entry := range summary.SSHEntries {
+		instance := types.Instance{
+			InstanceId:       aws.String(entry.InstanceID),
+			VpcId:            aws.String(entry.Metadata.VpcID),
+			SubnetId:         aws.String(entry.Metadata.SubnetID),
+			PrivateIpAddress: aws.String(entry.Metadata.PrivateIPAddress),
+			PublicIpAddress:  aws.String(entry.Metadata.PublicIPAddress),
+			LaunchTime:       aws.Time(entry.Metadata.LaunchTime),
+			Tags:             getTagsFromMap(entry.Tags),
+		}
+		if entry.Metadata.State != "" {
+			instance.State = &types.InstanceState{Name: types.InstanceStateName(entry.Metadata.State)}
+		}
+		result.Instances = append(result.Instances, instance)
+		result.InstanceRegions[entry.InstanceID] = entry.ProfileConfig.Region
+		if cidr := entry.Metadata.VpcCIDR; cidr != "" && !linq.From(result.VpcCIDRs[entry.Metadata.VpcID]).Contains(cidr) {
+			result.VpcCIDRs[entry.Metadata.VpcID] = append(result.VpcCIDRs[entry.Metadata.VpcID], cidr)
+		}
+		// only the managed instances have been cached with the ssm transport
+		if entry.Transport == TransportSSM {
+			result.ManagedInstances[entry.InstanceID] = true
+		}
+		if endpoint := entry.InstanceConnectEndpoint; endpoint != nil {
+			endpoints[endpoint.ID] = *endpoint
+		}
+	}
+	for _, endpoint := range endpoints {
+		result.ConnectEndpoints = append(result.ConnectEndpoints, endpoint)
+	}
+	sort.Slice(result.ConnectEndpoints, func(i, j int) bool { return result.ConnectEndpoints[i].ID < result.ConnectEndpoints[j].ID })
+	return result
+}
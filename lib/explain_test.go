@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// TestExplain checks the explanation from the cached entries matches the processed ones
+// and has all the candidates considered
+func TestExplain(t *testing.T) {
+	instance := func(id, vpcID, publicIP string, keyValues ...string) types.Instance {
+		return types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String(vpcID),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			PublicIpAddress:  aws.String(publicIP),
+			Tags:             tags(keyValues...),
+		}
+	}
+	summary := profileSummary{
+		ProfileConfig: ProfileConfig{Name: "prod"},
+		Instances: []types.Instance{
+			instance("i-1", "vpc-1", "54.0.0.1", "Name", "web-bastion"),
+			instance("i-2", "vpc-1", "54.0.0.2", "Name", "db-bastion"),
+			instance("i-3", "vpc-1", "54.0.0.3", "Name", "web", "x-aws-ssh-user", "ubuntu"),
+			instance("i-4", "vpc-2", "54.0.0.4", "Name", "cache"),
+		},
+	}
+	processed := ProcessedProfileSummary{ProfileConfig: summary.ProfileConfig, SSHEntries: processProfileSummary(summary, TraverseOptions{})}
+
+	for _, entry := range processed.SSHEntries {
+		explanation, err := Explain([]ProcessedProfileSummary{processed}, entry.InstanceID, TraverseOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if explanation.Entry.Address != entry.Address || explanation.Entry.ProxyJump != entry.ProxyJump {
+			t.Errorf("%s: explained %s through %q, processed %s through %q", entry.InstanceID,
+				explanation.Entry.Address, explanation.Entry.ProxyJump, entry.Address, entry.ProxyJump)
+		}
+		if len(explanation.Steps) == 0 {
+			t.Errorf("%s: no steps", entry.InstanceID)
+		}
+	}
+
+	explanation, err := Explain([]ProcessedProfileSummary{processed}, "i-3", TraverseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scores = make(map[string]int)
+	var chosen string
+	for _, candidate := range explanation.Candidates {
+		if candidate.Source != BastionSourceVPC {
+			t.Errorf("%s: unexpected source %s", candidate.InstanceID, candidate.Source)
+		}
+		scores[candidate.InstanceID] = candidate.Score
+		if candidate.Chosen {
+			chosen = candidate.InstanceID
+		}
+	}
+	if len(scores) != 2 || scores["i-1"] != 3 || scores["i-2"] != 1 {
+		t.Errorf("unexpected scores %v", scores)
+	}
+	if chosen != explanation.Entry.ProxyJump {
+		t.Errorf("chosen %s, but the proxy jump is %s", chosen, explanation.Entry.ProxyJump)
+	}
+	if explanation.Tags["x-aws-ssh-user"] != "ubuntu" {
+		t.Errorf("unexpected tags %v", explanation.Tags)
+	}
+
+	explanation, err = Explain([]ProcessedProfileSummary{processed}, "i-4", TraverseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanation.Candidates) != 0 || explanation.Entry.Address != "54.0.0.4" {
+		t.Errorf("i-4: got %s with candidates %v", explanation.Entry.Address, explanation.Candidates)
+	}
+
+	if _, err := Explain([]ProcessedProfileSummary{processed}, "i-5", TraverseOptions{}); err == nil {
+		t.Error("unknown instance is explained")
+	}
+}
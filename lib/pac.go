@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PACFile returns the proxy auto-config script sending the connections to the cidrs
+// (and to the EC2 internal host names) through the SOCKS5 proxy, and the rest directly
+func PACFile(proxyAddress string, cidrs []string) (string, error) {
+	var conditions = []string{`dnsDomainIs(host, ".compute.internal")`}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid cidr %q: %s", cidr, err)
+		}
+		// PAC files only support IPv4 networks
+		if network.IP.To4() == nil {
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf(`isInNet(ip, "%s", "%s")`, network.IP, net.IP(network.Mask)))
+	}
+
+	var pac strings.Builder
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	pac.WriteString("    var ip = dnsResolve(host) || \"0.0.0.0\";\n")
+	pac.WriteString("    if (" + strings.Join(conditions, " ||\n        ") + ") {\n")
+	fmt.Fprintf(&pac, "        return \"SOCKS5 %s\";\n", proxyAddress)
+	pac.WriteString("    }\n    return \"DIRECT\";\n}\n")
+	return pac.String(), nil
+}
@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestPACFile(t *testing.T) {
+	pac, err := PACFile("localhost:1080", []string{"10.0.0.0/16", "172.16.4.0/22", "2600:1f18::/56"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `function FindProxyForURL(url, host) {
+    var ip = dnsResolve(host) || "0.0.0.0";
+    if (dnsDomainIs(host, ".compute.internal") ||
+        isInNet(ip, "10.0.0.0", "255.255.0.0") ||
+        isInNet(ip, "172.16.4.0", "255.255.252.0")) {
+        return "SOCKS5 localhost:1080";
+    }
+    return "DIRECT";
+}
+`
+	if pac != expected {
+		t.Errorf("got\n%s\nexpected\n%s", pac, expected)
+	}
+
+	if _, err := PACFile("localhost:1080", []string{"10.0.0.0"}); err == nil {
+		t.Error("expected an error for the invalid cidr")
+	}
+}
@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Paths to reach the instance, in the order SelectPath tries them
+const (
+	PathDirect  = "direct"  // the private address, e.g. over VPN
+	PathBastion = "bastion" // the cached way through the bastions, session manager or instance connect endpoint
+	PathPublic  = "public"  // the public address
+)
+
+const (
+	// DefaultProbeTimeout limits a single probe, the unreachable addresses usually don't answer at all
+	DefaultProbeTimeout = time.Second
+	// DefaultProbeTTL is how long the probe of the private network is trusted, as VPN comes and goes
+	DefaultProbeTTL = 5 * time.Minute
+)
+
+// ProbeResult is the result of probing the private network
+type ProbeResult struct {
+	Reachable bool
+	Checked   time.Time
+}
+
+// ProbeCache keeps the probe results of the private networks by their VPC ids and CIDR blocks
+type ProbeCache interface {
+	// ProbeResult returns the last probe result of the network
+	ProbeResult(network string) (ProbeResult, bool)
+	// SaveProbeResult saves the probe result of the network
+	SaveProbeResult(network string, result ProbeResult) error
+}
+
+// PathOptions configures SelectPath
+type PathOptions struct {
+	// Timeout limits every probe, DefaultProbeTimeout is used if it's not set
+	Timeout time.Duration
+	// TTL is how long the probes of the private networks are cached, DefaultProbeTTL is used if it's not set
+	TTL time.Duration
+	// Port is the port of the instance to probe, like the one ssh connects to through the proxy command.
+	// The ssh port of the instance is used if it's not set.
+	Port string
+}
+
+// SelectPath probes the ways to reach the first entry: its private address directly, then the cached way
+// through the bastions, and then its public address. It returns the entries to connect through
+// for the first path which works and the path. If none of them works, the cached way is kept.
+// The probes of the private addresses are cached per VPC and CIDR block in probes, which can be nil not to cache them.
+func SelectPath(ctx context.Context, sshEntries SSHEntries, probes ProbeCache, options PathOptions) (SSHEntries, string) {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultProbeTimeout
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultProbeTTL
+	}
+	entry := sshEntries[0]
+	port := options.Port
+	if port == "" {
+		port = entryPort(*entry)
+	}
+	logCtx := log.WithField("instance_id", entry.InstanceID)
+	cached := entryPath(*entry)
+	// the stopped instances don't answer, and their public addresses change on start anyway
+	if !entry.Running() {
+		logCtx.Debugf("the instance isn't running, keeping the %s path", cached)
+		return sshEntries, cached
+	}
+
+	if private := entry.Metadata.PrivateIPAddress; private != "" {
+		network := privateNetwork(*entry)
+		if probeNetwork(ctx, network, net.JoinHostPort(private, port), probes, options) {
+			logCtx.Debugf("the private network %s is reachable, connecting to %s directly", network, private)
+			return directEntries(*entry, private), PathDirect
+		}
+	}
+
+	if entry.ProxyJump != "" || entry.Transport != "" {
+		firstHop := sshEntries[len(sshEntries)-1]
+		switch {
+		case firstHop.Transport != "":
+			logCtx.Debugf("the first hop is reached through the %s transport, which doesn't need probing", firstHop.Transport)
+			return sshEntries, PathBastion
+		case firstHop.ProxyJump != "":
+			logCtx.Debugf("the first hop is reached through %s, which isn't cached, so it's left to ssh", firstHop.ProxyJump)
+			return sshEntries, PathBastion
+		}
+		if probe(ctx, net.JoinHostPort(firstHop.Address, entryPort(*firstHop)), options.Timeout) {
+			return sshEntries, PathBastion
+		}
+	}
+
+	if public := entry.Metadata.PublicIPAddress; public != "" {
+		if probe(ctx, net.JoinHostPort(public, port), options.Timeout) {
+			return directEntries(*entry, public), PathPublic
+		}
+	}
+
+	logCtx.Warnf("none of the paths is reachable, trying the %s one", cached)
+	return sshEntries, cached
+}
+
+// entryPath returns the path the entry has been cached with
+func entryPath(entry SSHEntry) string {
+	switch {
+	case entry.ProxyJump != "" || entry.Transport != "":
+		return PathBastion
+	case entry.Address != "" && entry.Address == entry.Metadata.PublicIPAddress:
+		return PathPublic
+	}
+	return PathDirect
+}
+
+// privateNetwork returns the key of the private network of the entry in the probe cache:
+// the VPC id with its CIDR block if it's known, like vpc-1/10.0.0.0/16, as the VPCs of different accounts
+// often share the same CIDR blocks, but only some of them are reachable over VPN
+func privateNetwork(entry SSHEntry) string {
+	switch {
+	case entry.Metadata.VpcID != "" && entry.Metadata.VpcCIDR != "":
+		return entry.Metadata.VpcID + "/" + entry.Metadata.VpcCIDR
+	case entry.Metadata.VpcID != "":
+		return entry.Metadata.VpcID
+	}
+	return entry.Metadata.PrivateIPAddress
+}
+
+// directEntries returns the entry connected to directly at the address
+func directEntries(entry SSHEntry, address string) SSHEntries {
+	entry.Address = address
+	entry.ProxyJump = ""
+	entry.ProxyJumps = nil
+	entry.Transport = ""
+	entry.InstanceConnectEndpoint = nil
+	return SSHEntries{&entry}
+}
+
+func entryPort(entry SSHEntry) string {
+	if entry.Port != "" {
+		return entry.Port
+	}
+	return "22"
+}
+
+// probeNetwork returns true if the private network is reachable, probing it with the address
+// unless there is a fresh result in the cache
+func probeNetwork(ctx context.Context, network, address string, probes ProbeCache, options PathOptions) bool {
+	logCtx := log.WithField("network", network)
+	if probes != nil {
+		if result, ok := probes.ProbeResult(network); ok && time.Since(result.Checked) < options.TTL {
+			logCtx.Debugf("reachable: %t, probed %s ago", result.Reachable, time.Since(result.Checked).Round(time.Second))
+			return result.Reachable
+		}
+	}
+	reachable := probe(ctx, address, options.Timeout)
+	// the interrupted probe doesn't tell anything about the network
+	if probes != nil && ctx.Err() == nil {
+		if err := probes.SaveProbeResult(network, ProbeResult{Reachable: reachable, Checked: time.Now()}); err != nil {
+			logCtx.WithError(err).Warn("can't save the probe result")
+		}
+	}
+	return reachable
+}
+
+// dialProbe connects to the address for the probe, it's replaced in the tests
+var dialProbe = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	var dialer = net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// probe returns true if the address accepts the connection within the timeout.
+// The refused connection doesn't count, as ssh can't connect there either, and it can be refused
+// by something else with the same address, like a router on the way.
+func probe(ctx context.Context, address string, timeout time.Duration) bool {
+	var start = time.Now()
+	conn, err := dialProbe(ctx, address, timeout)
+	logCtx := log.WithFields(log.Fields{"address": address, "duration": time.Since(start).Round(time.Millisecond)})
+	if err == nil {
+		conn.Close()
+		logCtx.Debug("probe: reachable")
+		return true
+	}
+	logCtx.WithError(err).Debug("probe: unreachable")
+	return false
+}
+
+// vpcCIDR returns the CIDR block of the VPC with the address, or the primary one if none of them has it
+func vpcCIDR(cidrs []string, address string) string {
+	ip := net.ParseIP(address)
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+			return cidr
+		}
+	}
+	if len(cidrs) > 0 {
+		return cidrs[0]
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type probeCache map[string]ProbeResult
+
+func (c probeCache) ProbeResult(network string) (ProbeResult, bool) {
+	result, ok := c[network]
+	return result, ok
+}
+
+func (c probeCache) SaveProbeResult(network string, result ProbeResult) error {
+	c[network] = result
+	return nil
+}
+
+// TestSelectPath checks the private address goes first, then the bastion and then the public address
+func TestSelectPath(t *testing.T) {
+	const reachable, unreachable, refused = "10.0.0.1", "10.0.0.2", "10.0.0.3"
+	const port = "22"
+	defer func(dial func(context.Context, string, time.Duration) (net.Conn, error)) { dialProbe = dial }(dialProbe)
+	dialProbe = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		switch address {
+		case net.JoinHostPort(reachable, port):
+			conn, _ := net.Pipe()
+			return conn, nil
+		case net.JoinHostPort(refused, port):
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}
+	}
+
+	entries := func(private, bastion, public string) SSHEntries {
+		return SSHEntries{
+			&SSHEntry{
+				InstanceID: "i-1", Address: private, Port: port, ProxyJump: "i-2",
+				Metadata: InstanceMetadata{VpcID: "vpc-1", VpcCIDR: "10.0.0.0/16", PrivateIPAddress: private, PublicIPAddress: public},
+			},
+			&SSHEntry{InstanceID: "i-2", Address: bastion, Port: port},
+		}
+	}
+	var testCases = []struct {
+		description string
+		entries     SSHEntries
+		probes      probeCache
+		path        string
+		address     string
+		hops        int
+	}{
+		{"private address is reachable", entries(reachable, unreachable, unreachable), probeCache{}, PathDirect, reachable, 1},
+		{"bastion is reachable", entries(unreachable, reachable, reachable), probeCache{}, PathBastion, unreachable, 2},
+		{"public address is reachable", entries(unreachable, unreachable, reachable), probeCache{}, PathPublic, reachable, 1},
+		{"private address refuses the connection", entries(refused, reachable, reachable), probeCache{}, PathBastion, refused, 2},
+		{"nothing is reachable", entries(unreachable, unreachable, unreachable), probeCache{}, PathBastion, unreachable, 2},
+		{"private network is cached as reachable", entries(unreachable, unreachable, unreachable),
+			probeCache{"vpc-1/10.0.0.0/16": {Reachable: true, Checked: time.Now()}}, PathDirect, unreachable, 1},
+		{"private network is cached as unreachable", entries(reachable, reachable, unreachable),
+			probeCache{"vpc-1/10.0.0.0/16": {Reachable: false, Checked: time.Now()}}, PathBastion, reachable, 2},
+		{"cached probe is too old", entries(reachable, unreachable, unreachable),
+			probeCache{"vpc-1/10.0.0.0/16": {Reachable: false, Checked: time.Now().Add(-time.Hour)}}, PathDirect, reachable, 1},
+	}
+	for _, testCase := range testCases {
+		selected, path := SelectPath(context.Background(), testCase.entries, testCase.probes, PathOptions{})
+		if path != testCase.path || selected[0].Address != testCase.address || len(selected) != testCase.hops {
+			t.Errorf("%s: got %s path to %s with %d hops, want %s path to %s with %d hops", testCase.description,
+				path, selected[0].Address, len(selected), testCase.path, testCase.address, testCase.hops)
+		}
+		if testCase.path != PathBastion && selected[0].ProxyJump != "" {
+			t.Errorf("%s: the direct entry still goes through %s", testCase.description, selected[0].ProxyJump)
+		}
+		if _, ok := testCase.probes["vpc-1/10.0.0.0/16"]; !ok {
+			t.Errorf("%s: the probe of the private network isn't cached", testCase.description)
+		}
+	}
+
+	// the VPCs of different accounts share the CIDR block, but only one of them is reachable over VPN
+	var probes = probeCache{}
+	if _, path := SelectPath(context.Background(), entries(reachable, unreachable, unreachable), probes, PathOptions{}); path != PathDirect {
+		t.Errorf("first vpc: got %s path", path)
+	}
+	other := entries(unreachable, reachable, unreachable)
+	other[0].Metadata.VpcID = "vpc-2"
+	if _, path := SelectPath(context.Background(), other, probes, PathOptions{}); path != PathBastion {
+		t.Errorf("second vpc with the same CIDR block: got %s path", path)
+	}
+	if !probes["vpc-1/10.0.0.0/16"].Reachable || probes["vpc-2/10.0.0.0/16"].Reachable {
+		t.Errorf("unexpected probes: %+v", probes)
+	}
+
+	// the proxy command connects to the port given by ssh
+	const proxyPort = "2222"
+	dial := dialProbe
+	dialProbe = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		if address == net.JoinHostPort(unreachable, proxyPort) {
+			address = net.JoinHostPort(reachable, port)
+		}
+		return dial(ctx, address, timeout)
+	}
+	if _, path := SelectPath(context.Background(), entries(unreachable, unreachable, unreachable), probeCache{}, PathOptions{Port: proxyPort}); path != PathDirect {
+		t.Errorf("proxy command port: got %s path", path)
+	}
+
+	// the interrupted probe isn't cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	probes = probeCache{}
+	if _, path := SelectPath(ctx, entries(unreachable, unreachable, unreachable), probes, PathOptions{}); path != PathBastion || len(probes) != 0 {
+		t.Errorf("interrupted probe: got %s path and %d probes", path, len(probes))
+	}
+
+	// the stopped instance isn't probed
+	stopped := entries(reachable, reachable, reachable)
+	stopped[0].Metadata.State = "stopped"
+	probes = probeCache{}
+	if selected, path := SelectPath(context.Background(), stopped, probes, PathOptions{}); path != PathBastion || len(selected) != 2 || len(probes) != 0 {
+		t.Errorf("stopped instance: got %s path with %d hops and %d probes", path, len(selected), len(probes))
+	}
+}
+
+func TestVpcCIDR(t *testing.T) {
+	cidrs := []string{"10.0.0.0/16", "100.64.0.0/16"}
+	for address, want := range map[string]string{
+		"10.0.1.1":    "10.0.0.0/16",
+		"100.64.1.1":  "100.64.0.0/16",
+		"192.168.1.1": "10.0.0.0/16", // the primary one
+		"":            "10.0.0.0/16",
+	} {
+		if got := vpcCIDR(cidrs, address); got != want {
+			t.Errorf("%q: got %s, want %s", address, got, want)
+		}
+	}
+	if got := vpcCIDR(nil, "10.0.1.1"); got != "" {
+		t.Errorf("got %s without the CIDR blocks", got)
+	}
+}
@@ -1,20 +1,27 @@
 package lib
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/apex/log"
 )
 
-// Reconf writes ssh config with profiles into the specified file
-func Reconf(profiles []ProfileConfig, filename string, noProfilePrefix bool) {
-	profileSummaries, err := TraverseProfiles(profiles, noProfilePrefix)
+// Reconf writes ssh config with profiles into the specified file.
+// If proxyCommand is set, it's used for every entry instead of ProxyJump.
+func Reconf(ctx context.Context, profiles []ProfileConfig, filename string, options TraverseOptions, proxyCommand string) {
+	profileSummaries, err := TraverseProfiles(ctx, profiles, options)
 	if err != nil {
 		log.WithError(err).Warn("got some errors")
 	}
+	if ctx.Err() != nil {
+		log.Warn("Interrupted, the config file won't be touched")
+		return
+	}
 
 	var sshEntries []SSHEntry
 
@@ -23,22 +30,35 @@ func Reconf(profiles []ProfileConfig, filename string, noProfilePrefix bool) {
 	for _, summary := range profileSummaries {
 		sshEntries = append(sshEntries, summary.SSHEntries...)
 	}
+	for n := range sshEntries {
+		sshEntries[n].ProxyCommand = proxyCommand
+	}
+	// then the aliases forwarding the ports to the service endpoints through the bastions
+	for _, summary := range profileSummaries {
+		for _, entry := range EndpointEntries(summary) {
+			if proxyCommand != "" {
+				// the alias isn't in the cache, so the proxy command is given the bastion instead
+				entry.ProxyCommand = strings.ReplaceAll(proxyCommand, "%n", entry.InstanceID)
+			}
+			sshEntries = append(sshEntries, entry)
+		}
+	}
 
 	tmpfile, err := ioutil.TempFile(path.Dir(filename), "aws-ssh")
-	ctx := log.WithField("tmpfile", tmpfile.Name())
+	logCtx := log.WithField("tmpfile", tmpfile.Name())
 	if err != nil {
-		ctx.WithError(err).Fatal("Couldn't create a temporary file")
+		logCtx.WithError(err).Fatal("Couldn't create a temporary file")
 	}
 
 	for _, entry := range sshEntries {
 		if _, err := io.WriteString(tmpfile, entry.ConfigFormat()); err != nil {
-			ctx.WithError(err).Fatal("Can't write to the temp file")
+			logCtx.WithError(err).Fatal("Can't write to the temp file")
 		}
 	}
 	if err := tmpfile.Close(); err != nil {
-		ctx.WithError(err).Fatal("Couldn't close the temporary file")
+		logCtx.WithError(err).Fatal("Couldn't close the temporary file")
 	}
 	if err := os.Rename(tmpfile.Name(), filename); err != nil {
-		ctx.WithError(err).Fatalf("Couldn't move the file %s to %s", tmpfile.Name(), filename)
+		logCtx.WithError(err).Fatalf("Couldn't move the file %s to %s", tmpfile.Name(), filename)
 	}
 }
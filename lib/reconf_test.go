@@ -2,6 +2,9 @@ package lib
 
 import (
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
 var testdata = []struct {
@@ -35,6 +38,98 @@ var testdata = []struct {
     Hostname 54.54.54.54
 
 `, description: "entry with jumphost and custom port"},
+	{
+		entry: SSHEntry{
+			Address:    "10.0.0.1",
+			Names:      []string{"i-123456789"},
+			ProxyJump:  "i-2",
+			ProxyJumps: []string{"i-1", "i-2"},
+		},
+		formatted: `Host i-123456789
+    ProxyJump i-1,i-2
+    Hostname 10.0.0.1
+
+`, description: "entry with chain of jumphosts"},
+	{
+		entry: SSHEntry{
+			Address:    "10.0.0.1",
+			Names:      []string{"i-123456789"},
+			ProxyJump:  "jumphost",
+			ProxyJumps: []string{"i-1", "i-2"},
+		},
+		formatted: `Host i-123456789
+    ProxyJump jumphost
+    Hostname 10.0.0.1
+
+`, description: "entry with chain of jumphosts not ending with its jumphost"},
+	{
+		entry: SSHEntry{
+			Address:      "10.0.0.1",
+			Names:        []string{"i-123456789"},
+			IdentityFile: "/tmp/aws-ssh-key",
+		},
+		formatted: `Host i-123456789
+    IdentityFile /tmp/aws-ssh-key
+    IdentitiesOnly yes
+    Hostname 10.0.0.1
+
+`, description: "entry with identity file"},
+	{
+		entry: SSHEntry{
+			Address:      "10.0.0.1",
+			Names:        []string{"i-123456789"},
+			ProxyJump:    "jumphost",
+			ProxyCommand: "aws-ssh proxy-command %n %p %r",
+		},
+		formatted: `Host i-123456789
+    ProxyCommand aws-ssh proxy-command %n %p %r
+    Hostname 10.0.0.1
+
+`, description: "entry with proxy command replacing jumphost"},
+	{
+		entry: SSHEntry{
+			Address:       "54.54.54.54",
+			Names:         []string{"prod-db-main"},
+			User:          "ec2-user",
+			LocalForwards: []string{"5432 main.abc.eu-west-1.rds.amazonaws.com:5432"},
+		},
+		formatted: `Host prod-db-main
+    User ec2-user
+    LocalForward 5432 main.abc.eu-west-1.rds.amazonaws.com:5432
+    Hostname 54.54.54.54
+
+`, description: "service endpoint alias"},
+	{
+		entry: SSHEntry{
+			ProfileConfig: ProfileConfig{Name: "prod", Region: "eu-west-1"},
+			Address:       "10.0.0.1",
+			InstanceID:    "i-123456789",
+			Names:         []string{"prod-app", "i-123456789"},
+			User:          "ec2-user",
+			Transport:     TransportSSM,
+		},
+		formatted: `Host prod-app i-123456789
+    User ec2-user
+    ProxyCommand aws ssm start-session --target i-123456789 --document-name AWS-StartSSHSession --parameters portNumber=%p --profile prod --region eu-west-1
+    Hostname 10.0.0.1
+
+`, description: "entry with ssm transport"},
+	{
+		entry: SSHEntry{
+			ProfileConfig:           ProfileConfig{Name: "prod", Region: "eu-west-1"},
+			Address:                 "10.0.0.1",
+			InstanceID:              "i-123456789",
+			Names:                   []string{"prod-app", "i-123456789"},
+			User:                    "ec2-user",
+			Transport:               TransportEICE,
+			InstanceConnectEndpoint: &InstanceConnectEndpoint{ID: "eice-1", DNSName: "eice-1.ec2-instance-connect-endpoint.eu-west-1.amazonaws.com", VpcID: "vpc-1"},
+		},
+		formatted: `Host prod-app i-123456789
+    User ec2-user
+    ProxyCommand aws-ssh eice-tunnel -p prod --region eu-west-1 eice-1 eice-1.ec2-instance-connect-endpoint.eu-west-1.amazonaws.com %h %p
+    Hostname 10.0.0.1
+
+`, description: "entry with instance connect endpoint"},
 }
 
 // TestConfigFormat tests ConfigFormat function of SSHEntry
@@ -50,3 +145,164 @@ func TestConfigFormat(t *testing.T) {
 		}
 	}
 }
+
+// TestEndpointEntries checks the endpoint aliases go through their bastions
+func TestEndpointEntries(t *testing.T) {
+	summary := ProcessedProfileSummary{
+		SSHEntries: []SSHEntry{
+			{InstanceID: "i-1", Names: []string{"prod-bastion", "i-1"}, Address: "54.54.54.54", User: "ec2-user"},
+		},
+		Endpoints: []ServiceEndpoint{
+			{
+				ProfileConfig: ProfileConfig{Name: "prod", Domain: "example.com"},
+				Name:          "prod-db-main", Address: "main.rds", Port: "5432", ProxyJump: "i-1",
+			},
+			{Name: "prod-cache-main", Address: "main.cache", Port: "6379"}, // no bastion
+		},
+	}
+	entries := EndpointEntries(summary)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	var want = `Host prod-db-main prod-db-main.example.com
+    User ec2-user
+    LocalForward 5432 main.rds:5432
+    Hostname 54.54.54.54
+
+`
+	if got := entries[0].ConfigFormat(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(summary.SSHEntries[0].LocalForwards) > 0 {
+		t.Error("the bastion entry has been changed")
+	}
+}
+
+// TestSSMTransport checks only the managed instances are reached through session manager
+func TestSSMTransport(t *testing.T) {
+	instance := func(id, name string, tags ...types.Tag) types.Instance {
+		return types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String("vpc-1"),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			Tags:             append(tags, types.Tag{Key: aws.String("Name"), Value: aws.String(name)}),
+		}
+	}
+	summary := profileSummary{
+		ProfileConfig: ProfileConfig{Name: "prod"},
+		Instances: []types.Instance{
+			instance("i-1", "bastion"),
+			instance("i-2", "app", types.Tag{Key: aws.String("x-aws-ssh-transport"), Value: aws.String("ssm")}),
+			instance("i-3", "worker", types.Tag{Key: aws.String("x-aws-ssh-transport"), Value: aws.String("SSM")}),
+			instance("i-4", "web"),
+		},
+		ManagedInstances: map[string]bool{"i-2": true, "i-4": true},
+	}
+
+	var want = map[string][2]string{ // transport and proxy jump
+		"i-1": {"", ""},
+		"i-2": {TransportSSM, ""},
+		"i-3": {"", "i-1"}, // not managed
+		"i-4": {"", "i-1"}, // managed, but the transport isn't set
+	}
+	check := func() {
+		t.Helper()
+		for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+			if got := [2]string{entry.Transport, entry.ProxyJump}; got != want[entry.InstanceID] {
+				t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+			}
+		}
+	}
+	check()
+
+	// the profile transport applies to all managed instances
+	summary.Transport = TransportSSM
+	want["i-1"] = [2]string{"", ""}
+	want["i-4"] = [2]string{TransportSSM, ""}
+	check()
+}
+
+// TestInstanceConnectEndpoints checks the instances without public addresses in the VPCs with endpoints
+// are reached through them instead of the bastions
+func TestInstanceConnectEndpoints(t *testing.T) {
+	instance := func(id, vpcID, name, publicIP string) types.Instance {
+		instance := types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String(vpcID),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			Tags:             []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+		}
+		if publicIP != "" {
+			instance.PublicIpAddress = aws.String(publicIP)
+		}
+		return instance
+	}
+	summary := profileSummary{
+		ProfileConfig: ProfileConfig{Name: "prod"},
+		Instances: []types.Instance{
+			instance("i-1", "vpc-1", "bastion", "54.0.0.1"),
+			instance("i-2", "vpc-1", "app", ""),
+			instance("i-3", "vpc-2", "bastion", "54.0.0.3"),
+			instance("i-4", "vpc-2", "app", ""),
+			instance("i-5", "vpc-1", "web", "54.0.0.5"),
+			instance("i-6", "vpc-3", "web", "54.0.0.6"),
+		},
+		ConnectEndpoints: []InstanceConnectEndpoint{
+			{ID: "eice-1", DNSName: "eice-1.example.com", VpcID: "vpc-1"},
+			{ID: "eice-3", DNSName: "eice-3.example.com", VpcID: "vpc-3"},
+		},
+	}
+
+	var want = map[string][3]string{ // transport, endpoint and proxy jump
+		"i-1": {"", "", ""},
+		"i-2": {TransportEICE, "eice-1", ""},
+		"i-3": {"", "", ""},
+		"i-4": {"", "", "i-3"},               // no endpoint in the vpc
+		"i-5": {TransportEICE, "eice-1", ""}, // would go through the bastion
+		"i-6": {"", "", ""},                  // no bastion, but a public address
+	}
+	for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+		var endpointID string
+		if entry.InstanceConnectEndpoint != nil {
+			endpointID = entry.InstanceConnectEndpoint.ID
+		}
+		if got := [3]string{entry.Transport, endpointID, entry.ProxyJump}; got != want[entry.InstanceID] {
+			t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+		}
+	}
+}
+
+// TestStoppedInstances checks the stopped instances are cached with their state, but aren't used as bastions
+func TestStoppedInstances(t *testing.T) {
+	instance := func(id, name string, state types.InstanceStateName) types.Instance {
+		return types.Instance{
+			InstanceId:       aws.String(id),
+			VpcId:            aws.String("vpc-1"),
+			PrivateIpAddress: aws.String("10.0.0." + id[2:]),
+			State:            &types.InstanceState{Name: state},
+			Tags:             []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+		}
+	}
+	summary := profileSummary{
+		ProfileConfig: ProfileConfig{Name: "prod"},
+		Instances: []types.Instance{
+			instance("i-1", "bastion-old", types.InstanceStateNameStopped),
+			instance("i-2", "bastion", types.InstanceStateNameRunning),
+			instance("i-3", "dev", types.InstanceStateNameStopped),
+		},
+	}
+
+	var want = map[string][2]string{ // state and proxy jump
+		"i-1": {"stopped", ""}, // bastions don't go through bastions
+		"i-2": {"running", ""},
+		"i-3": {"stopped", "i-2"},
+	}
+	for _, entry := range processProfileSummary(summary, TraverseOptions{}) {
+		if got := [2]string{entry.Metadata.State, entry.ProxyJump}; got != want[entry.InstanceID] {
+			t.Errorf("%s: got %v, want %v", entry.InstanceID, got, want[entry.InstanceID])
+		}
+		if entry.Running() != (entry.InstanceID == "i-2") {
+			t.Errorf("%s: unexpected Running() %v", entry.InstanceID, entry.Running())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// apiRequest is a call of the AWS API which the SDK version aws-ssh uses doesn't have the client for
+type apiRequest struct {
+	// ServiceID is passed to the custom endpoint resolver like the SDK clients do, e.g. "EC2"
+	ServiceID string
+	// SigningName is the endpoint prefix of the service and the name it's signed with, e.g. "ec2"
+	SigningName string
+	// Operation names the call in the errors
+	Operation   string
+	Method      string
+	Path        string
+	ContentType string
+	Body        []byte
+}
+
+// apiError is the error response of the AWS API. The SDK retryers tell the retryable ones
+// by the status and the error code.
+type apiError struct {
+	Operation  string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Operation, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s: %s", e.Operation, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// HTTPStatusCode returns the status of the response
+func (e *apiError) HTTPStatusCode() int { return e.StatusCode }
+
+// ErrorCode returns the error code of the response, like Throttling
+func (e *apiError) ErrorCode() string { return e.Code }
+
+// sendAPIRequest signs and sends the request to the endpoint of the service in the region of cfg,
+// retrying it the way cfg.Retryer says, and returns the body of the response
+func sendAPIRequest(ctx context.Context, cfg aws.Config, request apiRequest) ([]byte, error) {
+	endpoint, err := resolveEndpoint(cfg, request.ServiceID, request.SigningName)
+	if err != nil {
+		return nil, err
+	}
+	var retryer aws.Retryer = retry.NewStandard()
+	if cfg.Retryer != nil {
+		retryer = cfg.Retryer()
+	}
+	for attempt := 1; ; attempt++ {
+		data, err := sendSignedRequest(ctx, cfg, endpoint, request)
+		if err == nil || ctx.Err() != nil || !retryer.IsErrorRetryable(err) {
+			return data, err
+		}
+		if maxAttempts := retryer.MaxAttempts(); maxAttempts > 0 && attempt >= maxAttempts {
+			return nil, err
+		}
+		delay, delayErr := retryer.RetryDelay(attempt, err)
+		if delayErr != nil {
+			return nil, err
+		}
+		log.WithError(err).Debugf("%s: retrying in %s", request.Operation, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// resolveEndpoint returns the endpoint of the service from the custom resolver of cfg if it has one,
+// so the custom endpoints work as they do with the SDK clients, otherwise the one of the partition of the region
+func resolveEndpoint(cfg aws.Config, serviceID, signingName string) (aws.Endpoint, error) {
+	if cfg.EndpointResolver != nil {
+		endpoint, err := cfg.EndpointResolver.ResolveEndpoint(serviceID, cfg.Region)
+		var notFound *aws.EndpointNotFoundError
+		if err == nil {
+			if endpoint.SigningName == "" {
+				endpoint.SigningName = signingName
+			}
+			if endpoint.SigningRegion == "" {
+				endpoint.SigningRegion = cfg.Region
+			}
+			return endpoint, nil
+		} else if !errors.As(err, &notFound) {
+			return aws.Endpoint{}, fmt.Errorf("can't resolve the %s endpoint: %s", serviceID, err)
+		}
+	}
+	return aws.Endpoint{
+		URL:           fmt.Sprintf("https://%s.%s.%s", signingName, cfg.Region, dnsSuffix(cfg.Region)),
+		SigningName:   signingName,
+		SigningRegion: cfg.Region,
+	}, nil
+}
+
+// dnsSuffix returns the DNS suffix of the partition of the region.
+// GovCloud shares the one of the commercial regions.
+func dnsSuffix(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "amazonaws.com.cn"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "c2s.ic.gov"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "sc2s.sgov.gov"
+	}
+	return "amazonaws.com"
+}
+
+// sendSignedRequest sends a single attempt of the request
+func sendSignedRequest(ctx context.Context, cfg aws.Config, endpoint aws.Endpoint, request apiRequest) ([]byte, error) {
+	url := strings.TrimSuffix(endpoint.URL, "/") + request.Path
+	req, err := http.NewRequestWithContext(ctx, request.Method, url, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+	if request.ContentType != "" {
+		req.Header.Set("Content-Type", request.ContentType)
+	}
+
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(request.Body)
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), endpoint.SigningName, endpoint.SigningRegion, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var client aws.HTTPClient = http.DefaultClient
+	if cfg.HTTPClient != nil {
+		client = cfg.HTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(request.Operation, resp, data)
+	}
+	return data, nil
+}
+
+// newAPIError returns the error of the response, which is either JSON with the code in the header,
+// or XML like the query APIs of EC2 return
+func newAPIError(operation string, resp *http.Response, data []byte) *apiError {
+	var apiErr = &apiError{Operation: operation, StatusCode: resp.StatusCode, Message: string(bytes.TrimSpace(data))}
+	var xmlError struct {
+		Code    string `xml:"Errors>Error>Code"`
+		Message string `xml:"Errors>Error>Message"`
+	}
+	var jsonError struct {
+		Message string // it's "message" or "Message" depending on the service
+	}
+	if errorType := resp.Header.Get("X-Amzn-Errortype"); errorType != "" {
+		apiErr.Code = strings.SplitN(errorType, ":", 2)[0]
+		if json.Unmarshal(data, &jsonError) == nil && jsonError.Message != "" {
+			apiErr.Message = jsonError.Message
+		}
+	} else if xml.Unmarshal(data, &xmlError) == nil && xmlError.Code != "" {
+		apiErr.Code, apiErr.Message = xmlError.Code, xmlError.Message
+	}
+	return apiErr
+}
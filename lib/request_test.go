@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+func testAPIConfig(url string) aws.Config {
+	return aws.Config{
+		Region: "cn-north-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+		}),
+		EndpointResolver: aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			if service != "EC2" {
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			}
+			return aws.Endpoint{URL: url}, nil
+		}),
+		Retryer: func() aws.Retryer {
+			return retry.NewStandard(func(options *retry.StandardOptions) {
+				options.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			})
+		},
+	}
+}
+
+func TestSendAPIRequest(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/cn-north-1/ec2/aws4_request") {
+			t.Errorf("unexpected signature: %s", auth)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch string(body) {
+		case "Action=Throttled":
+			if attempts < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, "<Response><Errors><Error><Code>RequestLimitExceeded</Code><Message>slow down</Message></Error></Errors></Response>")
+				return
+			}
+		case "Action=Denied":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Response><Errors><Error><Code>UnauthorizedOperation</Code><Message>denied</Message></Error></Errors></Response>")
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	cfg := testAPIConfig(server.URL)
+
+	request := func(action string) ([]byte, error) {
+		return sendAPIRequest(context.Background(), cfg, apiRequest{
+			ServiceID: "EC2", SigningName: "ec2", Operation: action, Method: http.MethodPost, Path: "/", Body: []byte("Action=" + action),
+		})
+	}
+	if data, err := request("Throttled"); err != nil || string(data) != "ok" || attempts != 3 {
+		t.Errorf("throttled: got %q, %v after %d attempts", data, err, attempts)
+	}
+	attempts = 0
+	if _, err := request("Denied"); err == nil || err.Error() != "Denied: UnauthorizedOperation: denied" || attempts != 1 {
+		t.Errorf("denied: got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	cfg := testAPIConfig("http://localhost:4566")
+	// the custom endpoint
+	if endpoint, err := resolveEndpoint(cfg, "EC2", "ec2"); err != nil || endpoint.URL != "http://localhost:4566" ||
+		endpoint.SigningName != "ec2" || endpoint.SigningRegion != "cn-north-1" {
+		t.Errorf("custom endpoint: got %+v, %v", endpoint, err)
+	}
+	// the resolver doesn't know the service, so it's the default endpoint of the partition
+	if endpoint, err := resolveEndpoint(cfg, "OpenSearch", "es"); err != nil || endpoint.URL != "https://es.cn-north-1.amazonaws.com.cn" {
+		t.Errorf("default endpoint: got %+v, %v", endpoint, err)
+	}
+	for region, want := range map[string]string{
+		"us-east-1":     "https://es.us-east-1.amazonaws.com",
+		"us-gov-west-1": "https://es.us-gov-west-1.amazonaws.com",
+		"us-iso-east-1": "https://es.us-iso-east-1.c2s.ic.gov",
+	} {
+		if endpoint, _ := resolveEndpoint(aws.Config{Region: region}, "OpenSearch", "es"); endpoint.URL != want {
+			t.Errorf("%s: got %s, want %s", region, endpoint.URL, want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	linq "gopkg.in/ahmetb/go-linq.v3"
+)
+
+// Sources of the bastion candidates
+const (
+	BastionSourceRouted = "routed" // x-aws-ssh-bastion-for lists the instance
+	BastionSourceVPC    = "vpc"    // the bastions of the vpc of the instance
+	BastionSourceGlobal = "global" // the bastions with the global tag
+	BastionSourceShared = "shared" // the bastions of the other profiles
+)
+
+// router chooses the way to reach the instances of the profile: the transport, the bastion and the address
+type router struct {
+	summary profileSummary
+	options TraverseOptions
+
+	// the bastions are sorted by name and then by launch time
+	vpcBastions    map[string][]types.Instance
+	commonBastions []types.Instance
+	routedBastions []types.Instance
+	// the first instance connect endpoint of the vpc is used
+	connectEndpoints map[string]InstanceConnectEndpoint
+}
+
+func newRouter(summary profileSummary, options TraverseOptions) *router {
+	var r = router{
+		summary:          summary,
+		options:          options,
+		vpcBastions:      make(map[string][]types.Instance),
+		connectEndpoints: make(map[string]InstanceConnectEndpoint),
+	}
+	for _, endpoint := range summary.ConnectEndpoints {
+		if _, ok := r.connectEndpoints[endpoint.VpcID]; !ok {
+			r.connectEndpoints[endpoint.VpcID] = endpoint
+		}
+	}
+
+	for _, bastion := range findBastions(summary.Instances, summary.Bastions) {
+		// the bastions with x-aws-ssh-bastion-for are only for the instances they list
+		if isRoutedBastion(bastion.Tags) {
+			r.routedBastions = append(r.routedBastions, bastion)
+			continue
+		}
+		vpcID := aws.ToString(bastion.VpcId)
+		r.vpcBastions[vpcID] = append(r.vpcBastions[vpcID], bastion)
+		if isGlobalFromTags(bastion.Tags) {
+			r.commonBastions = append(r.commonBastions, bastion)
+		}
+	}
+	return &r
+}
+
+// findBastions returns the running bastions among the instances, sorted by name and then by launch time
+func findBastions(instances []types.Instance, matcher BastionMatcher) []types.Instance {
+	var bastions []types.Instance
+	linq.From(instances).OrderBy(instanceNameSorter). // sort by name first
+								ThenBy(instanceLaunchTimeSorter). // then by launch time
+								Where(
+			func(f interface{}) bool {
+				// the stopped instances can't be bastions
+				return isRunning(f.(types.Instance)) && matcher.IsBastion(f.(types.Instance).Tags, false)
+			},
+		).ToSlice(&bastions)
+	return bastions
+}
+
+// shareBastions sets the bastions the instances of the described profiles can go through from the other profiles:
+// all the bastions of the profile set with aws-ssh-bastion-profile, or the global bastions of the other profiles.
+// The bastions routed with x-aws-ssh-bastion-for are only for the instances of their own profile.
+// The failed profiles are empty, so they neither have nor get any.
+func shareBastions(summaries []profileSummary) {
+	var bastions = make(map[string][]types.Instance) // by profile name
+	for n := range summaries {
+		for _, bastion := range findBastions(summaries[n].Instances, summaries[n].Bastions) {
+			if !isRoutedBastion(bastion.Tags) {
+				bastions[summaries[n].Name] = append(bastions[summaries[n].Name], bastion)
+			}
+		}
+	}
+
+	for n := range summaries {
+		var shared []types.Instance
+		if bastionProfile := summaries[n].BastionProfile; bastionProfile != "" {
+			shared = bastions[bastionProfile]
+			if len(shared) == 0 {
+				log.WithFields(log.Fields{"profile": summaries[n].Name, "bastion_profile": bastionProfile}).Warn("no bastions found in the bastion profile")
+			}
+		} else {
+			for name, profileBastions := range bastions {
+				if name == summaries[n].Name {
+					continue
+				}
+				for _, bastion := range profileBastions {
+					if isGlobalFromTags(bastion.Tags) {
+						shared = append(shared, bastion)
+					}
+				}
+			}
+		}
+		// the bastions of several profiles have to be in the same order every time
+		linq.From(shared).OrderBy(instanceNameSorter).ThenBy(instanceLaunchTimeSorter).ToSlice(&summaries[n].SharedBastions)
+	}
+}
+
+// route sets the transport, the bastion and the address of the entry of the instance.
+// The choices are explained to the explanation if it's not nil.
+func (r *router) route(entry *SSHEntry, instance types.Instance, instanceName string, explanation *Explanation) {
+	// proxyJump is the bastion instance id, or the host from x-aws-ssh-proxyjump tag
+	var proxyJump string
+	// the explicitly routed instances aren't switched to the instance connect endpoint
+	var routed bool
+	if instanceTransport(instance, r.summary.Transport) == TransportSSM {
+		// only the instances with ssm agent can be reached through session manager,
+		// the others fall back to the bastions
+		if r.summary.ManagedInstances[entry.InstanceID] {
+			entry.Transport = TransportSSM
+			explanation.addf("the ssm transport is set and SSM agent is online, so it's reached through Session Manager")
+		} else {
+			log.WithFields(log.Fields{"profile": r.summary.Name, "instance_id": entry.InstanceID}).Debug("Instance isn't managed by SSM, using bastions")
+			explanation.addf("the ssm transport is set, but SSM agent isn't online, so it falls back to the bastions")
+		}
+	}
+	if entry.Transport == "" {
+		if proxyJump = GetProxyJumpFromTags(instance.Tags); proxyJump != "" {
+			routed = true
+			explanation.addf("%s tag sets the host to go through to %s", proxyJumpTag, proxyJump)
+		} else if r.summary.Bastions.IsBastion(instance.Tags, false) {
+			explanation.addf("it's a bastion itself, bastions are connected to directly")
+		} else if bastion := r.findBestBastion(BastionSourceRouted, instanceName, bastionsFor(instanceName, entry.Metadata.SubnetID, r.routedBastions), explanation); bastion != nil {
+			proxyJump = aws.ToString(bastion.InstanceId)
+			routed = true
+		} else {
+			// first try to find a bastion from this vpc
+			bastion = r.findBestBastion(BastionSourceVPC, instanceName, r.vpcBastions[entry.Metadata.VpcID], explanation)
+			if bastion == nil { // then try common ones
+				bastion = r.findBestBastion(BastionSourceGlobal, instanceName, r.commonBastions, explanation)
+			} else if len(r.commonBastions) > 0 {
+				explanation.addf("%d global bastions aren't considered, as the vpc has its own", len(r.commonBastions))
+			}
+			// then the ones of the other profiles, the global ones only for the instances
+			// which can't be connected to directly, as they may not reach the other accounts at all
+			if bastion == nil && len(r.summary.SharedBastions) > 0 {
+				if r.summary.BastionProfile != "" || aws.ToString(instance.PublicIpAddress) == "" {
+					if r.summary.BastionProfile != "" {
+						explanation.addf("aws-ssh-bastion-profile shares the bastions of %s", r.summary.BastionProfile)
+					}
+					bastion = r.findBestBastion(BastionSourceShared, instanceName, r.summary.SharedBastions, explanation)
+				} else {
+					explanation.addf("%d global bastions of the other profiles aren't considered, as it has a public address and aws-ssh-bastion-profile isn't set",
+						len(r.summary.SharedBastions))
+				}
+			}
+			if bastion != nil {
+				// refer to the bastion by its instance ID
+				// which we should have a record for
+				proxyJump = aws.ToString(bastion.InstanceId)
+			} else {
+				explanation.addf("there are no bastions for it")
+			}
+		}
+	}
+	// the instance connect endpoint replaces the bastion and reaches the private instances without one,
+	// the instances with public addresses are still connected to directly
+	if endpoint, ok := r.connectEndpoints[entry.Metadata.VpcID]; ok && entry.Transport == "" && !routed &&
+		(proxyJump != "" || aws.ToString(instance.PublicIpAddress) == "") {
+		entry.Transport = TransportEICE
+		entry.InstanceConnectEndpoint = &endpoint
+		if proxyJump != "" {
+			explanation.addf("instance connect endpoint %s of %s replaces the bastion", endpoint.ID, endpoint.VpcID)
+		} else {
+			explanation.addf("instance connect endpoint %s of %s reaches it without a public address", endpoint.ID, endpoint.VpcID)
+		}
+		proxyJump = ""
+	}
+
+	entry.Address = aws.ToString(instance.PrivateIpAddress) // get the private address first as we always have one
+	if proxyJump != "" {                                    // get private address and add proxyhost
+		entry.ProxyJump = proxyJump
+		explanation.addf("the private address %s is used, as it's reached through %s", entry.Address, proxyJump)
+		return
+	}
+	if entry.Transport != "" { // session manager and connect endpoints don't need the public address
+		explanation.addf("the private address %s is used, as it's reached through the %s transport", entry.Address, entry.Transport)
+		return
+	}
+	// get public IP if we have one
+	if publicIP := aws.ToString(instance.PublicIpAddress); publicIP != "" {
+		entry.Address = publicIP
+		explanation.addf("the public address %s is used, as there is no bastion", entry.Address)
+	} else {
+		explanation.addf("the private address %s is used, as there is neither a bastion nor a public address, so it's only reachable from the vpc", entry.Address)
+	}
+}
+
+// findBestBastion finds the best bastion among the ones from the source and explains the choice
+func (r *router) findBestBastion(source, instanceName string, bastions []types.Instance, explanation *Explanation) *types.Instance {
+	bastion := findBestBastion(instanceName, bastions)
+	if explanation != nil && len(bastions) > 0 {
+		for _, candidate := range bastions {
+			name := getNameFromTags(candidate.Tags)
+			explanation.Candidates = append(explanation.Candidates, BastionCandidate{
+				InstanceID: aws.ToString(candidate.InstanceId),
+				Name:       name,
+				Source:     source,
+				Score:      len(lcs(instanceName, name)),
+				Chosen:     aws.ToString(candidate.InstanceId) == aws.ToString(bastion.InstanceId),
+			})
+		}
+		if len(bastions) == 1 {
+			explanation.addf("%s is the only %s bastion", getNameFromTags(bastion.Tags), source)
+		} else {
+			explanation.addf("%s has the lowest score of %d %s bastions: the scores are sorted in ascending order and the first one is taken, so the least similar name wins",
+				getNameFromTags(bastion.Tags), len(bastions), source)
+		}
+	}
+	return bastion
+}
+
+// resolveJumpHosts sets the whole chains of the jump hosts of the entries, following their ProxyJumps
+// through the entries of all profiles. A chain stops at the host which isn't a known instance
+// or is reached with a transport, and the entries with ProxyJump loops keep only their ProxyJump.
+func resolveJumpHosts(summaries []ProcessedProfileSummary) {
+	var entries = make(map[string]*SSHEntry)
+	for n := range summaries {
+		for m := range summaries[n].SSHEntries {
+			entry := &summaries[n].SSHEntries[m]
+			entries[entry.InstanceID] = entry
+		}
+	}
+	// the names are only used if they don't clash with the ids
+	for n := range summaries {
+		for m := range summaries[n].SSHEntries {
+			entry := &summaries[n].SSHEntries[m]
+			for _, name := range entry.Names {
+				if _, ok := entries[name]; !ok {
+					entries[name] = entry
+				}
+			}
+		}
+	}
+
+	for n := range summaries {
+		for m := range summaries[n].SSHEntries {
+			entry := &summaries[n].SSHEntries[m]
+			// session manager and instance connect endpoints don't use the jump hosts
+			if entry.ProxyJump == "" || entry.Transport != "" {
+				continue
+			}
+			chain, err := jumpHostChain(*entry, entries)
+			if err != nil {
+				log.WithFields(log.Fields{"profile": summaries[n].Name, "instance_id": entry.InstanceID}).WithError(err).Warn("can't resolve the jump hosts")
+				continue
+			}
+			// a single jump host is ProxyJump itself
+			if len(chain) > 1 {
+				entry.ProxyJumps = chain
+			}
+		}
+	}
+}
+
+// jumpHostChain returns the jump hosts to reach the entry through, the one to connect to first goes first
+func jumpHostChain(entry SSHEntry, entries map[string]*SSHEntry) ([]string, error) {
+	var chain []string
+	var visited = map[string]bool{entry.InstanceID: true}
+	for jumpHost := entry.ProxyJump; jumpHost != ""; {
+		chain = append([]string{jumpHost}, chain...)
+		next, ok := entries[jumpHost]
+		// the hosts which aren't instances are used as is,
+		// and session manager and instance connect endpoints reach the instance without the jump hosts
+		if !ok || next.Transport != "" {
+			break
+		}
+		if visited[next.InstanceID] {
+			return nil, fmt.Errorf("ProxyJump loop at %s", jumpHost)
+		}
+		visited[next.InstanceID] = true
+		jumpHost = next.ProxyJump
+	}
+	return chain, nil
+}
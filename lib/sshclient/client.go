@@ -0,0 +1,221 @@
+package sshclient
+
+import (
+	"aws-ssh/lib"
+	"fmt"
+	"net"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultPort = "22"
+	dialTimeout = 10 * time.Second
+)
+
+// Hop is a host on the way to the destination
+type Hop struct {
+	Name    string // used for logging only
+	Address string // host:port
+	User    string
+
+	InstanceID string
+	// Transport is lib.TransportSSM or lib.TransportEICE if the hop can't be connected to directly,
+	// it can only be the first hop then
+	Transport string
+}
+
+// HopDialer connects to the first hop
+type HopDialer func(hop Hop) (net.Conn, error)
+
+// Client is ssh client connected through a chain of hops
+type Client struct {
+	*ssh.Client
+
+	// clients of the previous hops, which have to be closed too
+	hops []*ssh.Client
+}
+
+// Close closes the connection to the destination and all hops
+func (c *Client) Close() error {
+	err := c.Client.Close()
+	for n := len(c.hops) - 1; n >= 0; n-- {
+		c.hops[n].Close()
+	}
+	return err
+}
+
+// HopsFromEntries returns the hops to reach the first entry, following its ProxyJump through the other entries.
+// The first hop is the one to connect to directly, and the last one is the first entry itself.
+func HopsFromEntries(sshEntries lib.SSHEntries) ([]Hop, error) {
+	if len(sshEntries) == 0 {
+		return nil, fmt.Errorf("no hosts to connect to")
+	}
+	var hops []Hop
+	var visited = make(map[string]bool)
+	for entry := sshEntries[0]; ; {
+		if visited[entry.InstanceID] {
+			return nil, fmt.Errorf("ProxyJump loop at %s", entry.InstanceID)
+		}
+		visited[entry.InstanceID] = true
+		hops = append([]Hop{entryHop(entry)}, hops...)
+
+		// session manager and instance connect endpoints reach the instance without the jump hosts
+		if entry.ProxyJump == "" || entry.Transport != "" {
+			return hops, nil
+		}
+		next := findEntry(sshEntries, entry.ProxyJump)
+		if next == nil {
+			// not an instance, but a host given as is, like with ssh -J
+			return append([]Hop{rawHop(entry.ProxyJump)}, hops...), nil
+		}
+		entry = next
+	}
+}
+
+func entryHop(entry *lib.SSHEntry) Hop {
+	var port = entry.Port
+	if port == "" {
+		port = defaultPort
+	}
+	var name = entry.InstanceID
+	if len(entry.Names) > 0 {
+		name = entry.Names[0]
+	}
+	return Hop{
+		Name:       name,
+		Address:    net.JoinHostPort(entry.Address, port),
+		User:       entry.User,
+		InstanceID: entry.InstanceID,
+		Transport:  entry.Transport,
+	}
+}
+
+// rawHop parses [user@]host[:port] jump host
+func rawHop(jumpHost string) Hop {
+	var hop = Hop{Name: jumpHost}
+	if n := strings.LastIndex(jumpHost, "@"); n >= 0 {
+		hop.User, jumpHost = jumpHost[:n], jumpHost[n+1:]
+	}
+	if host, port, err := net.SplitHostPort(jumpHost); err == nil {
+		hop.Address = net.JoinHostPort(host, port)
+	} else {
+		hop.Address = net.JoinHostPort(jumpHost, defaultPort)
+	}
+	if hop.User == "" {
+		if current, err := user.Current(); err == nil {
+			hop.User = current.Username
+		}
+	}
+	return hop
+}
+
+// findEntry finds the entry by its instance id or any name
+func findEntry(sshEntries lib.SSHEntries, name string) *lib.SSHEntry {
+	for _, entry := range sshEntries {
+		if entry.InstanceID == name {
+			return entry
+		}
+		for _, entryName := range entry.Names {
+			if entryName == name {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// DialDirect connects to the hop over the network
+func DialDirect(hop Hop) (net.Conn, error) {
+	if hop.Transport != "" {
+		return nil, fmt.Errorf("%s can only be reached through %s", hop.Name, hop.Transport)
+	}
+	return net.DialTimeout("tcp", hop.Address, dialTimeout)
+}
+
+// Dial connects to the last hop through all previous ones, connecting to the first hop directly
+func Dial(hops []Hop, signer ssh.Signer) (*Client, error) {
+	return DialWith(DialDirect, hops, signer)
+}
+
+// hopAddr is the address of a hop, which the transports not connecting over TCP don't know
+type hopAddr string
+
+func (hopAddr) Network() string  { return "tcp" }
+func (a hopAddr) String() string { return string(a) }
+
+// hopConn is a connection to a hop reporting its address as the remote one
+type hopConn struct {
+	net.Conn
+	addr hopAddr
+}
+
+// RemoteAddr is a part of net.Conn
+func (c *hopConn) RemoteAddr() net.Addr { return c.addr }
+
+// withHopAddress makes the connection report the address of the hop if its own one has no port,
+// like the one of an SSM session, as the host key check needs it
+func withHopAddress(conn net.Conn, hop Hop) net.Conn {
+	if addr := conn.RemoteAddr(); addr != nil {
+		if _, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return conn
+		}
+	}
+	return &hopConn{Conn: conn, addr: hopAddr(hop.Address)}
+}
+
+// DialWith connects to the last hop through all previous ones, connecting to the first hop with dial
+func DialWith(dial HopDialer, hops []Hop, signer ssh.Signer) (*Client, error) {
+	hostKeyCallback, err := knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	var client *Client
+	for _, hop := range hops {
+		config := &ssh.ClientConfig{
+			User:            hop.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialTimeout,
+		}
+		ctx := log.WithFields(log.Fields{"host": hop.Name, "address": hop.Address, "user": hop.User})
+		ctx.Debug("connecting")
+
+		var conn net.Conn
+		if client == nil {
+			conn, err = dial(hop)
+			if err == nil {
+				conn = withHopAddress(conn, hop)
+			}
+		} else {
+			conn, err = client.Dial("tcp", hop.Address)
+		}
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, fmt.Errorf("can't connect to %s (%s): %s", hop.Name, hop.Address, err)
+		}
+
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, hop.Address, config)
+		if err != nil {
+			conn.Close()
+			if client != nil {
+				client.Close()
+			}
+			return nil, fmt.Errorf("can't ssh to %s (%s): %s", hop.Name, hop.Address, err)
+		}
+
+		next := &Client{Client: ssh.NewClient(sshConn, chans, reqs)}
+		if client != nil {
+			next.hops = append(client.hops, client.Client)
+		}
+		client = next
+	}
+	return client, nil
+}
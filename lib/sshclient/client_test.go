@@ -0,0 +1,88 @@
+package sshclient
+
+import (
+	"aws-ssh/lib"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHopsFromEntries(t *testing.T) {
+	target := &lib.SSHEntry{InstanceID: "i-1", Names: []string{"app"}, Address: "10.0.0.1", User: "ubuntu", ProxyJump: "i-2"}
+	bastion := &lib.SSHEntry{InstanceID: "i-2", Names: []string{"bastion"}, Address: "1.2.3.4", Port: "2222", User: "ec2-user"}
+
+	hops, err := HopsFromEntries(lib.SSHEntries{target, bastion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Hop{
+		{Name: "bastion", Address: "1.2.3.4:2222", User: "ec2-user", InstanceID: "i-2"},
+		{Name: "app", Address: "10.0.0.1:22", User: "ubuntu", InstanceID: "i-1"},
+	}
+	if !reflect.DeepEqual(hops, want) {
+		t.Errorf("got %+v, want %+v", hops, want)
+	}
+
+	// raw jump host from the command line
+	bastion.ProxyJump = "admin@jump.example.com:2200"
+	hops, err = HopsFromEntries(lib.SSHEntries{target, bastion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 3 || hops[0] != (Hop{Name: "admin@jump.example.com:2200", Address: "jump.example.com:2200", User: "admin"}) {
+		t.Errorf("unexpected raw hop: %+v", hops)
+	}
+
+	// session manager is the first hop
+	bastion.Transport = lib.TransportSSM
+	hops, err = HopsFromEntries(lib.SSHEntries{target, bastion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 2 || hops[0].Transport != lib.TransportSSM {
+		t.Errorf("unexpected hops through session manager: %+v", hops)
+	}
+	if _, err := DialDirect(hops[0]); err == nil {
+		t.Error("expected an error connecting directly to the hop reachable through session manager")
+	}
+	bastion.Transport = ""
+
+	// loops are detected
+	bastion.ProxyJump = "app"
+	if _, err := HopsFromEntries(lib.SSHEntries{target, bastion}); err == nil {
+		t.Error("expected an error for ProxyJump loop")
+	}
+}
+
+// pipeAddr is the address of a connection which isn't a network one, like an SSM session
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "ssm" }
+func (pipeAddr) String() string  { return "ssm" }
+
+type pipeConn struct{ net.Conn }
+
+func (pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func TestDialWithNonTCPConn(t *testing.T) {
+	withTestHome(t)
+	key := newTestKey(t)
+	server := newTestServer(t, key.PublicKey())
+
+	hops := []Hop{{Name: "test", Address: server.address(), User: "test", InstanceID: "i-test", Transport: "ssm"}}
+	dial := func(hop Hop) (net.Conn, error) {
+		conn, err := net.Dial("tcp", server.address())
+		if err != nil {
+			return nil, err
+		}
+		return pipeConn{conn}, nil
+	}
+	// the first connection adds the host key, the second one checks it
+	for n := 0; n < 2; n++ {
+		client, err := DialWith(dial, hops, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+}
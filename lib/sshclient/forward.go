@@ -0,0 +1,118 @@
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// Forward is a local address forwarded to a remote one, like ssh -L
+type Forward struct {
+	LocalAddress  string
+	RemoteAddress string
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s -> %s", f.LocalAddress, f.RemoteAddress)
+}
+
+// ParseForward parses the forward spec in the ssh -L format, which is
+// [bind-address:]port:host:hostport. IPv6 addresses should be in square brackets.
+func ParseForward(spec string) (Forward, error) {
+	parts := splitForwardSpec(spec)
+	if len(parts) == 3 {
+		parts = append([]string{"localhost"}, parts...)
+	}
+	if len(parts) != 4 {
+		return Forward{}, fmt.Errorf("invalid forward %q, should be [bind-address:]port:host:hostport", spec)
+	}
+	for _, port := range []string{parts[1], parts[3]} {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return Forward{}, fmt.Errorf("invalid port %q in forward %q", port, spec)
+		}
+	}
+	if parts[2] == "" {
+		return Forward{}, fmt.Errorf("no remote host in forward %q", spec)
+	}
+	return Forward{
+		LocalAddress:  net.JoinHostPort(parts[0], parts[1]),
+		RemoteAddress: net.JoinHostPort(parts[2], parts[3]),
+	}, nil
+}
+
+// splitForwardSpec splits the spec by colons outside of square brackets, removing the brackets
+func splitForwardSpec(spec string) []string {
+	var parts []string
+	var part strings.Builder
+	var inBrackets bool
+	for _, r := range spec {
+		switch {
+		case r == '[' && !inBrackets:
+			inBrackets = true
+		case r == ']' && inBrackets:
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, part.String())
+}
+
+// ServeForwards listens on the local addresses and forwards the connections through the host
+// until ctx is done. If the connection to the host breaks, it reconnects with a growing delay,
+// and the new local connections wait for it meanwhile. Only the first connection failure is returned.
+func ServeForwards(ctx context.Context, forwards []Forward, connect Connector) error {
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", forward.LocalAddress)
+		if err != nil {
+			client.Close()
+			return fmt.Errorf("can't listen on %s: %s", forward.LocalAddress, err)
+		}
+		listeners = append(listeners, listener)
+		log.WithField("forward", forward.String()).Info("forwarding")
+	}
+
+	var t = newTunnel()
+	for n, listener := range listeners {
+		forward := forwards[n]
+		go t.accept(listener, func(conn net.Conn) { t.forward(ctx, conn, forward) })
+	}
+	t.keepConnected(ctx, client, connect)
+	return nil
+}
+
+// forward forwards the local connection to the remote address of the forward
+func (t *tunnel) forward(ctx context.Context, conn net.Conn, forward Forward) {
+	defer conn.Close()
+	logCtx := log.WithFields(log.Fields{"forward": forward.String(), "client": conn.RemoteAddr().String()})
+
+	remote, err := t.dial(ctx, forward.RemoteAddress)
+	if err != nil {
+		if ctx.Err() == nil {
+			logCtx.WithError(err).Warn("can't connect to the remote address")
+		}
+		return
+	}
+	defer remote.Close()
+	logCtx.Debug("connected")
+	pipe(conn, remote)
+	logCtx.Debug("disconnected")
+}
@@ -0,0 +1,130 @@
+package sshclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	var cases = []struct {
+		spec string
+		want Forward
+		err  bool
+	}{
+		{spec: "5432:db.internal:5432", want: Forward{LocalAddress: "localhost:5432", RemoteAddress: "db.internal:5432"}},
+		{spec: "0.0.0.0:8080:10.0.0.1:80", want: Forward{LocalAddress: "0.0.0.0:8080", RemoteAddress: "10.0.0.1:80"}},
+		{spec: "[::1]:6379:[fd00::1]:6379", want: Forward{LocalAddress: "[::1]:6379", RemoteAddress: "[fd00::1]:6379"}},
+		{spec: "5432:db.internal", err: true},
+		{spec: "abc:db.internal:5432", err: true},
+		{spec: "5432::5432", err: true},
+		{spec: "5432:db.internal:70000", err: true},
+	}
+	for _, c := range cases {
+		got, err := ParseForward(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", c.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.spec, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+}
+
+// newEchoServer returns the address of a server echoing everything back
+func newEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func checkEcho(t *testing.T, address string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q back", buf)
+	}
+}
+
+func TestServeForwardsReconnects(t *testing.T) {
+	withTestHome(t)
+	key := newTestKey(t)
+	server := newTestServer(t, key.PublicKey())
+	forward := Forward{LocalAddress: freeAddress(t), RemoteAddress: newEchoServer(t)}
+
+	var connects int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeForwards(ctx, []Forward{forward}, func() (*Client, error) {
+			atomic.AddInt32(&connects, 1)
+			return Dial([]Hop{{Name: "test", Address: server.address(), User: "test"}}, key)
+		})
+	}()
+
+	// wait for the listener
+	for n := 0; n < 50; n++ {
+		if conn, err := net.Dial("tcp", forward.LocalAddress); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	checkEcho(t, forward.LocalAddress)
+
+	server.dropConnections()
+	// the new connection waits for the reconnect
+	checkEcho(t, forward.LocalAddress)
+	if got := atomic.LoadInt32(&connects); got != 2 {
+		t.Errorf("expected 2 connects, got %d", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package sshclient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/apex/log"
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsCallback checks the host keys against ~/.ssh/known_hosts.
+// Like ssh with StrictHostKeyChecking=accept-new, it adds the unknown hosts to the file,
+// but refuses to connect if the host key has changed.
+func knownHostsCallback() (ssh.HostKeyCallback, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	fileName := path.Join(homeDir, ".ssh", "known_hosts")
+	if err := os.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return nil, err
+	}
+	// knownhosts wants the file to exist
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	callback, err := knownhosts.New(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", fileName, err)
+	}
+
+	var mu sync.Mutex // multiple connections can add hosts at once
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) > 0 {
+			// either known or changed
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		log.WithField("host", hostname).Infof("adding %s host key to %s", ssh.FingerprintSHA256(key), fileName)
+		file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
@@ -0,0 +1,97 @@
+package sshclient
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/apex/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Run runs the command on the remote host attached to stdin, stdout and stderr,
+// or an interactive shell if the command is empty, and returns its exit code.
+func Run(client *ssh.Client, command string) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	session.Stdin, session.Stdout, session.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if command != "" {
+		err = session.Run(command)
+	} else {
+		err = shell(session)
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Exec runs the command on the remote host with the output going to stdout and stderr,
+// and returns its exit code. There is no stdin, so the command can't wait for input.
+func Exec(client *ssh.Client, command string, stdout, stderr io.Writer) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	session.Stdout, session.Stderr = stdout, stderr
+	err = session.Run(command)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus(), nil
+	}
+	return 0, err
+}
+
+// shell runs an interactive shell, with a pty if stdin is a terminal
+func shell(session *ssh.Session) error {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			return err
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		if err := session.RequestPty(termType, height, width, ssh.TerminalModes{}); err != nil {
+			return err
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		// pass the terminal size changes to the remote
+		resize := make(chan os.Signal, 1)
+		signal.Notify(resize, syscall.SIGWINCH)
+		defer signal.Stop(resize)
+		go func() {
+			for range resize {
+				if width, height, err := term.GetSize(fd); err == nil {
+					if err := session.WindowChange(height, width); err != nil {
+						log.WithError(err).Debug("can't change window size")
+					}
+				}
+			}
+		}()
+	}
+
+	if err := session.Shell(); err != nil {
+		return err
+	}
+	return session.Wait()
+}
@@ -0,0 +1,171 @@
+package sshclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// SOCKS5 protocol constants, see RFC 1928
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+// socksHandshakeTimeout limits the time the client has to send its request
+const socksHandshakeTimeout = 10 * time.Second
+
+// ServeSOCKS serves SOCKS5 proxy on the local address, connecting to the requested addresses
+// through the host until ctx is done. The connection to the host is re-established the same way
+// as in ServeForwards. Only the CONNECT command without authentication is supported.
+func ServeSOCKS(ctx context.Context, address string, connect Connector) error {
+	client, err := connect()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("can't listen on %s: %s", address, err)
+	}
+	defer listener.Close()
+	log.WithField("address", listener.Addr().String()).Info("serving socks5 proxy")
+
+	var t = newTunnel()
+	go t.accept(listener, func(conn net.Conn) { t.socks(ctx, conn) })
+	t.keepConnected(ctx, client, connect)
+	return nil
+}
+
+// socks handles the SOCKS5 client connection
+func (t *tunnel) socks(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	logCtx := log.WithField("client", conn.RemoteAddr().String())
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	address, err := socksHandshake(conn)
+	if err != nil {
+		logCtx.WithError(err).Debug("invalid socks request")
+		return
+	}
+	logCtx = logCtx.WithField("address", address)
+
+	remote, err := t.dial(ctx, address)
+	if err != nil {
+		if ctx.Err() == nil {
+			logCtx.WithError(err).Warn("can't connect to the remote address")
+		}
+		socksReply(conn, socksGeneralFailure)
+		return
+	}
+	defer remote.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	logCtx.Debug("connected")
+	pipe(conn, remote)
+	logCtx.Debug("disconnected")
+}
+
+// socksHandshake negotiates the authentication method and reads the request,
+// returning the address to connect to
+func socksHandshake(conn io.ReadWriter) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	var method byte = socksNoAcceptable
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("no supported authentication method")
+	}
+
+	// version, command, reserved, address type
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddressNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+
+	if request[1] != socksConnect {
+		socksReply(conn, socksCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply sends the reply with the status. The bound address isn't known
+// for the connections through ssh, so it's always 0.0.0.0:0.
+func socksReply(conn io.Writer, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,131 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	var cases = []struct {
+		name    string
+		request []byte
+		want    string
+		reply   []byte
+		err     bool
+	}{
+		{
+			name:    "ipv4",
+			request: []byte{5, 1, 0, 5, 1, 0, 1, 10, 0, 0, 1, 0x1f, 0x90},
+			want:    "10.0.0.1:8080",
+			reply:   []byte{5, 0},
+		},
+		{
+			name:    "domain",
+			request: append(append([]byte{5, 2, 2, 0, 5, 1, 0, 3, 11}, "db.internal"...), 0x15, 0x38),
+			want:    "db.internal:5432",
+			reply:   []byte{5, 0},
+		},
+		{
+			name:    "ipv6",
+			request: append(append([]byte{5, 1, 0, 5, 1, 0, 4}, net.ParseIP("fd00::1")...), 0, 80),
+			want:    "[fd00::1]:80",
+			reply:   []byte{5, 0},
+		},
+		{
+			name:    "auth required",
+			request: []byte{5, 1, 2},
+			reply:   []byte{5, 0xff},
+			err:     true,
+		},
+		{
+			name:    "bind",
+			request: []byte{5, 1, 0, 5, 2, 0, 1, 10, 0, 0, 1, 0, 80},
+			reply:   []byte{5, 0, 5, socksCommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0},
+			err:     true,
+		},
+		{
+			name:    "socks4",
+			request: []byte{4, 1, 0, 80, 10, 0, 0, 1, 0},
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		var reply bytes.Buffer
+		conn := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(c.request), &reply}
+		got, err := socksHandshake(conn)
+		if c.err != (err != nil) {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		if !bytes.Equal(reply.Bytes(), c.reply) {
+			t.Errorf("%s: got reply %v, want %v", c.name, reply.Bytes(), c.reply)
+		}
+	}
+}
+
+func TestServeSOCKS(t *testing.T) {
+	withTestHome(t)
+	key := newTestKey(t)
+	server := newTestServer(t, key.PublicKey())
+	echo := newEchoServer(t)
+	address := freeAddress(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeSOCKS(ctx, address, func() (*Client, error) {
+			return Dial([]Hop{{Name: "test", Address: server.address(), User: "test"}}, key)
+		})
+	}()
+
+	var conn net.Conn
+	var err error
+	for n := 0; n < 50; n++ {
+		if conn, err = net.Dial("tcp", address); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	host, portString, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(portString)
+	request := append([]byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}, host...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	request = append(request, "ping"...)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	var response = make([]byte, 2+10+4)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[1] != socksNoAuth || response[3] != socksSucceeded {
+		t.Errorf("unexpected response %v", response[:12])
+	}
+	if string(response[12:]) != "ping" {
+		t.Errorf("got %q back", response[12:])
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
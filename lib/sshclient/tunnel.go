@@ -0,0 +1,148 @@
+package sshclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Connector connects to the host the connections go through
+type Connector func() (*Client, error)
+
+// tunnel keeps the current client, which is nil while reconnecting
+type tunnel struct {
+	mu     sync.Mutex
+	client *Client
+	// ready is closed once there is a client
+	ready chan struct{}
+}
+
+func newTunnel() *tunnel {
+	return &tunnel{ready: make(chan struct{})}
+}
+
+func (t *tunnel) set(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = client
+	close(t.ready)
+}
+
+// clear drops the client if it's still the current one, so the new connections wait for the reconnect
+func (t *tunnel) clear(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client == client {
+		t.client = nil
+		t.ready = make(chan struct{})
+	}
+}
+
+// get returns the current client, waiting for it if it's reconnecting
+func (t *tunnel) get(ctx context.Context) (*Client, error) {
+	for {
+		t.mu.Lock()
+		client, ready := t.client, t.ready
+		t.mu.Unlock()
+		if client != nil {
+			return client, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// keepConnected makes the client available until ctx is done. If the connection breaks,
+// it reconnects with a growing delay. The client is closed in the end.
+func (t *tunnel) keepConnected(ctx context.Context, client *Client, connect Connector) {
+	var delay = minReconnectDelay
+	var err error
+	for {
+		if client != nil {
+			t.set(client)
+			delay = minReconnectDelay
+
+			lost := make(chan error, 1)
+			go func(client *Client) { lost <- client.Wait() }(client)
+			select {
+			case <-ctx.Done():
+				client.Close()
+				return
+			case err := <-lost:
+				log.WithError(err).Warn("connection lost, reconnecting...")
+			}
+			t.clear(client)
+			client.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if client, err = connect(); err != nil {
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			log.WithError(err).Warnf("can't reconnect, retrying in %s", delay)
+		}
+	}
+}
+
+// accept handles the connections until the listener is closed
+func (t *tunnel) accept(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// dial connects to the address through the host. The connection can break before it's noticed,
+// then it's retried once with the new one.
+func (t *tunnel) dial(ctx context.Context, address string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := t.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial("tcp", address)
+		if err == nil {
+			return conn, nil
+		}
+		if _, rejected := err.(*ssh.OpenChannelError); rejected || attempt > 0 {
+			return nil, err
+		}
+		log.WithError(err).Debug("the connection is broken, waiting for the new one")
+		t.clear(client)
+	}
+}
+
+// pipe copies the data both ways until either side closes the connection
+func pipe(local, remote net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"aws-ssh/lib/ssmsession"
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// TransportSSM connects through Session Manager instead of bastions,
+// it's set with "aws-ssh-transport" in the config or x-aws-ssh-transport tag
+const TransportSSM = "ssm"
+
+// GetTransportFromTags gets the transport from tags
+func GetTransportFromTags(tags []types.Tag) string {
+	return strings.ToLower(getTagValue("x-aws-ssh-transport", tags))
+}
+
+// instanceTransport returns the transport of the instance, which is the tag if it's set
+// or the one of the profile otherwise
+func instanceTransport(instance types.Instance, profileTransport string) string {
+	if transport := GetTransportFromTags(instance.Tags); transport != "" {
+		return transport
+	}
+	return strings.ToLower(profileTransport)
+}
+
+// SSMStartSessionArgs returns aws cli command forwarding stdin and stdout to the port of the instance via Session Manager.
+// It needs the session-manager-plugin to be installed.
+func SSMStartSessionArgs(entry SSHEntry, port string) []string {
+	args := []string{
+		"aws", "ssm", "start-session",
+		"--target", entry.InstanceID,
+		"--document-name", ssmsession.SSHDocument,
+		"--parameters", "portNumber=" + port,
+	}
+	if entry.ProfileConfig.Name != "" {
+		args = append(args, "--profile", entry.ProfileConfig.Name)
+	}
+	if entry.ProfileConfig.Region != "" {
+		args = append(args, "--region", entry.ProfileConfig.Region)
+	}
+	return args
+}
+
+// describeManagedInstances returns the ids of the instances in the region which have SSM agent online
+func describeManagedInstances(ctx context.Context, cfg aws.Config, region string) (map[string]bool, error) {
+	regionCfg := cfg.Copy()
+	regionCfg.Region = region
+
+	svc := ssm.NewFromConfig(regionCfg)
+	var managed = make(map[string]bool)
+	paginator := ssm.NewDescribeInstanceInformationPaginator(svc, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmTypes.InstanceInformationStringFilter{
+			{Key: aws.String("PingStatus"), Values: []string{string(ssmTypes.PingStatusOnline)}},
+		},
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, information := range result.InstanceInformationList {
+			managed[aws.ToString(information.InstanceId)] = true
+		}
+	}
+	return managed, nil
+}
+
+// usesSSMTransport checks if any of the instances should be reached through Session Manager
+func usesSSMTransport(instances []types.Instance, profileTransport string) bool {
+	for _, instance := range instances {
+		if instanceTransport(instance, profileTransport) == TransportSSM {
+			return true
+		}
+	}
+	return false
+}
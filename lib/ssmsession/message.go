@@ -0,0 +1,156 @@
+package ssmsession
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message types of the data channel
+const (
+	inputStreamMessage  = "input_stream_data"
+	outputStreamMessage = "output_stream_data"
+	acknowledgeMessage  = "acknowledge"
+	channelClosed       = "channel_closed"
+	startPublication    = "start_publication"
+	pausePublication    = "pause_publication"
+)
+
+// Payload types of the stream messages
+const (
+	payloadOutput            = 1
+	payloadHandshakeRequest  = 5
+	payloadHandshakeResponse = 6
+	payloadHandshakeComplete = 7
+	payloadFlag              = 10
+)
+
+// Flags of the stream messages
+const (
+	flagData = 0
+	flagSyn  = 1
+	flagAck  = 3
+)
+
+// Values of the flag payload
+const (
+	flagDisconnectToPort   = 1
+	flagTerminateSession   = 2
+	flagConnectToPortError = 3
+)
+
+// The binary layout of the message. All numbers are big endian.
+const (
+	messageTypeLength = 32
+
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	schemaVersionOffset  = messageTypeOffset + messageTypeLength
+	createdDateOffset    = schemaVersionOffset + 4
+	sequenceNumberOffset = createdDateOffset + 8
+	flagsOffset          = sequenceNumberOffset + 8
+	messageIDOffset      = flagsOffset + 8
+	payloadDigestOffset  = messageIDOffset + 16
+	payloadTypeOffset    = payloadDigestOffset + sha256.Size
+	payloadLengthOffset  = payloadTypeOffset + 4
+	payloadOffset        = payloadLengthOffset + 4
+
+	// the header length doesn't include the payload length field
+	headerLength = payloadLengthOffset
+)
+
+// uuid is a random message id
+type uuid [16]byte
+
+func newUUID() uuid {
+	var id uuid
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // variant 10
+	return id
+}
+
+func (id uuid) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// message is a message of the data channel
+type message struct {
+	Type           string
+	SchemaVersion  uint32
+	CreatedDate    time.Time
+	SequenceNumber int64
+	Flags          uint64
+	ID             uuid
+	PayloadType    uint32
+	Payload        []byte
+}
+
+func newMessage(messageType string, sequenceNumber int64, flags uint64, payloadType uint32, payload []byte) *message {
+	return &message{
+		Type:           messageType,
+		SchemaVersion:  1,
+		CreatedDate:    time.Now(),
+		SequenceNumber: sequenceNumber,
+		Flags:          flags,
+		ID:             newUUID(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+}
+
+// marshal encodes the message in the binary format of the data channel
+func (m *message) marshal() []byte {
+	var data = make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(data[headerLengthOffset:], headerLength)
+	// the type is padded with spaces
+	copy(data[messageTypeOffset:schemaVersionOffset], m.Type+strings.Repeat(" ", messageTypeLength))
+	binary.BigEndian.PutUint32(data[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(data[createdDateOffset:], uint64(m.CreatedDate.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint64(data[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(data[flagsOffset:], m.Flags)
+	// the id goes as two longs, the least significant one first
+	copy(data[messageIDOffset:], m.ID[8:])
+	copy(data[messageIDOffset+8:], m.ID[:8])
+	digest := sha256.Sum256(m.Payload)
+	copy(data[payloadDigestOffset:], digest[:])
+	binary.BigEndian.PutUint32(data[payloadTypeOffset:], m.PayloadType)
+	binary.BigEndian.PutUint32(data[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(data[payloadOffset:], m.Payload)
+	return data
+}
+
+// unmarshalMessage decodes the message, checking its payload digest
+func unmarshalMessage(data []byte) (*message, error) {
+	if len(data) < payloadOffset {
+		return nil, fmt.Errorf("message is too short: %d bytes", len(data))
+	}
+	// the header can grow in the later schema versions
+	start := int(binary.BigEndian.Uint32(data[headerLengthOffset:])) + 4
+	length := int(binary.BigEndian.Uint32(data[payloadLengthOffset:]))
+	if start < payloadOffset || start+length > len(data) {
+		return nil, fmt.Errorf("invalid message length")
+	}
+
+	var m = &message{
+		Type:           strings.TrimRight(string(data[messageTypeOffset:schemaVersionOffset]), " \x00"),
+		SchemaVersion:  binary.BigEndian.Uint32(data[schemaVersionOffset:]),
+		CreatedDate:    time.Unix(0, int64(binary.BigEndian.Uint64(data[createdDateOffset:]))*int64(time.Millisecond)),
+		SequenceNumber: int64(binary.BigEndian.Uint64(data[sequenceNumberOffset:])),
+		Flags:          binary.BigEndian.Uint64(data[flagsOffset:]),
+		PayloadType:    binary.BigEndian.Uint32(data[payloadTypeOffset:]),
+		Payload:        data[start : start+length],
+	}
+	copy(m.ID[8:], data[messageIDOffset:])
+	copy(m.ID[:8], data[messageIDOffset+8:payloadDigestOffset])
+
+	digest := sha256.Sum256(m.Payload)
+	if !bytes.Equal(digest[:], data[payloadDigestOffset:payloadTypeOffset]) {
+		return nil, fmt.Errorf("invalid payload digest of %s message %d", m.Type, m.SequenceNumber)
+	}
+	return m, nil
+}
@@ -0,0 +1,45 @@
+package ssmsession
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	m := newMessage(inputStreamMessage, 42, flagSyn, payloadOutput, []byte("hello"))
+	m.CreatedDate = time.Unix(1600000000, 123000000)
+	data := m.marshal()
+
+	if len(data) != 120+5 {
+		t.Fatalf("got %d bytes, want 125", len(data))
+	}
+	if got := binary.BigEndian.Uint32(data); got != 116 {
+		t.Errorf("got header length %d, want 116", got)
+	}
+	if got := string(data[4:36]); got != "input_stream_data               " {
+		t.Errorf("got message type %q", got)
+	}
+	// the id is written as the least significant half first
+	if !bytes.Equal(data[64:72], m.ID[8:]) || !bytes.Equal(data[72:80], m.ID[:8]) {
+		t.Errorf("unexpected message id layout %x for %s", data[64:80], m.ID)
+	}
+
+	got, err := unmarshalMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.SequenceNumber != 42 || got.Flags != flagSyn || got.ID != m.ID ||
+		got.PayloadType != payloadOutput || string(got.Payload) != "hello" || !got.CreatedDate.Equal(m.CreatedDate) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+
+	data[len(data)-1] = 'O'
+	if _, err := unmarshalMessage(data); err == nil {
+		t.Error("expected an error for the invalid digest")
+	}
+	if _, err := unmarshalMessage(data[:100]); err == nil {
+		t.Error("expected an error for the short message")
+	}
+}
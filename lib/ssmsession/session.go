@@ -0,0 +1,479 @@
+// Package ssmsession implements the client side of the Session Manager data channel,
+// which is what session-manager-plugin does for aws cli, so the sessions don't need the plugin.
+package ssmsession
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/gorilla/websocket"
+)
+
+// SSHDocument is the Session Manager document forwarding the session to the ssh port,
+// its parameter is portNumber
+const SSHDocument = "AWS-StartSSHSession"
+
+const (
+	clientVersion = "1.2.0.0"
+	// streamPayloadSize is the maximum size of the data sent in one message
+	streamPayloadSize = 1024
+	// handshakeTimeout limits the time to connect the data channel and complete the handshake
+	handshakeTimeout = 30 * time.Second
+	// resendTimeout is the time to wait for the acknowledgement before sending the message again
+	resendTimeout = time.Second
+	// pingInterval keeps the idle connection alive
+	pingInterval = 5 * time.Minute
+)
+
+// errClosed is returned when the session is closed by this side
+var errClosed = errors.New("session is closed")
+
+// Session is the data stream of Session Manager session to the instance port
+type Session struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex // websocket supports only one writer at a time
+
+	mu sync.Mutex // protects all below
+	// sequenceNumber is the one of the next input message
+	sequenceNumber int64
+	// unacknowledged are the sent input messages by their sequence numbers
+	unacknowledged map[int64]*pendingMessage
+	// expected is the sequence number of the next output message,
+	// the ones after it are kept in outOfOrder until it comes
+	expected   int64
+	outOfOrder map[int64]*message
+	// data is the received output not read yet
+	data []byte
+	// dataReady is signalled when there is new data or the session is closed
+	dataReady *sync.Cond
+	// ready is closed once the handshake is complete
+	ready     chan struct{}
+	readyOnce sync.Once
+	err       error // set once the session is closed
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// terminate terminates the session started with Start
+	terminate func()
+}
+
+type pendingMessage struct {
+	message *message
+	sent    time.Time
+}
+
+// Start starts the session with the document on the target instance and connects to it
+func Start(ctx context.Context, cfg aws.Config, target, document string, parameters map[string][]string) (*Session, error) {
+	svc := ssm.NewFromConfig(cfg)
+	result, err := svc.StartSession(ctx, &ssm.StartSessionInput{
+		Target:       aws.String(target),
+		DocumentName: aws.String(document),
+		Parameters:   parameters,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't start ssm session: %s", err)
+	}
+	sessionID := aws.ToString(result.SessionId)
+	logCtx := log.WithFields(log.Fields{"instance_id": target, "session_id": sessionID})
+	logCtx.Debug("started ssm session")
+
+	session, err := Connect(ctx, aws.ToString(result.StreamUrl), aws.ToString(result.TokenValue))
+	terminate := func() {
+		if _, err := svc.TerminateSession(context.Background(), &ssm.TerminateSessionInput{SessionId: result.SessionId}); err != nil {
+			logCtx.WithError(err).Warn("can't terminate ssm session")
+		}
+	}
+	if err != nil {
+		terminate()
+		return nil, err
+	}
+	session.terminate = terminate
+	return session, nil
+}
+
+// Connect opens the data channel of the started session and completes the handshake
+func Connect(ctx context.Context, streamURL, token string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to ssm data channel: %s", err)
+	}
+	openDataChannel, _ := json.Marshal(map[string]string{
+		"MessageSchemaVersion": "1.0",
+		"RequestId":            newUUID().String(),
+		"TokenValue":           token,
+		"ClientId":             newUUID().String(),
+		"ClientVersion":        clientVersion,
+	})
+	if err := conn.WriteMessage(websocket.TextMessage, openDataChannel); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("can't open ssm data channel: %s", err)
+	}
+
+	s := &Session{
+		conn:           conn,
+		unacknowledged: make(map[int64]*pendingMessage),
+		outOfOrder:     make(map[int64]*message),
+		ready:          make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	s.dataReady = sync.NewCond(&s.mu)
+	go s.readLoop()
+	go s.resendLoop()
+
+	select {
+	case <-s.ready:
+		return s, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		s.closeWithError(ctx.Err())
+		return nil, fmt.Errorf("ssm session handshake: %s", ctx.Err())
+	}
+}
+
+// Read reads the output of the session
+func (s *Session) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.data) == 0 && s.err == nil {
+		s.dataReady.Wait()
+	}
+	if len(s.data) == 0 {
+		if s.err == errClosed {
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+	n := copy(b, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// Write sends the data as the input of the session
+func (s *Session) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > streamPayloadSize {
+			chunk = chunk[:streamPayloadSize]
+		}
+		if err := s.sendInput(payloadOutput, append([]byte(nil), chunk...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close terminates the session
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		// let the agent know if it's still there
+		var flag = make([]byte, 4)
+		binary.BigEndian.PutUint32(flag, flagTerminateSession)
+		s.sendInput(payloadFlag, flag)
+		s.closeWithError(errClosed)
+		if s.terminate != nil {
+			s.terminate()
+		}
+	})
+	return nil
+}
+
+// sessionAddr is the address of both ends of the session, which doesn't have network addresses
+type sessionAddr struct{}
+
+func (sessionAddr) Network() string { return "ssm" }
+func (sessionAddr) String() string  { return "ssm" }
+
+// LocalAddr is a part of net.Conn
+func (s *Session) LocalAddr() net.Addr { return sessionAddr{} }
+
+// RemoteAddr is a part of net.Conn
+func (s *Session) RemoteAddr() net.Addr { return sessionAddr{} }
+
+// SetDeadline is a part of net.Conn, the deadlines aren't supported
+func (s *Session) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline is a part of net.Conn, the deadlines aren't supported
+func (s *Session) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is a part of net.Conn, the deadlines aren't supported
+func (s *Session) SetWriteDeadline(t time.Time) error { return nil }
+
+// sendInput sends the input stream message, keeping it until it's acknowledged
+func (s *Session) sendInput(payloadType uint32, payload []byte) error {
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	var flags uint64 = flagData
+	if s.sequenceNumber == 0 {
+		flags = flagSyn
+	}
+	m := newMessage(inputStreamMessage, s.sequenceNumber, flags, payloadType, payload)
+	s.unacknowledged[m.SequenceNumber] = &pendingMessage{message: m, sent: time.Now()}
+	s.sequenceNumber++
+	s.mu.Unlock()
+	return s.send(m)
+}
+
+func (s *Session) send(m *message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, m.marshal())
+}
+
+// acknowledge confirms the output message has been received
+func (s *Session) acknowledge(m *message) error {
+	payload, _ := json.Marshal(acknowledgement{
+		AcknowledgedMessageType:           m.Type,
+		AcknowledgedMessageID:             m.ID.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	return s.send(newMessage(acknowledgeMessage, 0, flagAck, 0, payload))
+}
+
+type acknowledgement struct {
+	AcknowledgedMessageType           string
+	AcknowledgedMessageID             string `json:"AcknowledgedMessageId"`
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+// readLoop handles the messages from the agent until the session is closed
+func (s *Session) readLoop() {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.closeWithError(fmt.Errorf("ssm data channel: %s", err))
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		m, err := unmarshalMessage(data)
+		if err != nil {
+			log.WithError(err).Debug("skipping invalid ssm message")
+			continue
+		}
+		if err := s.handle(m); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(m *message) error {
+	switch m.Type {
+	case outputStreamMessage:
+		if err := s.acknowledge(m); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if m.SequenceNumber < s.expected {
+			// sent again before the acknowledgement reached the agent
+			s.mu.Unlock()
+			return nil
+		}
+		s.outOfOrder[m.SequenceNumber] = m
+		var ordered []*message
+		for next, ok := s.outOfOrder[s.expected]; ok; next, ok = s.outOfOrder[s.expected] {
+			delete(s.outOfOrder, s.expected)
+			ordered = append(ordered, next)
+			s.expected++
+		}
+		s.mu.Unlock()
+
+		for _, m := range ordered {
+			if err := s.handleOutput(m); err != nil {
+				return err
+			}
+		}
+	case acknowledgeMessage:
+		var ack acknowledgement
+		if err := json.Unmarshal(m.Payload, &ack); err != nil {
+			return fmt.Errorf("invalid acknowledgement: %s", err)
+		}
+		s.mu.Lock()
+		delete(s.unacknowledged, ack.AcknowledgedMessageSequenceNumber)
+		s.mu.Unlock()
+	case channelClosed:
+		var closed struct {
+			Output string
+		}
+		json.Unmarshal(m.Payload, &closed)
+		if closed.Output != "" {
+			log.Debugf("ssm channel closed: %s", closed.Output)
+		}
+		return errClosed
+	case startPublication, pausePublication:
+		// the agent buffers the input meanwhile, and the unacknowledged messages are sent again anyway
+	default:
+		log.Debugf("skipping unknown ssm message type %q", m.Type)
+	}
+	return nil
+}
+
+// handleOutput handles the output stream messages in their order
+func (s *Session) handleOutput(m *message) error {
+	switch m.PayloadType {
+	case payloadOutput:
+		s.mu.Lock()
+		s.data = append(s.data, m.Payload...)
+		s.dataReady.Broadcast()
+		s.mu.Unlock()
+		// the agents without the handshake start with the output straight away
+		s.readyOnce.Do(func() { close(s.ready) })
+	case payloadHandshakeRequest:
+		return s.handshake(m.Payload)
+	case payloadHandshakeComplete:
+		s.readyOnce.Do(func() { close(s.ready) })
+	case payloadFlag:
+		if len(m.Payload) >= 4 {
+			switch binary.BigEndian.Uint32(m.Payload) {
+			case flagConnectToPortError:
+				return errors.New("the agent can't connect to the port on the instance")
+			case flagDisconnectToPort, flagTerminateSession:
+				return errClosed
+			}
+		}
+	default:
+		log.Debugf("skipping ssm output payload type %d", m.PayloadType)
+	}
+	return nil
+}
+
+type clientAction struct {
+	ActionType       string
+	ActionParameters json.RawMessage `json:",omitempty"`
+	ActionStatus     int             `json:",omitempty"`
+	Error            string          `json:",omitempty"`
+}
+
+// Statuses of the processed client actions
+const (
+	actionSuccess     = 1
+	actionUnsupported = 3
+)
+
+// handshake responds to the handshake request of the agent. Only the port sessions without
+// the KMS encryption are supported.
+func (s *Session) handshake(payload []byte) error {
+	var request struct {
+		AgentVersion           string
+		RequestedClientActions []clientAction
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("invalid handshake request: %s", err)
+	}
+	log.Debugf("ssm agent version %s", request.AgentVersion)
+
+	var response = struct {
+		ClientVersion          string
+		ProcessedClientActions []clientAction
+		Errors                 []string
+	}{ClientVersion: clientVersion, Errors: []string{}}
+	var handshakeErr error
+	for _, action := range request.RequestedClientActions {
+		processed := clientAction{ActionType: action.ActionType, ActionStatus: actionSuccess}
+		var unsupported error
+		switch action.ActionType {
+		case "SessionType":
+			var parameters struct {
+				SessionType string
+			}
+			json.Unmarshal(action.ActionParameters, &parameters)
+			if parameters.SessionType != "Port" {
+				unsupported = fmt.Errorf("unsupported ssm session type %q", parameters.SessionType)
+			}
+		default:
+			// like KMSEncryption
+			unsupported = fmt.Errorf("unsupported ssm session action %q", action.ActionType)
+		}
+		if unsupported != nil {
+			processed.ActionStatus = actionUnsupported
+			processed.Error = unsupported.Error()
+			response.Errors = append(response.Errors, processed.Error)
+			handshakeErr = unsupported
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+
+	data, _ := json.Marshal(response)
+	if err := s.sendInput(payloadHandshakeResponse, data); err != nil {
+		return err
+	}
+	return handshakeErr
+}
+
+// resendLoop sends the input messages again if they aren't acknowledged in time,
+// and pings the agent to keep the connection
+func (s *Session) resendLoop() {
+	ticker := time.NewTicker(resendTimeout / 4)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			var resend []*message
+			s.mu.Lock()
+			for _, pending := range s.unacknowledged {
+				if now.Sub(pending.sent) >= resendTimeout {
+					pending.sent = now
+					resend = append(resend, pending.message)
+				}
+			}
+			s.mu.Unlock()
+			for _, m := range resend {
+				log.Debugf("sending ssm message %d again", m.SequenceNumber)
+				s.send(m)
+			}
+			if now.Sub(lastPing) >= pingInterval {
+				lastPing = now
+				s.conn.WriteControl(websocket.PingMessage, nil, now.Add(resendTimeout))
+			}
+		}
+	}
+}
+
+// closeWithError closes the session, the first error is kept
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.dataReady.Broadcast()
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == errClosed {
+		return errors.New("ssm session has been closed by the agent")
+	}
+	return s.err
+}
@@ -0,0 +1,232 @@
+package ssmsession
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAgent stands in for the ssm agent side of the data channel
+type testAgent struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	mu     sync.Mutex
+	seq    int64
+	acks   map[int64]bool // acknowledged output messages
+	inputs map[int64]bool // received input messages
+	resent int            // number of the input messages received again
+	// processed are the client actions of the last handshake response
+	processed []clientAction
+}
+
+// newTestAgent starts the websocket server running the agent script for every connection
+// and returns its url
+func newTestAgent(t *testing.T, script func(agent *testAgent)) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var open struct {
+			TokenValue string
+		}
+		if err := conn.ReadJSON(&open); err != nil {
+			t.Error(err)
+			return
+		}
+		if open.TokenValue != "token" {
+			t.Errorf("got token %q", open.TokenValue)
+			return
+		}
+		script(&testAgent{t: t, conn: conn, acks: make(map[int64]bool), inputs: make(map[int64]bool)})
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// output sends the output stream message with the next sequence number
+func (a *testAgent) output(payloadType uint32, payload []byte) *message {
+	m := newMessage(outputStreamMessage, a.seq, flagData, payloadType, payload)
+	a.seq++
+	a.send(m)
+	return m
+}
+
+func (a *testAgent) send(m *message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, m.marshal()); err != nil {
+		a.t.Error(err)
+	}
+}
+
+// input returns the next new input message, acknowledging it unless skipAck is set.
+// The acknowledgements of the output messages are recorded.
+func (a *testAgent) input(skipAck bool) *message {
+	for {
+		_, data, err := a.conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		m, err := unmarshalMessage(data)
+		if err != nil {
+			a.t.Error(err)
+			return nil
+		}
+		if m.Type == acknowledgeMessage {
+			var ack acknowledgement
+			json.Unmarshal(m.Payload, &ack)
+			a.acks[ack.AcknowledgedMessageSequenceNumber] = true
+			continue
+		}
+		if !skipAck {
+			payload, _ := json.Marshal(acknowledgement{
+				AcknowledgedMessageType:           m.Type,
+				AcknowledgedMessageID:             m.ID.String(),
+				AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+			})
+			a.send(newMessage(acknowledgeMessage, 0, flagAck, 0, payload))
+		}
+		if a.inputs[m.SequenceNumber] {
+			a.resent++
+			continue
+		}
+		a.inputs[m.SequenceNumber] = true
+		return m
+	}
+}
+
+func (a *testAgent) handshake(actions string) bool {
+	a.output(payloadHandshakeRequest, []byte(`{"AgentVersion":"3.1.0.0","RequestedClientActions":`+actions+`}`))
+	response := a.input(false)
+	if response == nil || response.PayloadType != payloadHandshakeResponse {
+		a.t.Errorf("expected the handshake response, got %+v", response)
+		return false
+	}
+	var processed struct {
+		ProcessedClientActions []clientAction
+	}
+	json.Unmarshal(response.Payload, &processed)
+	a.processed = processed.ProcessedClientActions
+	for _, action := range processed.ProcessedClientActions {
+		if action.ActionStatus != actionSuccess {
+			return false
+		}
+	}
+	a.output(payloadHandshakeComplete, []byte(`{"HandshakeTimeToComplete":1000000,"CustomerMessage":""}`))
+	return true
+}
+
+const portSession = `[{"ActionType":"SessionType","ActionParameters":{"SessionType":"Port","Properties":{"portNumber":"22"}}}]`
+
+func TestSession(t *testing.T) {
+	url := newTestAgent(t, func(agent *testAgent) {
+		if !agent.handshake(portSession) {
+			return
+		}
+		// the first data isn't acknowledged, so it has to come again
+		first := agent.input(true)
+		if first == nil || first.Flags != flagData || string(first.Payload) != "ping" {
+			t.Errorf("unexpected input %+v", first)
+			return
+		}
+		// the output comes in the wrong order and repeated
+		pong := newMessage(outputStreamMessage, agent.seq, flagData, payloadOutput, []byte("po"))
+		ng := newMessage(outputStreamMessage, agent.seq+1, flagData, payloadOutput, []byte("ng"))
+		agent.seq += 2
+		agent.send(ng)
+		agent.send(pong)
+		agent.send(pong)
+
+		// the resent message gets filtered out, then the termination flag comes
+		terminate := agent.input(false)
+		if terminate == nil || terminate.PayloadType != payloadFlag {
+			t.Errorf("expected the termination flag, got %+v", terminate)
+		}
+		if agent.resent == 0 {
+			t.Error("the unacknowledged input hasn't been sent again")
+		}
+		for seq := int64(0); seq < agent.seq; seq++ {
+			if !agent.acks[seq] {
+				t.Errorf("output %d isn't acknowledged", seq)
+			}
+		}
+	})
+
+	session, err := Connect(context.Background(), url, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 4)
+	if _, err := io.ReadFull(session, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong" {
+		t.Errorf("got %q", buf)
+	}
+	// wait for the resend
+	time.Sleep(2 * resendTimeout)
+	session.Close()
+	if _, err := session.Write([]byte("late")); err == nil {
+		t.Error("expected an error writing to the closed session")
+	}
+}
+
+func TestSessionClosedByAgent(t *testing.T) {
+	url := newTestAgent(t, func(agent *testAgent) {
+		if !agent.handshake(portSession) {
+			return
+		}
+		agent.output(payloadOutput, []byte("bye"))
+		agent.send(newMessage(channelClosed, 0, flagData, 0, []byte(`{"Output":"session terminated"}`)))
+		agent.input(false)
+	})
+
+	session, err := Connect(context.Background(), url, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	data, err := ioutil.ReadAll(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "bye" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestSessionUnsupportedActions(t *testing.T) {
+	done := make(chan struct{})
+	url := newTestAgent(t, func(agent *testAgent) {
+		defer close(done)
+		if agent.handshake(`[{"ActionType":"KMSEncryption","ActionParameters":{"KMSKeyId":"key"}},` + portSession[1:]) {
+			t.Error("KMS encryption has been accepted")
+		}
+		// only the unsupported action fails
+		if len(agent.processed) != 2 || agent.processed[1].ActionStatus != actionSuccess {
+			t.Errorf("the port session hasn't been accepted: %+v", agent.processed)
+		}
+	})
+
+	if _, err := Connect(context.Background(), url, "token"); err == nil || !strings.Contains(err.Error(), "KMSEncryption") {
+		t.Errorf("expected unsupported action error, got %v", err)
+	}
+	<-done
+}
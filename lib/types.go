@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // ProfileConfig represents an entry in aws config
@@ -12,6 +14,20 @@ type ProfileConfig struct {
 	Name, // aws profile name
 	Region, // region
 	Domain string // domain if set with "aws-ssh-domain" in the config
+
+	// Regions to query if set with "aws-ssh-regions" in the config
+	// or with the --regions flag. "all" means all enabled regions.
+	Regions []string `yaml:",omitempty"`
+	// Transport is the way to reach the instances if set with "aws-ssh-transport" in the config,
+	// the default is directly or through the bastions
+	Transport string `yaml:",omitempty"`
+	// BastionProfile is the profile with the bastions for the instances if set with "aws-ssh-bastion-profile" in the config,
+	// e.g. the central networking account reaching the VPCs of this one over Transit Gateway
+	BastionProfile string `yaml:",omitempty"`
+	// BastionName and BastionTag match the bastions of the profile if set with "aws-ssh-bastion-name"
+	// and "aws-ssh-bastion-tag" in the config or with the flags, see NewBastionMatcher
+	BastionName string `yaml:",omitempty"`
+	BastionTag  string `yaml:",omitempty"`
 }
 
 // SSHEntries is a list of SSHEntry with additional function
@@ -33,6 +49,25 @@ func (e SSHEntries) SaveConfig(path string) error {
 	return nil
 }
 
+// ServiceEndpoint is an endpoint of a managed service in a VPC, like a database,
+// which is reachable through a bastion
+type ServiceEndpoint struct {
+	ProfileConfig ProfileConfig `yaml:"profile_config"`
+
+	Name, // canonical name, like profile-db-main
+	Service, // rds, elasticache or opensearch
+	ID, // identifier in the service, like the db instance identifier
+	Address,
+	Port,
+	VpcID,
+	ProxyJump string // instance id of the bastion to reach the endpoint through
+}
+
+// LocalForward returns the endpoint as ssh LocalForward spec, keeping the port the same locally
+func (e ServiceEndpoint) LocalForward() string {
+	return fmt.Sprintf("%s %s:%s", e.Port, e.Address, e.Port)
+}
+
 // SSHEntry represents an entry in ssh config
 type SSHEntry struct {
 	ProfileConfig ProfileConfig `yaml:"profile_config"`
@@ -47,6 +82,114 @@ type SSHEntry struct {
 	// The main identifier is constructed from profile name and instance Name tag
 	// then comes instance id, then there are a couple of more
 	Names []string
+
+	// IdentityFile is the private key to use, it's only set for ec2 connect ephemeral keys
+	IdentityFile string `yaml:",omitempty"`
+	// ProxyJumps is the whole chain of the jump hosts, the one to connect to first goes first
+	// and ProxyJump is the last one. It's only set if the bastion itself is behind other jump hosts.
+	ProxyJumps []string `yaml:"proxy_jumps,omitempty"`
+	// ProxyCommand replaces ProxyJump if set, so the command can take care of the bastion
+	ProxyCommand string `yaml:",omitempty"`
+	// Transport is TransportSSM if the instance is reached through Session Manager instead of the bastion,
+	// or TransportEICE if it's reached through InstanceConnectEndpoint
+	Transport               string                   `yaml:",omitempty"`
+	InstanceConnectEndpoint *InstanceConnectEndpoint `yaml:"instance_connect_endpoint,omitempty"`
+	// LocalForwards are "port host:hostport" specs, they are set for the service endpoint aliases
+	LocalForwards []string `yaml:",omitempty"`
+
+	// Tags of the instance
+	Tags map[string]string `yaml:",omitempty"`
+
+	Metadata InstanceMetadata
+}
+
+// InstanceMetadata represents additional information about the instance,
+// which isn't used in ssh config but helps to tell the instances apart
+type InstanceMetadata struct {
+	InstanceType,
+	AvailabilityZone,
+	VpcID,
+	SubnetID,
+	Platform,
+	ImageID,
+	PrivateIPAddress,
+	PublicIPAddress string
+	// State is the instance state, it's empty in the caches from before the stopped instances were cached
+	State string `yaml:",omitempty"`
+	// VpcCIDR is the CIDR block of the VPC with the private address, it's empty if the VPCs can't be described
+	VpcCIDR string `yaml:",omitempty"`
+
+	LaunchTime time.Time
+}
+
+// InstanceStateRunning is the state of the running instances
+const InstanceStateRunning = "running"
+
+// JumpHosts returns the chain of the jump hosts to reach the entry through, the one to connect to first goes first
+func (e SSHEntry) JumpHosts() []string {
+	if e.ProxyJump == "" {
+		return nil
+	}
+	// the chain can be stale if ProxyJump has been overridden
+	if len(e.ProxyJumps) > 0 && e.ProxyJumps[len(e.ProxyJumps)-1] == e.ProxyJump {
+		return e.ProxyJumps
+	}
+	return []string{e.ProxyJump}
+}
+
+// Running returns true unless the instance has been cached in another state than running
+func (e SSHEntry) Running() bool {
+	return e.Metadata.State == "" || e.Metadata.State == InstanceStateRunning
+}
+
+// Details returns human readable details of the entry
+func (e SSHEntry) Details() string {
+	var output []string
+	add := func(name, value string) {
+		if value != "" {
+			output = append(output, fmt.Sprintf("%-18s %s", name+":", value))
+		}
+	}
+	if len(e.Names) > 0 {
+		add("Name", e.Names[0])
+	}
+	add("Instance ID", e.InstanceID)
+	add("Profile", e.ProfileConfig.Name)
+	add("Region", e.ProfileConfig.Region)
+	if !e.Running() {
+		add("State", e.Metadata.State)
+	}
+	add("Instance type", e.Metadata.InstanceType)
+	add("Availability zone", e.Metadata.AvailabilityZone)
+	add("VPC", e.Metadata.VpcID)
+	add("Subnet", e.Metadata.SubnetID)
+	add("Private IP", e.Metadata.PrivateIPAddress)
+	add("Public IP", e.Metadata.PublicIPAddress)
+	if !e.Metadata.LaunchTime.IsZero() {
+		add("Launched", e.Metadata.LaunchTime.Local().Format("2006-01-02 15:04:05"))
+	}
+	add("Platform", e.Metadata.Platform)
+	add("AMI", e.Metadata.ImageID)
+	add("User", e.User)
+	add("Port", e.Port)
+	add("Bastion", strings.Join(e.JumpHosts(), " -> "))
+	add("Transport", e.Transport)
+	if e.InstanceConnectEndpoint != nil {
+		add("Connect endpoint", e.InstanceConnectEndpoint.ID)
+	}
+
+	if len(e.Tags) > 0 {
+		var keys []string
+		for key := range e.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		output = append(output, "", "Tags:")
+		for _, key := range keys {
+			output = append(output, fmt.Sprintf("  %s = %s", key, e.Tags[key]))
+		}
+	}
+	return strings.Join(output, "\n")
 }
 
 // ConfigFormat returns formatted and stringified SSHEntry ready to use in ssh config
@@ -58,12 +201,24 @@ func (e SSHEntry) ConfigFormat() string {
 	if e.User != "" {
 		output = append(output, fmt.Sprintf("    User %s", e.User))
 	}
-	if e.ProxyJump != "" {
-		output = append(output, fmt.Sprintf("    ProxyJump %s", e.ProxyJump))
+	if e.ProxyCommand != "" {
+		output = append(output, fmt.Sprintf("    ProxyCommand %s", e.ProxyCommand))
+	} else if e.Transport == TransportSSM {
+		output = append(output, fmt.Sprintf("    ProxyCommand %s", strings.Join(SSMStartSessionArgs(e, "%p"), " ")))
+	} else if e.Transport == TransportEICE && e.InstanceConnectEndpoint != nil {
+		output = append(output, fmt.Sprintf("    ProxyCommand %s", strings.Join(EICETunnelArgs(e, "%h", "%p"), " ")))
+	} else if e.ProxyJump != "" {
+		output = append(output, fmt.Sprintf("    ProxyJump %s", strings.Join(e.JumpHosts(), ",")))
 	}
 	if e.Port != "" {
 		output = append(output, fmt.Sprintf("    Port %s", e.Port))
 	}
+	if e.IdentityFile != "" {
+		output = append(output, fmt.Sprintf("    IdentityFile %s", e.IdentityFile), "    IdentitiesOnly yes")
+	}
+	for _, localForward := range e.LocalForwards {
+		output = append(output, fmt.Sprintf("    LocalForward %s", localForward))
+	}
 	output = append(output, fmt.Sprintf("    Hostname %s", e.Address), "\n")
 
 	return strings.Join(output, "\n")
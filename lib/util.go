@@ -30,11 +30,48 @@ func getTagValue(tag string, tags []types.Tag, caseInsensitive ...bool) string {
 
 }
 
+func getTagsMap(tags []types.Tag) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	var tagsMap = make(map[string]string, len(tags))
+	for _, tag := range tags {
+		tagsMap[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tagsMap
+}
+
+func getInstanceMetadata(instance types.Instance) InstanceMetadata {
+	var metadata = InstanceMetadata{
+		InstanceType:     string(instance.InstanceType),
+		VpcID:            aws.ToString(instance.VpcId),
+		SubnetID:         aws.ToString(instance.SubnetId),
+		Platform:         aws.ToString(instance.PlatformDetails),
+		ImageID:          aws.ToString(instance.ImageId),
+		PrivateIPAddress: aws.ToString(instance.PrivateIpAddress),
+		PublicIPAddress:  aws.ToString(instance.PublicIpAddress),
+		LaunchTime:       aws.ToTime(instance.LaunchTime),
+	}
+	if instance.State != nil {
+		metadata.State = string(instance.State.Name)
+	}
+	if instance.Placement != nil {
+		metadata.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+	return metadata
+}
+
+// isRunning returns true if the instance is running, the instances without the state are considered running
+func isRunning(instance types.Instance) bool {
+	return instance.State == nil || instance.State.Name == types.InstanceStateNameRunning
+}
+
 func getNameFromTags(tags []types.Tag) string {
 	return strings.ToLower(getTagValue("Name", tags))
 }
 
-func getPortFromTags(tags []types.Tag) string {
+// GetPortFromTags gets the ssh port from tags
+func GetPortFromTags(tags []types.Tag) string {
 	return strings.ToLower(getTagValue("x-aws-ssh-port", tags))
 }
 
@@ -43,38 +80,30 @@ func GetUserFromTags(tags []types.Tag) string {
 	return strings.ToLower(getTagValue("x-aws-ssh-user", tags))
 }
 
-func isBastionFromTags(tags []types.Tag, checkGlobal bool) bool {
-	if len(tags) > 0 {
-		var name string
-		var global bool
-
-		for _, tag := range tags {
-			switch aws.ToString(tag.Key) {
-			case "Name":
-				name = strings.ToLower(aws.ToString(tag.Value))
-			case "Global", "x-aws-ssh-global":
-				{
-					value := strings.ToLower(aws.ToString(tag.Value))
-					if value == "yes" || value == "true" || value == "1" {
-						global = true
-					}
-				}
-			}
-		}
+// GetSecurityGroupFromTags gets the security group id to allow ssh access in from tags
+func GetSecurityGroupFromTags(tags []types.Tag) string {
+	if groupID := getTagValue("x-aws-ssh-security-group-id", tags); groupID != "" {
+		return groupID
+	}
+	return getTagValue("aws-ssh-security-group-id", tags)
+}
 
-		if strings.Contains(name, bastionCanonicalName) {
-			if checkGlobal {
-				if global {
-					return true
-				}
-			} else {
-				return true
-			}
+// isGlobalFromTags returns true if the bastion is for all VPCs
+func isGlobalFromTags(tags []types.Tag) bool {
+	for _, key := range []string{"Global", "x-aws-ssh-global"} {
+		if isTrue(getTagValue(key, tags)) {
+			return true
 		}
 	}
 	return false
 }
 
+// isTrue returns true if the tag value is "yes", "true" or "1"
+func isTrue(value string) bool {
+	value = strings.ToLower(value)
+	return value == "yes" || value == "true" || value == "1"
+}
+
 type weightType struct {
 	Index, Weight int
 }
@@ -86,8 +115,7 @@ func (w weights) Less(i, j int) bool { return w[i].Weight < w[j].Weight }
 func (w weights) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
 
 func findBestBastion(instanceName string, bastions []types.Instance) *types.Instance {
-	// skip instances with bastionCanonicalName in name
-	if !strings.Contains(instanceName, bastionCanonicalName) && len(bastions) > 0 {
+	if len(bastions) > 0 {
 		if len(bastions) == 1 {
 			return &bastions[0]
 		}
@@ -130,3 +158,40 @@ func instanceNameSorter(i interface{}) interface{} { // sort by instance name
 	instanceName := getNameFromTags(i.(types.Instance).Tags)
 	return instanceName
 }
+
+func getTagsFromMap(tagsMap map[string]string) []types.Tag {
+	var tags []types.Tag
+	for key, value := range tagsMap {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return tags
+}
+
+// FindVPCBastion returns the bastion to reach the vpc through, chosen among the cached entries
+// the same way it's chosen for the instances: the one from the vpc if there is any, otherwise a global one
+func FindVPCBastion(sshEntries []SSHEntry, vpcID string, matcher BastionMatcher) *SSHEntry {
+	var vpcBastions, commonBastions []types.Instance
+	var entries = make(map[string]*SSHEntry)
+	for n, entry := range sshEntries {
+		if !entry.Running() {
+			continue
+		}
+		instance := types.Instance{InstanceId: aws.String(entry.InstanceID), Tags: getTagsFromMap(entry.Tags)}
+		if entry.Metadata.VpcID == vpcID && matcher.IsBastion(instance.Tags, false) {
+			vpcBastions = append(vpcBastions, instance)
+		}
+		if matcher.IsBastion(instance.Tags, true) && !isRoutedBastion(instance.Tags) {
+			commonBastions = append(commonBastions, instance)
+		}
+		entries[entry.InstanceID] = &sshEntries[n]
+	}
+
+	bastion := findBestBastion("", vpcBastions)
+	if bastion == nil {
+		bastion = findBestBastion("", commonBastions)
+	}
+	if bastion == nil {
+		return nil
+	}
+	return entries[aws.ToString(bastion.InstanceId)]
+}